@@ -0,0 +1,270 @@
+package envsubst
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/drone/envsubst/parse"
+)
+
+// ArithError is returned when a $((expression)) arithmetic expansion
+// cannot be evaluated, such as on division by zero or when an operand
+// is not an integer.
+type ArithError struct {
+	Expr    string
+	Message string
+	Pos     parse.Pos
+}
+
+func (e *ArithError) Error() string {
+	return fmt.Sprintf("%d:%d: %s: %s", e.Pos.Line, e.Pos.Col, e.Expr, e.Message)
+}
+
+func (t *Template) evalArith(s *state, node *parse.ArithNode) error {
+	// the arguments are evaluated one level down, as are those of
+	// a function, so that escaping applies only to the result.
+	var w = s.writer
+	var buf bytes.Buffer
+	s.writer = &buf
+	s.depth++
+	for _, n := range node.Args {
+		s.node = n
+		if err := t.eval(s); err != nil {
+			s.depth--
+			return err
+		}
+	}
+	s.depth--
+	s.writer = w
+	s.node = node
+
+	expr := buf.String()
+	if s.opts.allowed != nil {
+		for _, name := range arithNames(expr) {
+			if !s.opts.allowed[name] {
+				_, err := io.WriteString(s.writer, node.Source)
+				return err
+			}
+		}
+	}
+
+	// the variables are looked up as if each were a ${name}
+	// substitution at the position of the expression, so that
+	// defaults and strict mode apply to them alike.
+	a := &arith{expr: expr, lookup: func(name string) (string, bool, error) {
+		return t.lookup(s, &parse.FuncNode{Param: name, Pos: node.Pos}, name)
+	}}
+	v, err := a.eval()
+	if a.lookupErr != nil {
+		return a.lookupErr
+	}
+	if err != nil {
+		return &ArithError{Expr: strings.TrimSpace(expr), Message: err.Error(), Pos: node.Pos}
+	}
+	return t.writeValue(s, strconv.FormatInt(v, 10))
+}
+
+// arith evaluates an integer arithmetic expression supporting the
+// + - * / % operators, unary + and -, parentheses and variables. An
+// unset or empty variable evaluates to 0.
+type arith struct {
+	expr   string
+	pos    int
+	lookup func(string) (string, bool, error)
+
+	// the error returned by lookup, if any, which is
+	// reported as is rather than as an ArithError.
+	lookupErr error
+}
+
+func (a *arith) eval() (int64, error) {
+	v, err := a.sum()
+	if err != nil {
+		return 0, err
+	}
+	if a.skip(); a.pos < len(a.expr) {
+		return 0, fmt.Errorf("syntax error near %q", a.expr[a.pos:])
+	}
+	return v, nil
+}
+
+// sum parses the + and - operators.
+func (a *arith) sum() (int64, error) {
+	v, err := a.product()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch a.next() {
+		case '+':
+			a.pos++
+			w, err := a.product()
+			if err != nil {
+				return 0, err
+			}
+			v += w
+		case '-':
+			a.pos++
+			w, err := a.product()
+			if err != nil {
+				return 0, err
+			}
+			v -= w
+		default:
+			return v, nil
+		}
+	}
+}
+
+// product parses the * / and % operators.
+func (a *arith) product() (int64, error) {
+	v, err := a.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := a.next()
+		switch op {
+		case '*', '/', '%':
+		default:
+			return v, nil
+		}
+		a.pos++
+		w, err := a.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case op == '*':
+			v *= w
+		case w == 0:
+			return 0, fmt.Errorf("division by zero")
+		case op == '/':
+			v /= w
+		default:
+			v %= w
+		}
+	}
+}
+
+// unary parses the unary + and - operators.
+func (a *arith) unary() (int64, error) {
+	switch a.next() {
+	case '+':
+		a.pos++
+		return a.unary()
+	case '-':
+		a.pos++
+		v, err := a.unary()
+		return -v, err
+	}
+	return a.operand()
+}
+
+// operand parses a number, variable or parenthesized expression.
+func (a *arith) operand() (int64, error) {
+	c := a.next()
+	switch {
+	case c == '(':
+		a.pos++
+		v, err := a.sum()
+		if err != nil {
+			return 0, err
+		}
+		if a.next() != ')' {
+			return 0, fmt.Errorf("missing )")
+		}
+		a.pos++
+		return v, nil
+	case isDigit(c):
+		start := a.pos
+		for a.pos < len(a.expr) && isNameChar(a.expr[a.pos]) {
+			a.pos++
+		}
+		return parseInt(a.expr[start:a.pos])
+	case isNameStart(c):
+		start := a.pos
+		for a.pos < len(a.expr) && isNameChar(a.expr[a.pos]) {
+			a.pos++
+		}
+		name := a.expr[start:a.pos]
+		v, _, err := a.lookup(name)
+		if err != nil {
+			a.lookupErr = err
+			return 0, err
+		}
+		if v = strings.TrimSpace(v); v == "" {
+			return 0, nil
+		}
+		return parseInt(v)
+	case c == 0:
+		return 0, fmt.Errorf("syntax error: operand expected")
+	}
+	return 0, fmt.Errorf("syntax error near %q", a.expr[a.pos:])
+}
+
+// next skips whitespace and returns the next character, or 0 at the
+// end of the expression.
+func (a *arith) next() byte {
+	a.skip()
+	if a.pos >= len(a.expr) {
+		return 0
+	}
+	return a.expr[a.pos]
+}
+
+// skip advances past whitespace.
+func (a *arith) skip() {
+	for a.pos < len(a.expr) && strings.IndexByte(" \t\r\n", a.expr[a.pos]) >= 0 {
+		a.pos++
+	}
+}
+
+// parseInt parses a decimal integer operand.
+func parseInt(s string) (int64, error) {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: not an integer", s)
+	}
+	return v, nil
+}
+
+// arithNames returns the names of the variables referenced by the
+// arithmetic expression.
+func arithNames(expr string) []string {
+	var names []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		if !isNameChar(c) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(expr) && isNameChar(expr[i]) {
+			i++
+		}
+		if isNameStart(c) {
+			names = append(names, expr[start:i])
+		}
+	}
+	return names
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || isDigit(c)
+}
@@ -0,0 +1,99 @@
+package envsubst
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestArith(t *testing.T) {
+	params := map[string]string{"PORT": "8080", "N": "3", "EMPTY": "", "STR": "abc"}
+	lookup := func(s string) (string, bool) {
+		v, ok := params[s]
+		return v, ok
+	}
+
+	var expressions = []struct {
+		input  string
+		output string
+	}{
+		{"$((1+2))", "3"},
+		{"$(( PORT + 1 ))", "8081"},
+		{"$((${PORT}+N))", "8083"},
+		{"$(($N*2))", "6"},
+		{"$((7/2)) $((7%2)) $((-7/2))", "3 1 -3"},
+		{"$((2+3*4)) $(((2+3)*4))", "14 20"},
+		{"$((-N)) $((+N)) $((--N))", "-3 3 3"},
+		{"$((UNSET+1)) $((EMPTY*2))", "1 0"},
+		{"port=$((PORT+1))/tcp", "port=8081/tcp"},
+		{"$(( $((N+1)) * 2 ))", "8"},
+		{"$$((1+2))", "$((1+2))"},
+		{"${PORT:-$((1+2))}", "8080"},
+	}
+
+	for _, expr := range expressions {
+		output, err := EvalLookup(expr.input, lookup)
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", expr.input, err)
+		}
+		if output != expr.output {
+			t.Errorf("Want %q expanded to %q, got %q", expr.input, expr.output, output)
+		}
+	}
+}
+
+func TestArithError(t *testing.T) {
+	params := map[string]string{"STR": "abc", "ZERO": "0", "OPEN": "("}
+	lookup := func(s string) (string, bool) {
+		v, ok := params[s]
+		return v, ok
+	}
+
+	var tests = []struct {
+		input string
+		err   string
+	}{
+		{"$((1/0))", "1:1: 1/0: division by zero"},
+		{"x\n $((5 % ZERO))", "2:2: 5 % ZERO: division by zero"},
+		{"$((STR+1))", "1:1: STR+1: abc: not an integer"},
+		{"$((1.5))", `1:1: 1.5: syntax error near ".5"`},
+		{"$((1+))", "1:1: 1+: syntax error: operand expected"},
+		{"$((1 2))", `1:1: 1 2: syntax error near "2"`},
+		{"$((${OPEN}1))", "1:1: (1: missing )"},
+	}
+
+	for _, test := range tests {
+		_, err := EvalLookup(test.input, lookup)
+		if _, ok := err.(*ArithError); !ok || err.Error() != test.err {
+			t.Errorf("Want %q to return ArithError %q, got %v", test.input, test.err, err)
+		}
+	}
+}
+
+func TestArithStrict(t *testing.T) {
+	lookup := func(s string) (string, bool) {
+		v, ok := map[string]string{"N": "3"}[s]
+		return v, ok
+	}
+	eval := func(s string) (string, error) {
+		tmpl, err := Parse(s)
+		if err != nil {
+			return "", err
+		}
+		return tmpl.ExecuteLookup(lookup, WithStrict())
+	}
+
+	if got, err := eval("$((N+1))"); err != nil || got != "4" {
+		t.Errorf("Want a set variable expanded, got %q, %v", got, err)
+	}
+
+	_, err := eval("x $((N+B))")
+	var uerr *UndefinedError
+	if !errors.As(err, &uerr) || uerr.Name != "B" || err.Error() != "1:3: B: unbound variable" {
+		t.Errorf("Want UndefinedError for B, got %v", err)
+	}
+
+	_, err = EvalLookup("$((A+B+A))", lookup, WithStrict(), WithAllUndefined())
+	if err == nil || err.Error() != "1:1: A: unbound variable\n1:1: B: unbound variable" {
+		t.Errorf("Want every unset variable reported, got %v", err)
+	}
+}
@@ -2,27 +2,506 @@ package main
 
 import (
 	"bufio"
-	"os"
-	"log"
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
 
 	"github.com/drone/envsubst"
 )
 
+// version is the program version, set at build time with
+// -ldflags "-X main.version=v1.2.3".
+var version string
+
+// usage is printed by -h and -help, and when the command line
+// cannot be parsed.
+const usage = `Usage: envsubst [flags] [file ...]
+
+Substitutes the values of environment variables in the named files,
+or standard input if no files are named, and writes the result to
+standard output.
+
+Flags:
+%s
+Syntax:
+  $var, ${var}          value of var
+  ${var:-word}          word if var is unset or empty
+  ${var:=word}          word if var is unset or empty
+  ${var:+word}          word if var is set and not empty
+  ${var:?message}       fail with message if var is unset or empty
+  ${var:offset:length}  substring of var
+  ${var#pattern}        remove prefix, shortest (#) or longest (##)
+  ${var%%pattern}        remove suffix, shortest (%%) or longest (%%%%)
+  ${var/old/new}        replace first (/) or all (//) matches
+  ${var^^}, ${var,,}    upper or lower case
+  ${#var}               length of var
+  $$, \$                literal $
+`
+
+// inPlace implements the -i flag, which optionally accepts a
+// backup suffix in the style of sed, e.g. -i.bak
+type inPlace struct {
+	enabled bool
+	suffix  string
+}
+
+func (f *inPlace) String() string   { return f.suffix }
+func (f *inPlace) IsBoolFlag() bool { return true }
+
+func (f *inPlace) Set(s string) error {
+	switch s {
+	case "true":
+		f.enabled = true
+	case "false":
+		f.enabled = false
+	default:
+		f.enabled = true
+		f.suffix = s
+	}
+	return nil
+}
+
+// argList implements the repeatable -arg flag, which supplies the
+// positional parameters ${1} onwards.
+type argList []string
+
+func (f *argList) String() string { return strings.Join(*f, " ") }
+
+func (f *argList) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// setVars implements the repeatable -set flag, which supplies the
+// value of a variable as KEY=VALUE, overriding the environment.
+type setVars map[string]string
+
+func (f setVars) String() string {
+	var pairs []string
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+func (f setVars) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("missing = in %q, want KEY=VALUE", s)
+	}
+	f[s[:i]] = s[i+1:]
+	return nil
+}
+
+func (f setVars) lookup(name string) (string, bool) {
+	v, ok := f[name]
+	return v, ok
+}
+
+// sources implements the -source flag, a comma separated list of the
+// sources of variables in order of precedence, each either env for
+// the environment or file:PATH for a .env file.
+type sources []string
+
+func (f *sources) String() string { return strings.Join(*f, ",") }
+
+func (f *sources) Set(s string) error {
+	var list []string
+	for _, src := range strings.Split(s, ",") {
+		if src != "env" && (!strings.HasPrefix(src, "file:") || src == "file:") {
+			return fmt.Errorf("unknown source %q, want env or file:PATH", src)
+		}
+		list = append(list, src)
+	}
+	*f = list
+	return nil
+}
+
+// load reads the .env files of the sources, returning a lookup
+// function that consults the sources in order and the enumerator of
+// the variables they define. The environment is skipped if envOnly.
+func (f sources) load(envOnly bool) (func(string) (string, bool), environ, error) {
+	var chain []func(string) (string, bool)
+	var e environ
+	for _, src := range f {
+		if src == "env" {
+			if !envOnly {
+				chain = append(chain, os.LookupEnv)
+				e.env = true
+			}
+			continue
+		}
+		vars, err := envsubst.ReadEnvFile(strings.TrimPrefix(src, "file:"))
+		if err != nil {
+			return nil, e, err
+		}
+		chain = append(chain, setVars(vars).lookup)
+		e.files = append(e.files, vars)
+	}
+	return envsubst.LookupChain(chain...), e, nil
+}
+
+// environ enumerates the variables set by -set followed by those of
+// the .env files and the environment variables, if used.
+type environ struct {
+	vars  setVars
+	files []setVars
+	env   bool
+}
+
+func (e environ) Names() []string {
+	var names []string
+	seen := map[string]bool{}
+	add := func(vars setVars) {
+		var keys []string
+		for name := range vars {
+			if !seen[name] {
+				seen[name] = true
+				keys = append(keys, name)
+			}
+		}
+		sort.Strings(keys)
+		names = append(names, keys...)
+	}
+	add(e.vars)
+	for _, vars := range e.files {
+		add(vars)
+	}
+	if !e.env {
+		return names
+	}
+	for _, kv := range os.Environ() {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			continue
+		}
+		if !seen[kv[:i]] {
+			names = append(names, kv[:i])
+		}
+	}
+	return names
+}
+
+// evalFunc expands the string with the options, which are added to
+// those given on the command line.
+type evalFunc func(s string, opts ...envsubst.Option) (string, error)
+
+// unsetVars collects the names of the referenced variables that are
+// not set in the environment, in order of first reference.
+type unsetVars struct {
+	names []string
+	seen  map[string]bool
+
+	// looks up variables, os.LookupEnv if nil.
+	lookup func(string) (string, bool)
+}
+
+// eval expands the string according to the environment, recording
+// every referenced variable that is not set rather than stopping at
+// the first. Variables with a default for the unset case, such as
+// ${var-word}, are not recorded. If any variable is recorded the
+// output is meaningless and the empty string is returned.
+func (u *unsetVars) eval(s string, opts ...envsubst.Option) (string, error) {
+	lookup := u.lookup
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	out, err := envsubst.EvalLookup(s, lookup, append(opts, envsubst.WithAllUndefined())...)
+	var uerrs envsubst.UndefinedErrors
+	if !errors.As(err, &uerrs) {
+		return out, err
+	}
+	if u.seen == nil {
+		u.seen = map[string]bool{}
+	}
+	for _, uerr := range uerrs {
+		if !u.seen[uerr.Name] {
+			u.seen[uerr.Name] = true
+			u.names = append(u.names, uerr.Name)
+		}
+	}
+	return "", nil
+}
+
+// check returns an error listing the unset variables, if any.
+func (u *unsetVars) check() error {
+	if len(u.names) != 0 {
+		return fmt.Errorf("unset variables: %s", strings.Join(u.names, ", "))
+	}
+	return nil
+}
+
 func main() {
-	stdin := bufio.NewScanner(os.Stdin)
-	stdout := bufio.NewWriter(os.Stdout)
+	os.Exit(run(os.Args, os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the program with the command line args, including the
+// program name, returning the exit status.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	logger := log.New(stderr, "", log.LstdFlags)
+	fail := func(format string, v ...interface{}) int {
+		logger.Printf("Error while envsubst: "+format, v...)
+		return 1
+	}
+
+	var inplace inPlace
+	var positional argList
+	var vars = setVars{}
+	var srcs = sources{"env"}
+	var failUnset, envOnly, checkOnly, nullData, printVersion bool
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.Var(&inplace, "i", "edit files in place, saving a backup with the `suffix` if supplied (-i.bak)")
+	flags.Var(&positional, "arg", "supply the `value` of the next positional parameter, ${1} onwards; may be repeated")
+	flags.Var(vars, "set", "set a variable as `KEY=VALUE`, overriding the environment; may be repeated")
+	flags.Var(&srcs, "source", "read variables from the comma separated `sources` in order of precedence, env for the environment or file:PATH for a .env file, as in file:.env,env")
+	flags.BoolVar(&envOnly, "env-only", false, "ignore the environment, expanding only the variables given by -set and -source files")
+	flags.BoolVar(&failUnset, "fail-unset", false, "exit with an error listing every referenced variable that is not set, writing no output")
+	flags.BoolVar(&nullData, "z", false, "separate input and output records with NUL rather than newline characters")
+	flags.BoolVar(&nullData, "null", false, "same as -z")
+	flags.BoolVar(&checkOnly, "check", false, "check the syntax of the input without expanding it, reporting the first error in each file")
+	flags.BoolVar(&printVersion, "version", false, "print the version and exit")
+	flags.SetOutput(stderr)
+	flags.Usage = func() { printUsage(flags, stderr) }
+	if err := flags.Parse(normalizeArgs(args[1:])); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	if printVersion {
+		fmt.Fprintln(stdout, "envsubst", programVersion())
+		return 0
+	}
+
+	lookup, env, err := srcs.load(envOnly)
+	if err != nil {
+		return fail("%v", err)
+	}
+	env.vars = vars
+	if len(vars) != 0 {
+		lookup = envsubst.LookupChain(vars.lookup, lookup)
+	}
+	if len(positional) != 0 {
+		params := append([]string{args[0]}, positional...)
+		lookup = envsubst.LookupChain(envsubst.ArgsLookup(params), lookup)
+	}
+	eval := func(s string, opts ...envsubst.Option) (string, error) {
+		return envsubst.EvalLookup(s, lookup, append(opts, envsubst.WithEnumerator(env))...)
+	}
+	unset := &unsetVars{lookup: lookup}
+	if failUnset {
+		eval = unset.eval
+	}
+
+	files := flags.Args()
+	if checkOnly {
+		if !check(files, stdin, logger) {
+			return 1
+		}
+		return 0
+	}
+	if inplace.enabled {
+		if len(files) == 0 {
+			return fail("-i requires at least one file")
+		}
+		for _, path := range files {
+			if err := expandFile(path, inplace.suffix, eval, unset); err != nil {
+				return fail("%s: %v", path, err)
+			}
+		}
+		return 0
+	}
 
-	for stdin.Scan() {
-		line, err := envsubst.EvalEnv(stdin.Text())
+	// with -fail-unset the output is held back until every
+	// variable is known to be set, so that nothing is written
+	// otherwise.
+	var held bytes.Buffer
+	out := bufio.NewWriter(stdout)
+	if failUnset {
+		out = bufio.NewWriter(&held)
+	}
+	delim := byte('\n')
+	if nullData {
+		delim = 0
+	}
+	if len(files) == 0 {
+		// exit cleanly instead of waiting on an interactive
+		// terminal when no input is piped to the program.
+		if f, ok := stdin.(*os.File); ok && isTerminal(f) {
+			return 0
+		}
+		if err := expand(stdin, out, delim, eval); err != nil {
+			return fail("%v", err)
+		}
+	}
+	for _, path := range files {
+		f, err := os.Open(path)
 		if err != nil {
-			log.Fatalf("Error while envsubst: %v", err)
+			return fail("%v", err)
 		}
-		_, err = fmt.Fprintln(stdout, line)
+		err = expand(f, out, delim, eval)
+		f.Close()
 		if err != nil {
-			log.Fatalf("Error while writing to stdout: %v", err)
+			return fail("%s: %v", path, err)
 		}
-		stdout.Flush()
 	}
+	if err := unset.check(); err != nil {
+		return fail("%v", err)
+	}
+	if _, err := held.WriteTo(stdout); err != nil {
+		return fail("%v", err)
+	}
+	return 0
+}
+
+// printUsage writes the usage text, including the flag defaults, to
+// w.
+func printUsage(flags *flag.FlagSet, w io.Writer) {
+	var defaults strings.Builder
+	flags.SetOutput(&defaults)
+	flags.PrintDefaults()
+	flags.SetOutput(w)
+	fmt.Fprintf(w, usage, defaults.String())
 }
 
+// programVersion returns the version set at build time or, failing
+// that, the module version recorded in the binary.
+func programVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// check validates the syntax of the named files, or stdin if none
+// are named, reporting the first error in each to the logger. It
+// returns false if any input cannot be read or parsed.
+func check(files []string, stdin io.Reader, logger *log.Logger) bool {
+	if len(files) == 0 {
+		b, err := ioutil.ReadAll(stdin)
+		if err == nil {
+			err = envsubst.Validate(string(b))
+		}
+		if err != nil {
+			logger.Printf("Error while envsubst: %v", err)
+			return false
+		}
+		return true
+	}
+	ok := true
+	for _, path := range files {
+		if _, err := envsubst.ParseFile(path); err != nil {
+			logger.Printf("Error while envsubst: %v", err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// normalizeArgs rewrites an attached -i suffix, as in -i.bak, to
+// the -i=.bak form understood by the flag package.
+func normalizeArgs(args []string) []string {
+	out := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			return append(out, args[i:]...)
+		}
+		if strings.HasPrefix(arg, "-i") && len(arg) > 2 && arg[2] != '=' {
+			arg = "-i=" + arg[2:]
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+// expand reads the input line by line and writes each expanded
+// line to the output. Lines are terminated by delim, which is a
+// newline or, with -z, a NUL character. Lines are streamed so that
+// large inputs are never held in memory, and the line terminators are
+// preserved as read so input without a trailing terminator produces
+// output without one. Each line is expanded with its line number in
+// the whole input, so that errors report the line of the input rather
+// than line 1.
+func expand(r io.Reader, w *bufio.Writer, delim byte, eval evalFunc) error {
+	reader := bufio.NewReader(r)
+	n := 1
+	for {
+		line, err := reader.ReadString(delim)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) != 0 {
+			text := strings.TrimSuffix(line, string(delim))
+			text, eerr := eval(text, envsubst.WithFirstLine(n))
+			if eerr != nil {
+				return eerr
+			}
+			n += strings.Count(line, "\n")
+			if line[len(line)-1] == delim {
+				text += string(delim)
+			}
+			if _, werr := w.WriteString(text); werr != nil {
+				return werr
+			}
+			if werr := w.Flush(); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// expandFile expands the named file and writes the result back to
+// the same path. The file is only overwritten once the expansion
+// succeeds. If suffix is not empty the original content is first
+// saved to a backup file with the suffix appended to its name. The
+// file is left unchanged if any referenced variable is unset.
+func expandFile(path, suffix string, eval evalFunc, unset *unsetVars) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	out, err := eval(string(b))
+	if err != nil {
+		return err
+	}
+	if err := unset.check(); err != nil {
+		return err
+	}
+	if suffix != "" {
+		err = ioutil.WriteFile(path+suffix, b, info.Mode().Perm())
+		if err != nil {
+			return fmt.Errorf("cannot write backup: %v", err)
+		}
+	}
+	return ioutil.WriteFile(path, []byte(out), info.Mode().Perm())
+}
+
+// isTerminal returns true if the file is a character device,
+// such as an interactive terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
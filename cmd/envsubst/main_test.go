@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/drone/envsubst"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRun(t *testing.T) {
+	var tests = []struct {
+		args   []string
+		input  string
+		output string
+		status int
+		err    string
+	}{
+		{
+			args:   []string{"-env-only", "-set", "A=1"},
+			input:  "a=${A}\nb=$B\n",
+			output: "a=1\nb=\n",
+		},
+		{
+			args:   []string{"-env-only", "-set", "A=1", "-z"},
+			input:  "a=${A}\x00b=${A}\nc\x00d",
+			output: "a=1\x00b=1\nc\x00d",
+		},
+		{
+			args:   []string{"-env-only", "-set", "A=1", "-null"},
+			input:  "a=${A}\x00",
+			output: "a=1\x00",
+		},
+		{
+			args:   []string{"-env-only", "-arg", "x", "-arg", "y"},
+			input:  "${1}-${2}",
+			output: "x-y",
+		},
+		{
+			args:   []string{"-env-only", "-set", "SEEN=", "-fail-unset"},
+			input:  "${SEEN-x}${SEEN+y}\n${MISSING}\n${OTHER:-z}${OTHER}${MISSING}\n",
+			status: 1,
+			err:    "unset variables: MISSING, OTHER",
+		},
+		{
+			args:   []string{"-env-only", "-set", "SEEN=", "-fail-unset"},
+			input:  "${SEEN-x}${SEEN+y}${UNSET-z}\n",
+			output: "yz\n",
+		},
+		{
+			args:   []string{"-env-only", "-set", "A=1"},
+			input:  "a\n\n${A:?}${B:?required}\n",
+			output: "a\n\n",
+			status: 1,
+			err:    "3:7: B: required",
+		},
+		{
+			args:   []string{"-check"},
+			input:  "${A}\n${B:-${C}}\n",
+			output: "",
+		},
+		{
+			args:   []string{"-check"},
+			input:  "${A}\n${B\n",
+			status: 1,
+			err:    "bad substitution",
+		},
+		{
+			args:   []string{"-set", "NOEQUALS"},
+			status: 2,
+			err:    `missing = in "NOEQUALS"`,
+		},
+		{
+			args:   []string{"-i"},
+			status: 1,
+			err:    "-i requires at least one file",
+		},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		args := append([]string{"envsubst"}, test.args...)
+		status := run(args, strings.NewReader(test.input), &stdout, &stderr)
+		if status != test.status {
+			t.Errorf("Want %q to exit with %d, got %d: %s", test.args, test.status, status, stderr.String())
+		}
+		if got := stdout.String(); got != test.output {
+			t.Errorf("Want %q to write %q, got %q", test.args, test.output, got)
+		}
+		if got := stderr.String(); test.err == "" && got != "" || !strings.Contains(got, test.err) {
+			t.Errorf("Want %q to report %q, got %q", test.args, test.err, got)
+		}
+	}
+}
+
+func TestRunInPlace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "envsubst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		flag   string
+		backup string
+	}{
+		{"-i", ""},
+		{"-i.bak", ".bak"},
+		{"-i=.orig", ".orig"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, "config")
+		if err := ioutil.WriteFile(path, []byte("host=${HOST}\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		var stdout, stderr bytes.Buffer
+		status := run([]string{"envsubst", "-env-only", "-set", "HOST=localhost", test.flag, path}, nil, &stdout, &stderr)
+		if status != 0 {
+			t.Errorf("Want %s to succeed, got %d: %s", test.flag, status, stderr.String())
+		}
+		if b, _ := ioutil.ReadFile(path); string(b) != "host=localhost\n" {
+			t.Errorf("Want %s to expand the file in place, got %q", test.flag, b)
+		}
+		if test.backup == "" {
+			continue
+		}
+		if b, _ := ioutil.ReadFile(path + test.backup); string(b) != "host=${HOST}\n" {
+			t.Errorf("Want %s to save the original to %s, got %q", test.flag, test.backup, b)
+		}
+		os.Remove(path + test.backup)
+	}
+
+	// the file is left unchanged if a variable is unset.
+	path := filepath.Join(dir, "unset")
+	if err := ioutil.WriteFile(path, []byte("${MISSING}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	if status := run([]string{"envsubst", "-env-only", "-fail-unset", "-i.bak", path}, nil, new(bytes.Buffer), &stderr); status != 1 {
+		t.Errorf("Want an unset variable to fail, got %d", status)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "${MISSING}" {
+		t.Errorf("Want the file unchanged, got %q", b)
+	}
+	if _, err := os.Stat(path + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("Want no backup written, got %v", err)
+	}
+}
+
+func TestNormalizeArgs(t *testing.T) {
+	var tests = []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"-i", "file"}, []string{"-i", "file"}},
+		{[]string{"-i.bak", "file"}, []string{"-i=.bak", "file"}},
+		{[]string{"-i=.bak", "file"}, []string{"-i=.bak", "file"}},
+		{[]string{"-set", "A=1", "-i~"}, []string{"-set", "A=1", "-i=~"}},
+		{[]string{"--", "-i.bak"}, []string{"--", "-i.bak"}},
+	}
+	for _, test := range tests {
+		if diff := cmp.Diff(test.want, normalizeArgs(test.args)); diff != "" {
+			t.Errorf("Unexpected args for %q: %s", test.args, diff)
+		}
+	}
+}
+
+func TestSetVars(t *testing.T) {
+	var tests = []struct {
+		arg   string
+		name  string
+		value string
+		err   bool
+	}{
+		{arg: "A=1", name: "A", value: "1"},
+		{arg: "A=", name: "A", value: ""},
+		{arg: "A=b=c", name: "A", value: "b=c"},
+		{arg: "A", err: true},
+		{arg: "=1", err: true},
+	}
+	for _, test := range tests {
+		vars := setVars{}
+		err := vars.Set(test.arg)
+		if test.err {
+			if err == nil {
+				t.Errorf("Want %q rejected", test.arg)
+			}
+			continue
+		}
+		if v, ok := vars[test.name]; err != nil || !ok || v != test.value {
+			t.Errorf("Want %q to set %s to %q, got %q, %v", test.arg, test.name, test.value, v, err)
+		}
+	}
+}
+
+func TestSources(t *testing.T) {
+	var tests = []struct {
+		arg  string
+		want sources
+		err  bool
+	}{
+		{arg: "env", want: sources{"env"}},
+		{arg: "file:.env,env", want: sources{"file:.env", "env"}},
+		{arg: "env,file:a.env,file:b.env", want: sources{"env", "file:a.env", "file:b.env"}},
+		{arg: "file:", err: true},
+		{arg: "env,vault", err: true},
+	}
+	for _, test := range tests {
+		var srcs sources
+		err := srcs.Set(test.arg)
+		if test.err {
+			if err == nil {
+				t.Errorf("Want %q rejected", test.arg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Want %q accepted, got %v", test.arg, err)
+		}
+		if diff := cmp.Diff(test.want, srcs); diff != "" {
+			t.Errorf("Unexpected sources for %q: %s", test.arg, diff)
+		}
+	}
+}
+
+func TestExpandLines(t *testing.T) {
+	lookup := func(name string) (string, bool) { return "", name == "SET" }
+	eval := func(s string, opts ...envsubst.Option) (string, error) {
+		return envsubst.EvalLookup(s, lookup, append(opts, envsubst.WithStrict())...)
+	}
+
+	var tests = []struct {
+		input string
+		delim byte
+		err   string
+	}{
+		{"${SET}\n\n  ${UNSET}\n", '\n', "3:3: UNSET: unbound variable"},
+		{"${SET}\r\n${SET}\n${UNSET}", '\n', "3:1: UNSET: unbound variable"},
+		{"${SET}\x00\n${UNSET}\x00", 0, "2:1: UNSET: unbound variable"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		err := expand(strings.NewReader(test.input), bufio.NewWriter(&out), test.delim, eval)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("Want %q to fail with %q, got %v", test.input, test.err, err)
+		}
+	}
+}
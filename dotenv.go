@@ -0,0 +1,141 @@
+package envsubst
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// EvalFile replaces ${var} and $var in the template string using the
+// variables defined in the named .env file, falling back to the
+// current environment variables for names the file does not define.
+func EvalFile(template string, envFile string) (string, error) {
+	vars, err := ReadEnvFile(envFile)
+	if err != nil {
+		return template, err
+	}
+	return EvalLookup(template, func(name string) (string, bool) {
+		if v, ok := vars[name]; ok {
+			return v, true
+		}
+		return os.LookupEnv(name)
+	}, WithEnumerator(environ{}))
+}
+
+// ReadEnvFile reads the KEY=value lines of the named .env file. Blank
+// lines and lines beginning with # are ignored, and a line may begin
+// with export. A value may be enclosed in single quotes, which are
+// taken literally, or double quotes, which recognize the escapes \n,
+// \t, \", \\ and \$. An unquoted value ends at a # preceded by white
+// space. A malformed line is reported with its line number.
+func ReadEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	vars, err := readEnv(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+	return vars, nil
+}
+
+// readEnv reads the KEY=value lines from r.
+func readEnv(r io.Reader) (map[string]string, error) {
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("%d: missing = in %q", n, line)
+		}
+		key := strings.TrimSpace(line[:i])
+		if !isName(key) {
+			return nil, fmt.Errorf("%d: invalid variable name %q", n, key)
+		}
+		value, err := envValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s: %s", n, key, err)
+		}
+		vars[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// envValue returns the value of a .env line, removing any quotes
+// and trailing comment.
+func envValue(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	var value, rest string
+	switch quote := s[0]; quote {
+	case '\'':
+		i := strings.IndexByte(s[1:], '\'')
+		if i < 0 {
+			return "", fmt.Errorf("unterminated quote")
+		}
+		value, rest = s[1:i+1], s[i+2:]
+	case '"':
+		var b strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case '"', '\\', '$':
+					b.WriteByte(s[i])
+				default:
+					b.WriteByte('\\')
+					b.WriteByte(s[i])
+				}
+				continue
+			}
+			b.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return "", fmt.Errorf("unterminated quote")
+		}
+		value, rest = b.String(), s[i+1:]
+	default:
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = s[:i]
+		}
+		if i := strings.Index(s, "\t#"); i >= 0 {
+			s = s[:i]
+		}
+		return strings.TrimSpace(s), nil
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+		return "", fmt.Errorf("unexpected text after quoted value")
+	}
+	return value, nil
+}
+
+// isName returns true if s is a valid variable name.
+func isName(s string) bool {
+	if s == "" || !isNameStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isNameChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package envsubst
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadEnv(t *testing.T) {
+	input := `# database settings
+DB_HOST=localhost
+export DB_PORT=5432
+
+DB_NAME = app # trailing comment
+DB_PASS='p@ss #word'
+DB_URL="postgres://\"${DB_HOST}\"\n"
+EMPTY=
+HASH=a#b
+`
+	want := map[string]string{
+		"DB_HOST": "localhost",
+		"DB_PORT": "5432",
+		"DB_NAME": "app",
+		"DB_PASS": "p@ss #word",
+		"DB_URL":  "postgres://\"${DB_HOST}\"\n",
+		"EMPTY":   "",
+		"HASH":    "a#b",
+	}
+	got, err := readEnv(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestReadEnvErrors(t *testing.T) {
+	var tests = []struct {
+		input string
+		err   string
+	}{
+		{"A=1\nB", `2: missing = in "B"`},
+		{"1A=1", `1: invalid variable name "1A"`},
+		{"\n\nA='abc", "3: A: unterminated quote"},
+		{`A="abc`, "1: A: unterminated quote"},
+		{`A="abc" def`, "1: A: unexpected text after quoted value"},
+	}
+	for _, test := range tests {
+		_, err := readEnv(strings.NewReader(test.input))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("Want %q to return error %q, got %v", test.input, test.err, err)
+		}
+	}
+}
+
+func TestEvalFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "envsubst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("HOST=example.com\nexport ENVSUBST_TEST_PORT=\"8080\"\n")
+	f.Close()
+
+	os.Setenv("ENVSUBST_TEST_HOST", "env.example.com")
+	os.Setenv("ENVSUBST_TEST_PORT", "80") // the file takes precedence
+	defer os.Unsetenv("ENVSUBST_TEST_HOST")
+	defer os.Unsetenv("ENVSUBST_TEST_PORT")
+
+	got, err := EvalFile("${HOST}:${ENVSUBST_TEST_PORT} ${ENVSUBST_TEST_HOST}", f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "example.com:8080 env.example.com"; got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+
+	if _, err := EvalFile("${HOST}", f.Name()+".missing"); !os.IsNotExist(err) {
+		t.Errorf("Want a missing env file to return a not exist error, got %v", err)
+	}
+}
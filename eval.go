@@ -1,19 +1,162 @@
 package envsubst
 
-import "os"
+import (
+	"context"
+	"os"
+	"strings"
 
-// Eval replaces ${var} in the string based on the mapping function.
-func Eval(s string, mapping func(string) string) (string, error) {
-	t, err := Parse(s)
+	"github.com/drone/envsubst/parse"
+)
+
+// Eval replaces ${var} and $var in the string based on the mapping
+// function. The options configure both parsing and execution.
+// Eval, like the other Eval functions, shares no mutable state between
+// calls and is safe to call from multiple goroutines.
+func Eval(s string, mapping func(string) string, opts ...Option) (string, error) {
+	o := newOptions(opts...)
+	if isLiteral(s, o) {
+		return s, nil
+	}
+	t, err := parseOptions(s, o)
+	if err != nil {
+		return s, err
+	}
+	return t.Execute(mapping, opts...)
+}
+
+// EvalLookup replaces ${var} and $var in the string based on the
+// lookup function, which reports whether each variable is set in the
+// style of os.LookupEnv.
+func EvalLookup(s string, lookup func(string) (string, bool), opts ...Option) (string, error) {
+	o := newOptions(opts...)
+	if isLiteral(s, o) {
+		return s, nil
+	}
+	t, err := parseOptions(s, o)
 	if err != nil {
 		return s, err
 	}
-	return t.Execute(mapping)
+	return t.ExecuteLookup(lookup, opts...)
+}
+
+// EvalContext replaces ${var} and $var in the string based on the
+// mapping function, which receives the context and may return an
+// error. Evaluation stops with the context's error once the context
+// is done, so a deadline can bound the time spent in slow lookups.
+func EvalContext(ctx context.Context, s string, mapping func(context.Context, string) (string, error), opts ...Option) (string, error) {
+	t, err := parseOptions(s, newOptions(opts...))
+	if err != nil {
+		return s, err
+	}
+	return t.ExecuteContext(ctx, mapping, opts...)
+}
+
+// EvalFunc replaces ${var} and $var in the string based on the
+// mapping function, which may return an error, such as when a secrets
+// backend cannot be reached. The first error stops evaluation and is
+// returned as a *LookupError naming the variable.
+func EvalFunc(s string, mapping func(string) (string, error), opts ...Option) (string, error) {
+	return EvalContext(context.Background(), s, func(_ context.Context, name string) (string, error) {
+		return mapping(name)
+	}, opts...)
+}
+
+// EvalTrace replaces ${var} and $var in the string based on the
+// mapping function, like Eval, and also returns the variables that
+// the evaluation looked up mapped to their values. A variable in the
+// word of a default is only included if the word is used, so a cached
+// result remains valid until one of the returned variables changes.
+func EvalTrace(s string, mapping func(string) string, opts ...Option) (string, map[string]string, error) {
+	used := map[string]string{}
+	result, err := Eval(s, func(name string) string {
+		v := mapping(name)
+		used[name] = v
+		return v
+	}, opts...)
+	return result, used, err
 }
 
-// EvalEnv replaces ${var} in the string according to the values of the
-// current environment variables. References to undefined variables are
-// replaced by the empty string.
+// EvalEnv replaces ${var} and $var in the string according to the values
+// of the current environment variables. References to undefined variables
+// are replaced by the empty string.
 func EvalEnv(s string) (string, error) {
-	return Eval(s, os.Getenv)
+	return EvalLookup(s, os.LookupEnv, WithEnumerator(environ{}))
+}
+
+// EvalArgs replaces ${var} and $var in the string according to the
+// positional arguments, where ${0} is args[0], conventionally the
+// program name, and ${1} onwards are the arguments that follow. An
+// index beyond the end of args expands to the empty string. ${@} and
+// ${*} expand to the arguments after ${0}, and ${#@} and ${#*} to their
+// number. Other variables are replaced by the values of the current
+// environment variables. A positional parameter must be enclosed in
+// braces, as a bare $1 is taken literally.
+func EvalArgs(s string, args []string) (string, error) {
+	return EvalLookup(s, LookupChain(ArgsLookup(args), os.LookupEnv), WithEnumerator(environ{}))
+}
+
+// EvalStrict replaces ${var} in the string based on the mapping
+// function, returning an *UndefinedError naming the first variable
+// that is referenced but not set. Because the mapping cannot
+// distinguish an unset variable from an empty one, a variable that
+// maps to the empty string is treated as not set; use EvalLookupStrict
+// to allow variables set to the empty string.
+func EvalStrict(s string, mapping func(string) string) (string, error) {
+	return EvalLookup(s, func(name string) (string, bool) {
+		v := mapping(name)
+		return v, v != ""
+	}, WithStrict())
+}
+
+// EvalLookupStrict replaces ${var} in the string based on the lookup
+// function, returning an *UndefinedError naming the first variable
+// for which the lookup reports false. A variable set to the empty
+// string expands to the empty string. It is equivalent to EvalLookup
+// with the WithStrict option.
+func EvalLookupStrict(s string, lookup func(string) (string, bool)) (string, error) {
+	return EvalLookup(s, lookup, WithStrict())
+}
+
+// EvalRestricted replaces only the variables named in allowed, in the
+// manner of GNU envsubst's SHELL-FORMAT argument. Every other
+// substitution, and any escape such as $$, is written exactly as it
+// appears in the string.
+func EvalRestricted(s string, allowed []string, mapping func(string) string) (string, error) {
+	return Eval(s, mapping, WithAllowed(allowed...))
+}
+
+// isLiteral returns true if the string cannot contain a substitution
+// or escape, in which case it evaluates to itself and need not be
+// parsed. Strict syntax checks and stripping directives still require
+// the string be parsed, as does a ~ with tilde expansion, a line
+// terminator with a line ending and a string longer than the maximum
+// output size, which must fail with ErrMaxOutputSize.
+func isLiteral(s string, o *options) bool {
+	delim := byte('$')
+	if o.leftDelim != "" {
+		delim = o.leftDelim[0]
+	}
+	return !o.strictSyntax && !o.stripDirectives &&
+		!(o.maxOutput > 0 && len(s) > o.maxOutput) &&
+		strings.IndexByte(s, delim) < 0 &&
+		strings.IndexByte(s, '\\') < 0 &&
+		!(o.tilde && strings.IndexByte(s, '~') >= 0) &&
+		!(o.lineEnding != 0 && strings.IndexByte(s, '\n') >= 0)
+}
+
+// parseOptions parses the string using the delimiters and syntax
+// checks configured by the options.
+func parseOptions(s string, o *options) (*Template, error) {
+	tree := new(parse.Tree)
+	tree.Strict = o.strictSyntax
+	tree.Directives = o.directives
+	tree.StripDirectives = o.stripDirectives
+	tree.BalancedBraces = o.balancedBraces
+	tree.LiteralDoubleDollar = o.literalDollar
+	tree.Line = o.firstLine
+	tree, err := tree.Delims(o.leftDelim, o.rightDelim).Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{tree: tree, evaluated: true}, nil
 }
@@ -1,6 +1,18 @@
 package envsubst
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drone/envsubst/parse"
+	"github.com/google/go-cmp/cmp"
+)
 
 // test cases sourced from tldp.org
 // http://www.tldp.org/LDP/abs/html/parameter-substitution.html
@@ -23,6 +35,21 @@ func TestExpand(t *testing.T) {
 			input:  "${#var01}",
 			output: "12",
 		},
+		{
+			params: map[string]string{"var01": "naïve café 😀"},
+			input:  "${#var01}",
+			output: "12",
+		},
+		{
+			params: map[string]string{"FILE": "/usr/local/bin/envsubst"},
+			input:  `${#${FILE##*/}} ${#${FILE%/*}} ${#${FILE//\//}}`,
+			output: "8 14 19",
+		},
+		{
+			params: map[string]string{"var01": "naïve café"},
+			input:  "${#${var01// /}} ${#${UNSET:-default}} ${#${UNSET}}",
+			output: "9 7 0",
+		},
 		// uppercase first
 		{
 			params: map[string]string{"var01": "abcdEFGH28ij"},
@@ -35,6 +62,28 @@ func TestExpand(t *testing.T) {
 			input:  "${var01^^}",
 			output: "ABCDEFGH28IJ",
 		},
+		// uppercase matching pattern
+		{
+			params: map[string]string{"var01": "abcdefghij"},
+			input:  "${var01^^[aeiou]}",
+			output: "AbcdEfghIj",
+		},
+		{
+			params: map[string]string{"var01": "abcdefghij"},
+			input:  "${var01^[aeiou]} ${var01^[b-z]}",
+			output: "Abcdefghij abcdefghij",
+		},
+		// toggle case
+		{
+			params: map[string]string{"var01": "abcdEFGH28ij"},
+			input:  "${var01~} ${var01~~}",
+			output: "AbcdEFGH28ij ABCDefgh28IJ",
+		},
+		{
+			params: map[string]string{"var01": "aBcDé"},
+			input:  "${var01~~[a-c]} ${var01~[b-z]} ${var01~~[é]}",
+			output: "ABCDé aBcDé aBcDÉ",
+		},
 		// lowercase first
 		{
 			params: map[string]string{"var01": "ABCDEFGH28IJ"},
@@ -47,6 +96,63 @@ func TestExpand(t *testing.T) {
 			input:  "${var01,,}",
 			output: "abcdefgh28ij",
 		},
+		// transformation operators
+		{
+			params: map[string]string{"var01": "café"},
+			input:  "${var01@U}",
+			output: "CAFÉ",
+		},
+		{
+			params: map[string]string{"var01": "ÀBCD"},
+			input:  "${var01@L}",
+			output: "àbcd",
+		},
+		{
+			params: map[string]string{"var01": "élan"},
+			input:  "${var01@u}",
+			output: "Élan",
+		},
+		{
+			params: map[string]string{"var01": "it's $5"},
+			input:  "echo ${var01@Q}",
+			output: `echo 'it'\''s $5'`,
+		},
+		{
+			params: map[string]string{"var01": `a	b`},
+			input:  "${var01@E}",
+			output: "a\tb",
+		},
+		{
+			params: map[string]string{"var01": "héllo, 世界"},
+			input:  "${var01@b64}",
+			output: "aMOpbGxvLCDkuJbnlYw=",
+		},
+		{
+			params: map[string]string{"var01": "aMOpbGxvLCDkuJbnlYw="},
+			input:  "${var01@b64d}",
+			output: "héllo, 世界",
+		},
+		{
+			params: map[string]string{"var01": "a b&c=d/é~"},
+			input:  "?q=${var01@url}",
+			output: "?q=a%20b%26c%3Dd%2F%C3%A9~",
+		},
+		{
+			params: map[string]string{"var01": "a%20b+%26c%3dd%2F%C3%A9"},
+			input:  "${var01@urld}",
+			output: "a b+&c=d/é",
+		},
+		// lowercase matching pattern
+		{
+			params: map[string]string{"var01": "ABCDEFGHIJ"},
+			input:  "${var01,,[A-D]}",
+			output: "abcdEFGHIJ",
+		},
+		{
+			params: map[string]string{"var01": "ABCDEFGHIJ"},
+			input:  "${var01,?}",
+			output: "aBCDEFGHIJ",
+		},
 		// substring with position
 		{
 			params: map[string]string{"path_name": "/home/bozo/ideas/thoughts.for.today"},
@@ -59,6 +165,32 @@ func TestExpand(t *testing.T) {
 			input:  "${path_name:11:5}",
 			output: "ideas",
 		},
+		{
+			params: map[string]string{"name": "Zoë Saldaña"},
+			input:  "${name:0:3} ${name:4}",
+			output: "Zoë Saldaña",
+		},
+		// substring with negative position
+		{
+			params: map[string]string{"path_name": "/home/bozo/ideas/thoughts.for.today"},
+			input:  "${path_name: -5}",
+			output: "today",
+		},
+		{
+			params: map[string]string{"path_name": "/home/bozo/ideas/thoughts.for.today"},
+			input:  "${path_name:(-5):3}",
+			output: "tod",
+		},
+		{
+			params: map[string]string{"path_name": "/home/bozo/ideas/thoughts.for.today"},
+			input:  "${path_name:11:-19}",
+			output: "ideas",
+		},
+		{
+			params: map[string]string{"path_name": "/home/bozo/ideas/thoughts.for.today"},
+			input:  "${path_name:-5}",
+			output: "/home/bozo/ideas/thoughts.for.today",
+		},
 		// default not used
 		{
 			params: map[string]string{"var": "abc"},
@@ -91,6 +223,22 @@ func TestExpand(t *testing.T) {
 			input:  "${var:=xyz}",
 			output: "xyz",
 		},
+		// integer or default, an envsubst extension
+		{
+			params: map[string]string{"port": "-9000"},
+			input:  "${port:num:8080}",
+			output: "-9000",
+		},
+		{
+			params: map[string]string{"port": "http"},
+			input:  "${port:num:8080} ${port:num:$fallback} ${unset:num:1}",
+			output: "8080  1",
+		},
+		{
+			params: map[string]string{"port": " 80"},
+			input:  "${port:num:8080}",
+			output: "8080",
+		},
 		// replace suffix
 		{
 			params: map[string]string{"stringZ": "abcABC123ABCabc"},
@@ -147,6 +295,16 @@ func TestExpand(t *testing.T) {
 			input:  "${filename##*/}",
 			output: "file",
 		},
+		{
+			params: map[string]string{"ver": "release-v1.2.3"},
+			input:  "${ver##*[!0-9.]}",
+			output: "1.2.3",
+		},
+		{
+			params: map[string]string{"ver": "v10.4-beta"},
+			input:  "${ver#[![:digit:]]}",
+			output: "10.4-beta",
+		},
 		// delete shortest match suffix
 		{
 			params: map[string]string{"filename": "bash.string.txt"},
@@ -160,6 +318,28 @@ func TestExpand(t *testing.T) {
 			output: "bash",
 		},
 
+		// indirect expansion
+		{
+			params: map[string]string{"ref": "var01", "var01": "abcdEFGH28ij"},
+			input:  "${!ref}",
+			output: "abcdEFGH28ij",
+		},
+		{
+			params: map[string]string{"var01": "abcdEFGH28ij"},
+			input:  "${!ref}",
+			output: "",
+		},
+		{
+			params: map[string]string{"ref": "var02", "var01": "abcdEFGH28ij"},
+			input:  "${!ref}",
+			output: "",
+		},
+		{
+			params: map[string]string{"prefix": "var", "var": "var01", "var01": "abcdEFGH28ij"},
+			input:  "${var02:-${!prefix}}",
+			output: "var01",
+		},
+
 		// nested parameters
 		{
 			params: map[string]string{"var01": "abcdEFGH28ij"},
@@ -175,13 +355,56 @@ func TestExpand(t *testing.T) {
 		{
 			params: map[string]string{"var01": "abcdEFGH28ij"},
 			input:  "some text ${var01}$${var$${var01}$var01${var01}",
-			output: "some text abcdEFGH28ij${var${var01}$var01abcdEFGH28ij",
+			output: "some text abcdEFGH28ij${var${var01}abcdEFGH28ijabcdEFGH28ij",
 		},
 		{
 			params: map[string]string{"default_var": "foo"},
 			input:  "something $${var=${default_var}}",
 			output: "something ${var=foo}",
 		},
+		{
+			params: map[string]string{"var01": "abcdEFGH28ij"},
+			input:  `\${var01} \$var01 \\${var01}`,
+			output: `${var01} $var01 \abcdEFGH28ij`,
+		},
+		// bare variables in arguments
+		{
+			params: map[string]string{"Y": "why", "HOME": "/home/bozo"},
+			input:  "${X:-$Y} ${X:-$Y/suffix} ${CACHE:-$HOME/.cache}",
+			output: "why why/suffix /home/bozo/.cache",
+		},
+		// operator characters in a default are literal
+		{
+			params: map[string]string{"PORT": "8080"},
+			input:  "${URL:-http://localhost:$PORT/path?q=a b#top} ${X:-a:b:c} ${X:-/#%/}",
+			output: "http://localhost:8080/path?q=a b#top a:b:c /#%/",
+		},
+		{
+			params: map[string]string{"X": "x", "E": ""},
+			input:  "${X:+ :-1 } ${E:-#1} ${E:=%2}, ${X:?${E:-a/b}:c}",
+			output: " :-1  #1 %2, x",
+		},
+		{
+			params: map[string]string{"X": "a.b.c", "Y": "-"},
+			input:  "${X:+$Y$Y} ${X+[$Y]} ${X:=$Y}",
+			output: "-- [-] a.b.c",
+		},
+		// bare variables
+		{
+			params: map[string]string{"HOME": "/home/bozo"},
+			input:  "PATH=$HOME/bin:$PATH_EXTRA",
+			output: "PATH=/home/bozo/bin:",
+		},
+		{
+			params: map[string]string{},
+			input:  "total: $ 5 or $5",
+			output: "total: $ 5 or $5",
+		},
+		{
+			params: map[string]string{"HOST": "localhost", "PORT": "8080"},
+			input:  "$HOST:${PORT}/path",
+			output: "localhost:8080/path",
+		},
 		// some common escaping use cases
 		{
 			params: map[string]string{"stringZ": "foo/bar"},
@@ -193,12 +416,55 @@ func TestExpand(t *testing.T) {
 			input:  `${stringZ//\//-}`,
 			output: "foo-bar-baz",
 		},
+		{
+			params: map[string]string{"stringZ": "a/b*c"},
+			input:  `${stringZ//[\/*]/-}`,
+			output: "a-b-c",
+		},
+		{
+			params: map[string]string{"stringZ": "version-1.2.3"},
+			input:  "${stringZ/#*-/v}",
+			output: "v1.2.3",
+		},
 		// substitute with a blank string
 		{
 			params: map[string]string{"stringZ": "foo.bar"},
 			input:  `${stringZ/./}`,
 			output: "foobar",
 		},
+		// anchored replace with a blank string
+		{
+			params: map[string]string{"stringZ": "abcABC123ABCabc"},
+			input:  "${stringZ/#abc/} ${stringZ/%abc/}",
+			output: "ABC123ABCabc abcABC123ABC",
+		},
+		{
+			params: map[string]string{"stringZ": "abcABC123ABCabc"},
+			input:  "${stringZ/#ABC/} ${stringZ/%ABC/} ${stringZ/#ABC/X} ${stringZ/%ABC/X}",
+			output: "abcABC123ABCabc abcABC123ABCabc abcABC123ABCabc abcABC123ABCabc",
+		},
+		{
+			params: map[string]string{"FILE": "/srv/app/config.yaml"},
+			input:  `${FILE/#*\//} ${FILE/%.*/} ${FILE/%.*/.json}`,
+			output: "config.yaml /srv/app/config /srv/app/config.json",
+		},
+		// replace without a replacement deletes the matches
+		{
+			params: map[string]string{"stringZ": "abcABC123ABCabc"},
+			input:  "${stringZ/abc} ${stringZ//abc} ${stringZ//[0-9]}",
+			output: "ABC123ABCabc ABC123ABC abcABCABCabc",
+		},
+		{
+			params: map[string]string{"FILE": "/srv/app/config.yaml"},
+			input:  `${FILE/#*\/} ${FILE/%.*} ${FILE//\/}`,
+			output: "config.yaml /srv/app/config srvappconfig.yaml",
+		},
+		// an empty pattern leaves the value unchanged
+		{
+			params: map[string]string{"stringZ": "abc"},
+			input:  "${stringZ/} ${stringZ//} ${stringZ/#} ${stringZ/%}",
+			output: "abc abc abc abc",
+		},
 	}
 
 	for _, expr := range expressions {
@@ -218,3 +484,1227 @@ func TestExpand(t *testing.T) {
 		}
 	}
 }
+
+func TestEvalStrict(t *testing.T) {
+	params := map[string]string{"HOST": "localhost"}
+	mapping := func(s string) string {
+		return params[s]
+	}
+
+	var tests = []struct {
+		input  string
+		output string
+		name   string
+		pos    parse.Pos
+	}{
+		{input: "${HOST}", output: "localhost"},
+		{input: "${PORT:-8080}", output: "8080"},
+		{input: "${HOST:-${PORT}}", output: "localhost"},
+		{input: "${PORT}", name: "PORT", pos: parse.Pos{Line: 1, Col: 1}},
+		{input: "$HOST:$PORT", name: "PORT", pos: parse.Pos{Line: 1, Col: 7}},
+		{input: "${HOST}\n${PORT^^}", name: "PORT", pos: parse.Pos{Line: 2, Col: 1}},
+		{input: "${USER:-${PORT}}", name: "PORT", pos: parse.Pos{Line: 1, Col: 9}},
+		{input: "${HOST/local/${PORT}}", name: "PORT", pos: parse.Pos{Line: 1, Col: 14}},
+	}
+
+	for _, test := range tests {
+		output, err := EvalStrict(test.input, mapping)
+		if test.name == "" {
+			if err != nil {
+				t.Errorf("Want %q expanded but got error %q", test.input, err)
+			} else if output != test.output {
+				t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+			}
+			continue
+		}
+		uerr, ok := err.(*UndefinedError)
+		if !ok {
+			t.Errorf("Want %q to return an UndefinedError, got %v", test.input, err)
+			continue
+		}
+		if uerr.Name != test.name || uerr.Pos != test.pos {
+			t.Errorf("Want %q undefined at %v, got %q at %v", test.name, test.pos, uerr.Name, uerr.Pos)
+		}
+	}
+}
+
+func TestEvalLookupStrict(t *testing.T) {
+	params := map[string]string{"EMPTY": "", "HOST": "localhost"}
+	lookup := func(s string) (string, bool) {
+		v, ok := params[s]
+		return v, ok
+	}
+
+	// a variable set to the empty string is defined.
+	if got, err := EvalLookupStrict("${HOST}[${EMPTY}]", lookup); err != nil || got != "localhost[]" {
+		t.Errorf("Want an empty variable expanded, got %q, %v", got, err)
+	}
+	// whereas EvalStrict cannot tell it from an unset one.
+	mapping := func(s string) string { return params[s] }
+	if _, err := EvalStrict("${EMPTY}", mapping); err == nil {
+		t.Errorf("Want EvalStrict to report an empty variable as undefined")
+	}
+
+	_, err := EvalLookupStrict("${HOST}${PORT}", lookup)
+	if uerr, ok := err.(*UndefinedError); !ok || uerr.Name != "PORT" || uerr.Pos != (parse.Pos{Line: 1, Col: 8}) {
+		t.Errorf("Want PORT undefined at 1:8, got %v", err)
+	}
+}
+
+func TestEvalLookup(t *testing.T) {
+	params := map[string]string{"empty": "", "var": "abc"}
+	lookup := func(s string) (string, bool) {
+		v, ok := params[s]
+		return v, ok
+	}
+
+	var expressions = []struct {
+		input  string
+		output string
+	}{
+		{"${var-x}", "abc"},
+		{"${empty-x}", ""},
+		{"${unset-x}", "x"},
+		{"${empty:-x}", "x"},
+		{"${unset:-x}", "x"},
+		{"${var+x}", "x"},
+		{"${empty+x}", "x"},
+		{"${unset+x}", ""},
+		{"${var:+x}", "x"},
+		{"${empty:+x}", ""},
+		{"${unset:+x}", ""},
+		{"${var+${var}!}", "abc!"},
+		{"${empty+${var}!}", "abc!"},
+		{"${unset+${var}!}", ""},
+		{"${var:+${var}!}", "abc!"},
+		{"${empty:+${var}!}", ""},
+		{"${unset:+${var}!}", ""},
+		{"${var?x}", "abc"},
+		{"${empty?x}", ""},
+	}
+
+	for _, expr := range expressions {
+		output, err := EvalLookup(expr.input, lookup)
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", expr.input, err)
+		}
+		if output != expr.output {
+			t.Errorf("Want %q expanded to %q, got %q", expr.input, expr.output, output)
+		}
+	}
+
+	_, err := EvalLookup("${unset?is required}", lookup)
+	if perr, ok := err.(*ParameterError); !ok || perr.Name != "unset" || perr.Message != "is required" {
+		t.Errorf("Want ParameterError for unset variable, got %v", err)
+	}
+}
+
+func TestEvalEnvUnsetAndEmpty(t *testing.T) {
+	os.Setenv("ENVSUBST_TEST_EMPTY", "")
+	os.Unsetenv("ENVSUBST_TEST_UNSET")
+	defer os.Unsetenv("ENVSUBST_TEST_EMPTY")
+
+	got, err := EvalEnv("[${ENVSUBST_TEST_EMPTY-x}][${ENVSUBST_TEST_EMPTY:-x}][${ENVSUBST_TEST_UNSET-x}]")
+	if err != nil {
+		t.Error(err)
+	}
+	if want := "[][x][x]"; got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
+
+func TestEvalArgs(t *testing.T) {
+	os.Setenv("ENVSUBST_TEST_ARG", "env")
+	defer os.Unsetenv("ENVSUBST_TEST_ARG")
+	args := []string{"prog", "one", "two", "", "four", "five", "six", "seven", "eight", "nine", "ten"}
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"${0} ${1} ${2}", "prog one two"},
+		{"${10} ${01}", "ten one"},
+		{"${#1} ${2^^} ${2:1}", "3 TWO wo"},
+		{"[${3-x}][${3:-x}][${11-x}][${99}]", "[][x][x][]"},
+		{"${ENVSUBST_TEST_ARG} $ENVSUBST_TEST_ARG", "env env"},
+		{"$1 costs $$5", "$1 costs $5"},
+		{"[${@}] ${#@} ${#*}", "[one two  four five six seven eight nine ten] 10 10"},
+	}
+	for _, test := range tests {
+		output, err := EvalArgs(test.input, args)
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+}
+
+func TestEvalParams(t *testing.T) {
+	lookup := LookupChain(ArgsLookup([]string{"prog", "a", "", "c"}), LayeredMapping(nil, map[string]string{"IFS": ",;"}))
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"${*}|${@}", "a,,c|a  c"},
+		{"${#*}", "3"},
+	}
+	for _, test := range tests {
+		output, err := EvalLookup(test.input, lookup)
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+
+	// without ArgsLookup there are no positional parameters.
+	output, err := Eval("[${@}] ${#@}", func(string) string { return "x" })
+	if err != nil || output != "[] 0" {
+		t.Errorf("Want no positional parameters, got %q, %v", output, err)
+	}
+}
+
+func TestEvalEmptyInput(t *testing.T) {
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"", ""},
+		{"\n", "\n"},
+		{"\r\n", "\r\n"},
+		{" \t\n ", " \t\n "},
+		{"$", "$"},
+		{"$$", "$"},
+		{"$$$", "$$"},
+		{"$$$$", "$$"},
+		{"$ $", "$ $"},
+		{"\\", "\\"},
+	}
+	for _, test := range tests {
+		output, err := EvalEnv(test.input)
+		if err != nil || output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q, %v", test.input, test.output, output, err)
+		}
+		// parsed rather than passed through as a literal.
+		output, err = Eval(test.input, func(string) string { return "x" }, WithStrictSyntax())
+		if err != nil || output != test.output {
+			t.Errorf("Want %q parsed and expanded to %q, got %q, %v", test.input, test.output, output, err)
+		}
+	}
+}
+
+func TestEvalEnvConcurrent(t *testing.T) {
+	os.Setenv("ENVSUBST_TEST_HOST", "example.com")
+	defer os.Unsetenv("ENVSUBST_TEST_HOST")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(2)
+		// identical input on every goroutine
+		go func() {
+			defer wg.Done()
+			got, err := EvalEnv("https://${ENVSUBST_TEST_HOST^^}:${ENVSUBST_TEST_PORT:-443}/$((1 + 1))")
+			if want := "https://EXAMPLE.COM:443/2"; err != nil || got != want {
+				t.Errorf("Want %q, got %q, %v", want, got, err)
+			}
+		}()
+		// distinct input on every goroutine
+		go func(i int) {
+			defer wg.Done()
+			input := fmt.Sprintf("%d ${ENVSUBST_TEST_HOST:%d} ${#ENVSUBST_TEST_HOST}", i, i%5)
+			want := fmt.Sprintf("%d %s 11", i, "example.com"[i%5:])
+			got, err := EvalEnv(input)
+			if err != nil || got != want {
+				t.Errorf("Want %q, got %q, %v", want, got, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestEvalRestricted(t *testing.T) {
+	mapping := func(s string) string {
+		return "<" + s + ">"
+	}
+
+	var expressions = []struct {
+		input  string
+		output string
+	}{
+		{"${HOST}:${PORT}", "<HOST>:${PORT}"},
+		{"$HOST $PORT", "<HOST> $PORT"},
+		{"${PORT:-8080} ${HOST:-x}", "${PORT:-8080} <HOST>"},
+		{"${PORT//8/9} ${#HOST}", "${PORT//8/9} 6"},
+		{"${HOST:-${PORT}}", "<HOST>"},
+		{"${UNSET:-${HOST}}", "${UNSET:-${HOST}}"},
+		{"$$PORT ${PORT@Q}", "$$PORT ${PORT@Q}"},
+		{"$${HOST} $$$HOST", "$${HOST} $$<HOST>"},
+	}
+
+	for _, expr := range expressions {
+		output, err := EvalRestricted(expr.input, []string{"HOST"}, mapping)
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", expr.input, err)
+		}
+		if output != expr.output {
+			t.Errorf("Want %q expanded to %q, got %q", expr.input, expr.output, output)
+		}
+	}
+}
+
+func TestEvalParameterError(t *testing.T) {
+	mapping := func(s string) string {
+		if s == "var" {
+			return "abc"
+		}
+		return ""
+	}
+
+	var tests = []struct {
+		input string
+		err   string
+	}{
+		{"${empty:?}", "1:1: empty: parameter null or not set"},
+		{"${empty:?must be set}", "1:1: empty: must be set"},
+		{"a\n  ${empty:?${var} required}", "2:3: empty: abc required"},
+		{"${empty?}", ""},
+		{"${var:?must be set}", ""},
+	}
+
+	for _, test := range tests {
+		_, err := Eval(test.input, mapping)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("Want %q expanded but got error %q", test.input, err)
+			}
+			continue
+		}
+		if _, ok := err.(*ParameterError); !ok || err.Error() != test.err {
+			t.Errorf("Want %q to return ParameterError %q, got %v", test.input, test.err, err)
+		}
+	}
+
+	_, err := EvalLookup("${unset?}", func(string) (string, bool) { return "", false })
+	if err == nil || err.Error() != "1:1: unset: parameter not set" {
+		t.Errorf("Want ParameterError for unset variable, got %v", err)
+	}
+}
+
+func TestEvalOptions(t *testing.T) {
+	mapping := func(s string) string {
+		switch s {
+		case "HOST":
+			return "localhost"
+		case "PORT":
+			return "8080"
+		}
+		return ""
+	}
+
+	var tests = []struct {
+		input  string
+		output string
+		opts   []Option
+	}{
+		{"${HOST}:${PORT}", "localhost:8080", nil},
+		{"%%HOST%%:%%PORT%% ${HOST}", "localhost:8080 ${HOST}", []Option{WithDelims("%%", "%%")}},
+		{"{{HOST}}:{{PORT:-80}}", "localhost:8080", []Option{WithDelims("{{", "}}")}},
+		{`\{{HOST}} {{{PORT}}`, "{{HOST}} {{PORT}}", []Option{WithDelims("{{", "}}")}},
+		{"${HOST}:${PORT}", "localhost:${PORT}", []Option{WithAllowed("HOST")}},
+		{"%%HOST%%:%%PORT%%", "%%HOST%%:8080", []Option{WithDelims("%%", "%%"), WithAllowed("PORT")}},
+	}
+
+	for _, test := range tests {
+		output, err := Eval(test.input, mapping, test.opts...)
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+
+	if _, err := Eval("${a:-${b}}", mapping, WithMaxDepth(0)); !errors.Is(err, ErrMaxDepth) {
+		t.Errorf("Want ErrMaxDepth, got %v", err)
+	}
+	if _, err := Eval("${UNSET}", mapping, WithStrict()); err != nil {
+		t.Errorf("Want a plain mapping to treat every variable as set, got %v", err)
+	}
+	if _, err := Eval("x\n  ${UNSET:?}", mapping, WithFirstLine(10)); err == nil || !strings.HasPrefix(err.Error(), "11:3: ") {
+		t.Errorf("Want the error on line 11, got %v", err)
+	}
+	if _, err := Eval("${HOST:}", mapping, WithFirstLine(7)); err == nil || !strings.HasPrefix(err.Error(), "7:") {
+		t.Errorf("Want the parse error on line 7, got %v", err)
+	}
+}
+
+func TestEvalJSONEscape(t *testing.T) {
+	params := map[string]string{"NAME": `say "hi"`, "PATH": `C:\dir`, "NL": "a\nb", "N": "\t2"}
+	mapping := func(s string) string { return params[s] }
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{`{"name": "${NAME}"}`, `{"name": "say \"hi\""}`},
+		{`{"path": "$PATH", "nl": "${NL}"}`, `{"path": "C:\\dir", "nl": "a\nb"}`},
+		{`{"name": "${NAME/\"/'}"}`, `{"name": "say 'hi\""}`},
+		{`{"name": "${UNSET:-${NAME}}"}`, `{"name": "say \"hi\""}`},
+		{`"\"literal\""`, `"\"literal\""`},
+		{`{"n": $((${N}+1)), "m": $((N*2))}`, `{"n": 3, "m": 4}`},
+	}
+	for _, test := range tests {
+		output, err := Eval(test.input, mapping, WithJSONEscape())
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+}
+
+func TestEvalUnescape(t *testing.T) {
+	params := map[string]string{"MSG": `a\tb`, "NL": `line\nbreak`, "QUOTE": `say \"hi\"`}
+	mapping := func(s string) string { return params[s] }
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{`${MSG}`, "a\tb"},
+		{`$NL`, "line\nbreak"},
+		{`${UNSET:-x\ty}`, "x\ty"},
+		{`${UNSET:-\x41\0102}`, "AB"},
+		{`${UNSET:-back\\slash}`, `back\slash`},
+		{`text\tstays`, `text\tstays`},
+	}
+	for _, test := range tests {
+		output, err := Eval(test.input, mapping, WithUnescape())
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+
+	output, err := Eval(`{"q": "${QUOTE}"}`, mapping, WithUnescape(), WithJSONEscape())
+	if want := `{"q": "say \"hi\""}`; err != nil || output != want {
+		t.Errorf("Want unescaped value escaped as %q, got %q, %v", want, output, err)
+	}
+}
+
+func TestEvalLiteral(t *testing.T) {
+	mapping := func(s string) string { return "x" }
+
+	// strings without a $ must evaluate exactly as the parser
+	// would evaluate them.
+	var texts = []string{
+		"",
+		"plain text",
+		"{braces} and }stray",
+		`back\slash \} \\`,
+		"tabs\tand\nnewlines\r\n",
+		"unicode é 😀",
+		"invalid \xff utf8",
+		"#{not} %{a} @{b}",
+	}
+	for _, text := range texts {
+		tmpl, err := Parse(text)
+		if err != nil {
+			t.Errorf("Want %q parsed, got error %q", text, err)
+			continue
+		}
+		want, err := tmpl.Execute(mapping)
+		if err != nil {
+			t.Errorf("Want %q executed, got error %q", text, err)
+		}
+		got, err := Eval(text, mapping)
+		if err != nil || got != want {
+			t.Errorf("Want %q evaluated to %q, got %q, %v", text, want, got, err)
+		}
+	}
+
+	if got, _ := Eval("%{HOST}", mapping, WithDelims("%{", "}")); got != "x" {
+		t.Errorf("Want custom delimiters expanded without a $, got %q", got)
+	}
+	if _, err := Eval("a}", mapping, WithStrictSyntax()); !errors.Is(err, parse.ErrUnexpectedBrace) {
+		t.Errorf("Want strict syntax checked without a $, got %v", err)
+	}
+}
+
+func TestEvalSubstrOffsets(t *testing.T) {
+	params := map[string]string{"S": "abcdefgh", "P": "2", "L": "3", "NEG": " -3", "X": "x"}
+	mapping := func(s string) string { return params[s] }
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"${S:${P}}", "cdefgh"},
+		{"${S:${P}:${L}}", "cde"},
+		{"${S:$P:$L}", "cde"},
+		{"${S:1:${L}}", "bcd"},
+		{"${S:${NEG}}", "fgh"},
+		{"${S:${UNSET:-4}:2}", "ef"},
+		{"${S:x}", "abcdefgh"},
+		{"${S:1:two}", "abcdefgh"},
+	}
+	for _, test := range tests {
+		output, err := Eval(test.input, mapping)
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+
+	for _, input := range []string{"${S:${X}}", "${S:1:$X}", "${S:${UNSET}}"} {
+		_, err := Eval(input, mapping)
+		var offsetErr *OffsetError
+		if !errors.As(err, &offsetErr) || offsetErr.Name != "S" {
+			t.Errorf("Want OffsetError for %q, got %v", input, err)
+		}
+	}
+	_, err := Eval("\n ${S:${X}}", mapping)
+	if want := `2:2: S: "x": offset is not an integer`; err == nil || err.Error() != want {
+		t.Errorf("Want error %q, got %v", want, err)
+	}
+
+	// strict offsets written literally must be integers too
+	for _, input := range []string{"${S:x}", "${S:1:two}", "${S:${X}}"} {
+		_, err := Eval(input, mapping, WithStrictOffsets())
+		var offsetErr *OffsetError
+		if !errors.As(err, &offsetErr) || offsetErr.Name != "S" {
+			t.Errorf("Want OffsetError for %q, got %v", input, err)
+		}
+	}
+	if got, err := Eval("${S:2:3}", mapping, WithStrictOffsets()); err != nil || got != "cde" {
+		t.Errorf("Want integer offsets expanded, got %q, %v", got, err)
+	}
+}
+
+func TestEvalCaseInsensitiveNames(t *testing.T) {
+	params := map[string]string{"PATH": "/bin", "home": "/root", "Temp": `C:\Temp`, "user": "lower", "USER": "upper"}
+	lookup := func(s string) (string, bool) {
+		v, ok := params[s]
+		return v, ok
+	}
+	opts := []Option{WithCaseInsensitiveNames(), WithEnumerator(names{"PATH", "home", "Temp", "user", "USER"})}
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"${Path}:${PATH}:$path", "/bin:/bin:/bin"},
+		{"${HOME} ${Home}", "/root /root"},
+		{"${TEMP}", `C:\Temp`},
+		{"${user} ${User} ${USER}", "lower upper upper"},
+		{"${UNSET:-x} $((${#Path} + 1))", "x 5"},
+	}
+	for _, test := range tests {
+		output, err := EvalLookup(test.input, lookup, opts...)
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+
+	if output, _ := EvalLookup("${Path}", lookup); output != "" {
+		t.Errorf("Want names case sensitive by default, got %q", output)
+	}
+
+	// a name set to the empty string in the exact case wins.
+	params["Path"] = ""
+	if output, err := EvalLookup("[${Path}] [${path}]", lookup, opts...); err != nil || output != "[] [/bin]" {
+		t.Errorf("Want the empty Path used as is, got %q, %v", output, err)
+	}
+	_, err := EvalLookup("${Unset}", lookup, append(opts, WithStrict())...)
+	var undef *UndefinedError
+	if !errors.As(err, &undef) || undef.Name != "Unset" {
+		t.Errorf("Want UndefinedError naming Unset, got %v", err)
+	}
+}
+
+func TestEvalRecursiveExpansion(t *testing.T) {
+	params := map[string]string{
+		"SCHEME": "https",
+		"HOST":   "example.com",
+		"URL":    "${SCHEME}://${HOST}",
+		"API":    "$URL/api",
+		"PRICE":  "$$5",
+		"A":      "${B}",
+		"B":      "${A}",
+		"SELF":   "x${SELF}",
+	}
+	mapping := func(s string) string { return params[s] }
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"${URL}", "https://example.com"},
+		{"${API}/v1", "https://example.com/api/v1"},
+		{"${API#https://}", "example.com/api"},
+		{"${UNSET:-${URL}}", "https://example.com"},
+		{"${PRICE}", "$5"},
+	}
+	for _, test := range tests {
+		output, err := Eval(test.input, mapping, WithRecursiveExpansion())
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+
+	if output, _ := Eval("${URL}", mapping); output != "${SCHEME}://${HOST}" {
+		t.Errorf("Want values expanded once by default, got %q", output)
+	}
+	for _, input := range []string{"${A}", "${SELF}"} {
+		if _, err := Eval(input, mapping, WithRecursiveExpansion()); !errors.Is(err, ErrMaxDepth) {
+			t.Errorf("Want ErrMaxDepth for %q, got %v", input, err)
+		}
+	}
+}
+
+func TestEvalValueTransform(t *testing.T) {
+	params := map[string]string{"USER": " admin ", "DB_SECRET": "hunter2", "EMPTY": ""}
+	lookup := func(s string) (string, bool) {
+		v, ok := params[s]
+		return v, ok
+	}
+	var names []string
+	transform := func(name, value string) string {
+		names = append(names, name)
+		if strings.HasSuffix(name, "_SECRET") {
+			return "***"
+		}
+		return strings.TrimSpace(value)
+	}
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"user=${USER}.", "user=admin."},
+		{"pass=$DB_SECRET ${DB_SECRET:0:2} ${#DB_SECRET}", "pass=*** ** 3"},
+		{"${UNSET:- default } [${EMPTY}]", " default  []"},
+		{" literal ${USER^^} ", " literal ADMIN "},
+	}
+	for _, test := range tests {
+		output, err := EvalLookup(test.input, lookup, WithValueTransform(transform))
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+
+	want := []string{"USER", "DB_SECRET", "DB_SECRET", "DB_SECRET", "EMPTY", "USER"}
+	if diff := cmp.Diff(want, names); diff != "" {
+		t.Errorf("Want the transform to receive each set variable: %s", diff)
+	}
+}
+
+func TestEvalDirectives(t *testing.T) {
+	mapping := func(s string) string { return strings.ToLower(s) }
+	input := "host: ${HOST}\n# envsubst:off\nexample: ${HOME:-/root} $$\n# envsubst:on\nuser: $USER\n"
+
+	output, err := Eval(input, mapping, WithDirectives())
+	if want := "host: host\n# envsubst:off\nexample: ${HOME:-/root} $$\n# envsubst:on\nuser: user\n"; err != nil || output != want {
+		t.Errorf("Want %q, got %q, %v", want, output, err)
+	}
+	output, err = Eval(input, mapping, WithStripDirectives())
+	if want := "host: host\nexample: ${HOME:-/root} $$\nuser: user\n"; err != nil || output != want {
+		t.Errorf("Want %q, got %q, %v", want, output, err)
+	}
+	output, err = Eval("a\n# envsubst:off\nb\n", mapping, WithStripDirectives())
+	if want := "a\nb\n"; err != nil || output != want {
+		t.Errorf("Want markers stripped without substitutions, got %q, %v", output, err)
+	}
+}
+
+func TestEvalKeepUnset(t *testing.T) {
+	params := map[string]string{"HOST": "localhost", "EMPTY": "", "REF": "MISSING"}
+	lookup := func(s string) (string, bool) {
+		v, ok := params[s]
+		return v, ok
+	}
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"${HOST}:${PORT}", "localhost:${PORT}"},
+		{"$HOST:$PORT/x", "localhost:$PORT/x"},
+		{"[${EMPTY}][${EMPTY^^}]", "[][]"},
+		{"${PORT:-8080} ${PORT-x} ${PORT:+set}", "8080 x "},
+		{"${USER^^} ${USER:0:2} ${USER//a/b} ${#USER}", "${USER^^} ${USER:0:2} ${USER//a/b} ${#USER}"},
+		{"${UNSET:-${PORT}}", "${PORT}"},
+		{"${!REF}", "${!REF}"},
+	}
+	for _, test := range tests {
+		output, err := EvalLookup(test.input, lookup, WithKeepUnset())
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+}
+
+func TestEvalDefaults(t *testing.T) {
+	params := map[string]string{"HOST": "example.com", "EMPTY": ""}
+	lookup := func(s string) (string, bool) {
+		v, ok := params[s]
+		return v, ok
+	}
+	defaults := map[string]string{"HOST": "localhost", "PORT": "8080", "EMPTY": "filled", "PROTO": "https"}
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"${PROTO}://${HOST}:${PORT}", "https://example.com:8080"},
+		{"$PROTO [${EMPTY}] ${PORT^^}", "https [] 8080"},
+		{"${PORT:-80} ${PORT-80} ${PORT:+set}", "80 80 "},
+		{"${UNSET:-${PORT}}", "8080"},
+		{"$((PORT+1))", "8081"},
+		{"[${OTHER}]", "[]"},
+	}
+	for _, test := range tests {
+		output, err := EvalLookup(test.input, lookup, WithDefaults(defaults))
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+
+	// a variable with a default is not undefined.
+	if _, err := EvalLookup("${PORT}", lookup, WithDefaults(defaults), WithStrict()); err != nil {
+		t.Errorf("Want a variable with a default defined, got %v", err)
+	}
+
+	// a variable set to the empty string keeps its value.
+	output, err := EvalLookup("[${A}]", func(string) (string, bool) { return "", true }, WithDefaults(map[string]string{"A": "d"}))
+	if err != nil || output != "[]" {
+		t.Errorf("Want a set but empty variable kept, got %q, %v", output, err)
+	}
+}
+
+func TestEvalBalancedBraces(t *testing.T) {
+	params := map[string]string{"SET": `{"set":true}`, "NAME": "app"}
+	lookup := func(s string) (string, bool) {
+		v, ok := params[s]
+		return v, ok
+	}
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{`${JSON:-{"k":"v"}}`, `{"k":"v"}`},
+		{`${SET:-{"k":"v"}}`, `{"set":true}`},
+		{`${JSON:-{"a":{"b":[1,2]}}} tail`, `{"a":{"b":[1,2]}} tail`},
+		{`${JSON:-{"name":"${NAME}"}}`, `{"name":"app"}`},
+		{`${SET:+{"enabled":{}}}`, `{"enabled":{}}`},
+		{`${JSON-{}}${JSON:-}`, `{}`},
+		{`{"a": ${JSON:-{}}}`, `{"a": {}}`},
+	}
+	for _, test := range tests {
+		output, err := EvalLookup(test.input, lookup, WithBalancedBraces())
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+
+	// by default the first closing brace ends the substitution.
+	if output, _ := EvalLookup(`${SET:-{"k":"v"}}`, lookup); output != `{"set":true}}` {
+		t.Errorf("Want the first brace to close the substitution by default, got %q", output)
+	}
+	if _, err := EvalLookup(`${JSON:-{"k":"v"}`, lookup, WithBalancedBraces()); !errors.Is(err, parse.ErrBadSubstitution) {
+		t.Errorf("Want unbalanced braces to return ErrBadSubstitution, got %v", err)
+	}
+}
+
+func TestEvalLiteralDoubleDollar(t *testing.T) {
+	params := map[string]string{"HOST": "localhost", "VALUE": "pid $$"}
+	mapping := func(s string) string { return params[s] }
+
+	var tests = []struct {
+		input   string
+		literal string
+		escaped string
+	}{
+		{"kill -9 $$", "kill -9 $$", "kill -9 $"},
+		{"$$HOST", "$localhost", "$HOST"},
+		{"$${HOST}", "$localhost", "${HOST}"},
+		{`\${HOST}`, "${HOST}", "${HOST}"},
+		{"${HOST} $$ ${UNSET:-$$}", "localhost $$ $$", "localhost $ $$"},
+		{"$$$$", "$$$$", "$$"},
+	}
+	for _, test := range tests {
+		output, err := Eval(test.input, mapping, WithLiteralDoubleDollar())
+		if err != nil || output != test.literal {
+			t.Errorf("Want %q expanded to %q with literal $$, got %q, %v", test.input, test.literal, output, err)
+		}
+		output, err = Eval(test.input, mapping)
+		if err != nil || output != test.escaped {
+			t.Errorf("Want %q expanded to %q by default, got %q, %v", test.input, test.escaped, output, err)
+		}
+	}
+
+	// values expanded recursively keep their $$ too.
+	output, err := Eval("${VALUE}", mapping, WithLiteralDoubleDollar(), WithRecursiveExpansion())
+	if err != nil || output != "pid $$" {
+		t.Errorf("Want a recursively expanded value to keep $$, got %q, %v", output, err)
+	}
+}
+
+func TestEvalShellQuote(t *testing.T) {
+	params := map[string]string{"MSG": "hello world", "HOME": "$HOME", "QUOTE": "it's", "N": "2"}
+	mapping := func(s string) string { return params[s] }
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"echo ${MSG}", "echo 'hello world'"},
+		{"echo $HOME ${QUOTE}", `echo '$HOME' 'it'\''s'`},
+		{"echo ${UNSET}", "echo ''"},
+		{"echo ${UNSET:-${MSG}}!", "echo 'hello world'!"},
+		{"echo ${MSG@Q}", `echo ''\''hello world'\'''`},
+		{"echo 'literal $$text'", "echo 'literal $text'"},
+		{"echo $((1+2))", "echo '3'"},
+		{"echo $((${N}+1)) $((N*2)) $(($N-1))", "echo '3' '4' '1'"},
+	}
+	for _, test := range tests {
+		output, err := Eval(test.input, mapping, WithShellQuote())
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+}
+
+func TestEvalStrictSyntax(t *testing.T) {
+	mapping := func(s string) string { return "x" }
+
+	if _, err := Eval("${foo}}", mapping, WithStrictSyntax()); !errors.Is(err, parse.ErrUnexpectedBrace) {
+		t.Errorf("Want ErrUnexpectedBrace, got %v", err)
+	}
+	output, err := Eval(`{"a": "${foo}"}`, mapping, WithStrictSyntax())
+	if err != nil || output != `{"a": "x"}` {
+		t.Errorf("Want balanced braces expanded, got %q, %v", output, err)
+	}
+	if output, _ := Eval("${foo}}", mapping); output != "x}" {
+		t.Errorf("Want a stray brace kept by default, got %q", output)
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	mapping := func(ctx context.Context, s string) (string, error) {
+		return strings.ToLower(s), nil
+	}
+	output, err := EvalContext(context.Background(), "${HOST}:$PORT", mapping)
+	if err != nil || output != "host:port" {
+		t.Errorf("Want expanded to %q, got %q, %v", "host:port", output, err)
+	}
+
+	// the mapping receives the context
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "from context")
+	output, _ = EvalContext(ctx, "${HOST}", func(ctx context.Context, s string) (string, error) {
+		return ctx.Value(key{}).(string), nil
+	})
+	if output != "from context" {
+		t.Errorf("Want the mapping to receive the context, got %q", output)
+	}
+
+	// cancellation stops evaluation between lookups
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	_, err = EvalContext(ctx, "${A} ${B} $((C+1))", func(ctx context.Context, s string) (string, error) {
+		calls++
+		cancel()
+		return "1", nil
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("Want context.Canceled after 1 lookup, got %v after %d", err, calls)
+	}
+
+	// a mapping observing the deadline reports the context error
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = EvalContext(ctx, "$((SLOW+1))", func(ctx context.Context, s string) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Want context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestEvalFunc(t *testing.T) {
+	errDenied := errors.New("permission denied")
+	mapping := func(s string) (string, error) {
+		if s == "SECRET" {
+			return "", errDenied
+		}
+		return "value", nil
+	}
+
+	output, err := EvalFunc("${HOST}:$PORT", mapping)
+	if err != nil || output != "value:value" {
+		t.Errorf("Want expanded to %q, got %q, %v", "value:value", output, err)
+	}
+
+	var tests = []struct {
+		input string
+		err   string
+	}{
+		{"a ${SECRET}", "1:3: SECRET: permission denied"},
+		{"a\n${HOST:+${SECRET}}", "2:9: SECRET: permission denied"},
+		{"$((SECRET + 1))", "1:1: SECRET: permission denied"},
+	}
+	for _, test := range tests {
+		_, err := EvalFunc(test.input, mapping)
+		lerr, ok := err.(*LookupError)
+		if !ok || lerr.Name != "SECRET" || err.Error() != test.err {
+			t.Errorf("Want %q to return LookupError %q, got %v", test.input, test.err, err)
+		}
+		if !errors.Is(err, errDenied) {
+			t.Errorf("Want %q error to wrap the mapping error", test.input)
+		}
+	}
+}
+
+func TestEvalTrace(t *testing.T) {
+	params := map[string]string{"HOST": "localhost", "PORT": "", "SCHEME": "https"}
+	mapping := func(s string) string {
+		return params[s]
+	}
+
+	var tests = []struct {
+		input  string
+		output string
+		used   map[string]string
+	}{
+		{"plain text", "plain text", map[string]string{}},
+		{"${HOST}:$PORT", "localhost:", map[string]string{"HOST": "localhost", "PORT": ""}},
+		{"${PORT:-${DEFAULT_PORT}}", "", map[string]string{"PORT": "", "DEFAULT_PORT": ""}},
+		{"${HOST:-${FALLBACK}}", "localhost", map[string]string{"HOST": "localhost"}},
+		{"${SCHEME:+${SCHEME}://}${HOST^^}", "https://LOCALHOST", map[string]string{"SCHEME": "https", "HOST": "localhost"}},
+		{"$((PORT + 1))", "1", map[string]string{"PORT": ""}},
+	}
+	for _, test := range tests {
+		output, used, err := EvalTrace(test.input, mapping)
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+		if diff := cmp.Diff(test.used, used); diff != "" {
+			t.Errorf("Unexpected variables used by %q: %s", test.input, diff)
+		}
+	}
+}
+
+func TestEvalAllUndefined(t *testing.T) {
+	params := map[string]string{"HOST": "localhost", "EMPTY": ""}
+	lookup := func(s string) (string, bool) {
+		v, ok := params[s]
+		return v, ok
+	}
+
+	input := "${HOST}:${PORT}\n${USER} ${EMPTY} ${PORT}\n  ${UNSET:-x} $USER $DEBUG"
+	_, err := EvalLookup(input, lookup, WithAllUndefined())
+	uerrs, ok := err.(UndefinedErrors)
+	if !ok {
+		t.Fatalf("Want UndefinedErrors, got %v", err)
+	}
+	want := UndefinedErrors{
+		{Name: "PORT", Pos: parse.Pos{Line: 1, Col: 9}},
+		{Name: "USER", Pos: parse.Pos{Line: 2, Col: 1}},
+		{Name: "DEBUG", Pos: parse.Pos{Line: 3, Col: 21}},
+	}
+	if diff := cmp.Diff(want, uerrs); diff != "" {
+		t.Errorf(diff)
+	}
+	if got, want := err.Error(), "1:9: PORT: unbound variable\n2:1: USER: unbound variable\n3:21: DEBUG: unbound variable"; got != want {
+		t.Errorf("Want error %q, got %q", want, got)
+	}
+
+	output, err := EvalLookup("${HOST} ${EMPTY}", lookup, WithAllUndefined())
+	if err != nil || output != "localhost " {
+		t.Errorf("Want expanded without error, got %q, %v", output, err)
+	}
+}
+
+func TestEvalNestedDefaults(t *testing.T) {
+	params := map[string]string{"VAR": "var", "OTHER": "other", "THIRD": "third", "EMPTY": ""}
+
+	var tests = []struct {
+		input  string
+		output string
+		params []string // variables that are set
+		calls  []string // variables looked up, in order
+	}{
+		{
+			input:  "${VAR:-${OTHER:-${THIRD:-fallback}}}",
+			output: "var",
+			params: []string{"VAR", "OTHER", "THIRD"},
+			calls:  []string{"VAR"},
+		},
+		{
+			input:  "${VAR:-${OTHER:-${THIRD:-fallback}}}",
+			output: "other",
+			params: []string{"OTHER", "THIRD"},
+			calls:  []string{"VAR", "OTHER"},
+		},
+		{
+			input:  "${VAR:-${OTHER:-${THIRD:-fallback}}}",
+			output: "third",
+			params: []string{"THIRD"},
+			calls:  []string{"VAR", "OTHER", "THIRD"},
+		},
+		{
+			input:  "${VAR:-${OTHER:-${THIRD:-fallback}}}",
+			output: "fallback",
+			params: nil,
+			calls:  []string{"VAR", "OTHER", "THIRD"},
+		},
+		{
+			input:  "${EMPTY:-${OTHER:-${THIRD:-fallback}}}",
+			output: "other",
+			params: []string{"EMPTY", "OTHER"},
+			calls:  []string{"EMPTY", "OTHER"},
+		},
+		{
+			input:  "${EMPTY-${OTHER:-${THIRD:-fallback}}}",
+			output: "",
+			params: []string{"EMPTY", "OTHER"},
+			calls:  []string{"EMPTY"},
+		},
+		{
+			input:  "${VAR:+${OTHER:-${THIRD:-fallback}}!}",
+			output: "third!",
+			params: []string{"VAR", "THIRD"},
+			calls:  []string{"VAR", "OTHER", "THIRD"},
+		},
+		// the alternate word is only evaluated when it is used
+		{
+			input:  "${EMPTY:+${OTHER}}",
+			output: "",
+			params: []string{"EMPTY", "OTHER"},
+			calls:  []string{"EMPTY"},
+		},
+		{
+			input:  "${EMPTY+${OTHER}}",
+			output: "other",
+			params: []string{"EMPTY", "OTHER"},
+			calls:  []string{"EMPTY", "OTHER"},
+		},
+		{
+			input:  "${VAR+${OTHER}} ${VAR:+${OTHER}}",
+			output: " ",
+			params: []string{"OTHER"},
+			calls:  []string{"VAR", "VAR"},
+		},
+	}
+
+	for _, test := range tests {
+		set := map[string]bool{}
+		for _, name := range test.params {
+			set[name] = true
+		}
+		var calls []string
+		lookup := func(s string) (string, bool) {
+			calls = append(calls, s)
+			return params[s], set[s]
+		}
+		output, err := EvalLookup(test.input, lookup)
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q with %v set, got %q", test.input, test.output, test.params, output)
+		}
+		if diff := cmp.Diff(test.calls, calls); diff != "" {
+			t.Errorf("Unexpected lookups for %q with %v set: %s", test.input, test.params, diff)
+		}
+	}
+
+	// the depth of the chain is bounded by the maximum depth
+	input := "${A:-${B:-${C:-${D:-fallback}}}}"
+	unset := func(string) (string, bool) { return "", false }
+	if output, err := EvalLookup(input, unset, WithMaxDepth(4)); err != nil || output != "fallback" {
+		t.Errorf("Want %q expanded to fallback, got %q, %v", input, output, err)
+	}
+	if _, err := EvalLookup(input, unset, WithMaxDepth(3)); !errors.Is(err, ErrMaxDepth) {
+		t.Errorf("Want %q to exceed the maximum depth, got %v", input, err)
+	}
+}
+
+func TestEvalTildeExpansion(t *testing.T) {
+	params := map[string]string{"HOME": "/home/bozo", "BIN": "/usr/bin"}
+	lookup := func(s string) (string, bool) {
+		v, ok := params[s]
+		return v, ok
+	}
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"~", "/home/bozo"},
+		{"~/bin ~ ~/.config", "/home/bozo/bin /home/bozo /home/bozo/.config"},
+		{"${BIN:-~/bin} ${UNSET:-~/bin} ${UNSET:-~}", "/usr/bin /home/bozo/bin /home/bozo"},
+		{"${BIN:+~/bin}", "/home/bozo/bin"},
+		{"a~b a~/b ~user ~~ ${BIN}~/x x/~", "a~b a~/b ~user ~~ /usr/bin~/x x/~"},
+		{"${UNSET:-x~/bin}", "x~/bin"},
+	}
+	for _, test := range tests {
+		output, err := EvalLookup(test.input, lookup, WithTildeExpansion())
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+
+	// without the option, or without HOME, ~ is literal
+	if output, _ := EvalLookup("~/bin", lookup); output != "~/bin" {
+		t.Errorf("Want ~ left unchanged by default, got %q", output)
+	}
+	unset := func(string) (string, bool) { return "", false }
+	if output, _ := EvalLookup("~/bin", unset, WithTildeExpansion()); output != "~/bin" {
+		t.Errorf("Want ~ left unchanged without HOME, got %q", output)
+	}
+}
+
+func TestEvalLineEnding(t *testing.T) {
+	params := map[string]string{"BODY": "a\r\nb\nc"}
+	mapping := func(s string) string {
+		return params[s]
+	}
+
+	var tests = []struct {
+		input  string
+		output string
+		opts   []Option
+	}{
+		{"x\r\ny\n${BODY}\n", "x\ny\na\r\nb\nc\n", []Option{WithLineEnding(LF)}},
+		{"x\r\ny\n${BODY}\n", "x\r\ny\r\na\r\nb\nc\r\n", []Option{WithLineEnding(CRLF)}},
+		{"x\r\ny\n${BODY}\n", "x\ny\na\nb\nc\n", []Option{WithLineEnding(LF), WithValueLineEndings()}},
+		{"x\r\ny\n${BODY}\n", "x\r\ny\r\na\r\nb\r\nc\r\n", []Option{WithLineEnding(CRLF), WithValueLineEndings()}},
+		{"x\r\ny\n${BODY}\n", "x\r\ny\na\r\nb\nc\n", []Option{WithValueLineEndings()}},
+		{"${UNSET:-a\r\nb}\r\n", "a\r\nb\n", []Option{WithLineEnding(LF)}},
+		{"no substitutions\r\n", "no substitutions\n", []Option{WithLineEnding(LF)}},
+	}
+	for _, test := range tests {
+		output, err := Eval(test.input, mapping, test.opts...)
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+}
+
+func TestEvalStats(t *testing.T) {
+	mapping := func(string) string { return "/usr/local/bin" }
+
+	var stats Stats
+	output, err := Eval(`${BIN//\//-} ${BIN/#\//} ${LIB//x/y} ${BIN^^}`, mapping, WithStats(&stats))
+	if want := "-usr-local-bin usr/local/bin /usr/local/bin /USR/LOCAL/BIN"; err != nil || output != want {
+		t.Errorf("Want %q, got %q, %v", want, output, err)
+	}
+	want := []Replacement{
+		{Name: "BIN", Count: 3, Pos: parse.Pos{Line: 1, Col: 1}},
+		{Name: "BIN", Count: 1, Pos: parse.Pos{Line: 1, Col: 14}},
+		{Name: "LIB", Count: 0, Pos: parse.Pos{Line: 1, Col: 26}},
+	}
+	if diff := cmp.Diff(want, stats.Replacements); diff != "" {
+		t.Errorf("Unexpected replacements: %s", diff)
+	}
+}
+
+func TestEvalByteLength(t *testing.T) {
+	params := map[string]string{"ASCII": "naive", "UTF8": "naïve", "EMOJI": "😀"}
+	mapping := func(s string) string { return params[s] }
+
+	var tests = []struct {
+		input string
+		runes string
+		bytes string
+	}{
+		{"${#ASCII}", "5", "5"},
+		{"${#UTF8}", "5", "6"},
+		{"${#EMOJI}", "1", "4"},
+		{"${#${UNSET:-$UTF8}}", "5", "6"},
+		{"${#UTF8[0]} ${#UTF8[@]}", "5 1", "6 1"},
+	}
+	for _, test := range tests {
+		output, err := Eval(test.input, mapping)
+		if err != nil || output != test.runes {
+			t.Errorf("Want %q expanded to %q characters, got %q, %v", test.input, test.runes, output, err)
+		}
+		output, err = Eval(test.input, mapping, WithByteLength())
+		if err != nil || output != test.bytes {
+			t.Errorf("Want %q expanded to %q bytes, got %q, %v", test.input, test.bytes, output, err)
+		}
+	}
+}
+
+func TestEvalTrimEmptyExpansionWhitespace(t *testing.T) {
+	params := map[string]string{"SET": "v"}
+	mapping := func(s string) string { return params[s] }
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"key: ${VALUE}\nnext: 1\n", "key:\nnext: 1\n"},
+		{"key: ${VALUE}", "key:"},
+		{"a ${VALUE} b", "a b"},
+		{"a ${X} ${Y} b", "a b"},
+		{"  ${VALUE} b\n", "  b\n"},
+		{"x:\n  ${VALUE}\n", "x:\n\n"},
+		{"  ${X} ${SET}\n", "  v\n"},
+		{"a\t${VALUE}\r\n", "a\r\n"},
+		{"prefix-${VALUE} ${VALUE}-suffix", "prefix- -suffix"},
+		{"key: ${VALUE:-default} ${SET}", "key: default v"},
+	}
+	for _, test := range tests {
+		output, err := Eval(test.input, mapping, WithTrimEmptyExpansionWhitespace())
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+}
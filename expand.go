@@ -0,0 +1,91 @@
+package envsubst
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// maxPending is the size of the input held back while a substitution
+// spanning multiple lines is left open, past which the input is
+// expanded as is so that an unclosed ${ is reported rather than
+// buffered until the end of the input.
+const maxPending = 1 << 20
+
+// Expand reads a template from r and writes the expanded output to
+// w based on the mapping function. The input is expanded one line at
+// a time, or for substitutions that span multiple lines, once the
+// closing bracket is read, so the input is never held in memory as a
+// whole. A substitution left open for more than 1 MiB of input fails
+// as unclosed. Errors report the line of the input at which they
+// occurred.
+func Expand(r io.Reader, w io.Writer, mapping func(string) string) error {
+	reader := bufio.NewReader(r)
+	var pending strings.Builder
+	var open []byte
+	var lines int
+	for {
+		text, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		pending.WriteString(text)
+		open = bracketDepth(text, open)
+
+		if (len(open) == 0 || err == io.EOF || pending.Len() > maxPending) && pending.Len() != 0 {
+			chunk := pending.String()
+			out, eerr := Eval(chunk, mapping, WithFirstLine(lines+1))
+			if eerr != nil {
+				return eerr
+			}
+			if _, werr := io.WriteString(w, out); werr != nil {
+				return werr
+			}
+			lines += strings.Count(chunk, "\n")
+			pending.Reset()
+			open = open[:0]
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// bracketDepth returns the kinds of the substitutions left open at
+// the end of the text, given those open at its start: '{' for ${,
+// 'a' for $(( and '(' for a parenthesis within it. A closing bracket
+// only closes an opener of its own kind, so the )) in ${A:-))} does
+// not close the substitution. Escaped openers, such as $${ and \${,
+// open none.
+func bracketDepth(text string, open []byte) []byte {
+	top := func() byte {
+		if len(open) == 0 {
+			return 0
+		}
+		return open[len(open)-1]
+	}
+	for i := 0; i < len(text); i++ {
+		switch {
+		case strings.HasPrefix(text[i:], "$$"),
+			strings.HasPrefix(text[i:], `\$`),
+			strings.HasPrefix(text[i:], `\\`):
+			i++
+		case strings.HasPrefix(text[i:], "${"):
+			open = append(open, '{')
+			i++
+		case strings.HasPrefix(text[i:], "$(("):
+			open = append(open, 'a')
+			i += 2
+		case text[i] == '}' && top() == '{':
+			open = open[:len(open)-1]
+		case text[i] == '(' && (top() == 'a' || top() == '('):
+			open = append(open, '(')
+		case text[i] == ')' && top() == '(':
+			open = open[:len(open)-1]
+		case strings.HasPrefix(text[i:], "))") && top() == 'a':
+			open = open[:len(open)-1]
+			i++
+		}
+	}
+	return open
+}
@@ -0,0 +1,124 @@
+package envsubst
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/drone/envsubst/parse"
+)
+
+func TestExpandStream(t *testing.T) {
+	params := map[string]string{"HOST": "localhost", "PORT": "8080"}
+	mapping := func(s string) string {
+		return params[s]
+	}
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"", ""},
+		{"no variables\n", "no variables\n"},
+		{"host=${HOST}\nport=$PORT\n", "host=localhost\nport=8080\n"},
+		{"no trailing newline ${HOST}", "no trailing newline localhost"},
+		{"default=${USER:-first\nsecond}\n${PORT}", "default=first\nsecond\n8080"},
+		{"escaped $${HOST}\n", "escaped ${HOST}\n"},
+	}
+
+	for _, test := range tests {
+		// read one byte at a time so that substitutions
+		// cross the boundaries of every read.
+		r := iotest.OneByteReader(strings.NewReader(test.input))
+		w := new(bytes.Buffer)
+		if err := Expand(r, w, mapping); err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if got := w.String(); got != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, got)
+		}
+	}
+}
+
+func TestExpandErrorLine(t *testing.T) {
+	input := "line one\nline two\n${HOST:?is required}\n"
+	err := Expand(strings.NewReader(input), new(bytes.Buffer), func(string) string { return "" })
+	perr, ok := err.(*ParameterError)
+	if !ok {
+		t.Fatalf("Want ParameterError, got %v", err)
+	}
+	if want := (parse.Pos{Line: 3, Col: 1}); perr.Pos != want {
+		t.Errorf("Want error at %v, got %v", want, perr.Pos)
+	}
+
+	input = "line one\nline two\nline ${three\n"
+	err = Expand(strings.NewReader(input), new(bytes.Buffer), func(string) string { return "" })
+	perr2, ok := err.(*parse.ErrParse)
+	if !ok || !errors.Is(err, parse.ErrBadSubstitution) {
+		t.Fatalf("Want ErrParse, got %v", err)
+	}
+	if perr2.Pos.Line != 3 {
+		t.Errorf("Want bad substitution on line 3, got %v", perr2.Pos)
+	}
+
+	// the line of other errors is shifted alike, without a prefix.
+	input = "line one\n  ${HOST:?unset}\n"
+	err = Expand(strings.NewReader(input), new(bytes.Buffer), func(string) string { return "" })
+	if _, ok := err.(*ParameterError); !ok || !strings.HasPrefix(err.Error(), "2:3:") {
+		t.Errorf("Want ParameterError on line 2, got %v", err)
+	}
+}
+
+func TestBracketDepth(t *testing.T) {
+	var tests = []struct {
+		text string
+		open string
+	}{
+		{"${HOST", "{"},
+		{"${A:-${B}", "{"},
+		{"$((1+", "a"},
+		{"$${HOST", ""},
+		{`\${HOST`, ""},
+		{`\$((1+`, ""},
+		{`\\${HOST`, "{"},
+		{"${A:-))", "{"},
+		{"${A:-)) }", ""},
+		{"$((1+${A}", "a"},
+		{"$(( (1+2)*3 ))", ""},
+		{"$(((1+2)", "a"},
+		{"$((1)) }", ""},
+	}
+	for _, test := range tests {
+		if got := string(bracketDepth(test.text, nil)); got != test.open {
+			t.Errorf("Want %q to leave %q open, got %q", test.text, test.open, got)
+		}
+	}
+}
+
+func TestExpandOpenSubstitution(t *testing.T) {
+	// a closing )) does not close ${.
+	var out bytes.Buffer
+	err := Expand(strings.NewReader("x ${A:-))\n}\ny\n"), &out, func(string) string { return "" })
+	if want := "x ))\n\ny\n"; err != nil || out.String() != want {
+		t.Errorf("Want %q, got %q, %v", want, out.String(), err)
+	}
+
+	// an unclosed ${ fails once too much input is pending, rather
+	// than reading to the end of the input.
+	lines := strings.Repeat(strings.Repeat("x", 1023)+"\n", maxPending/1024+1)
+	r := io.MultiReader(strings.NewReader("${A:-\n"+lines), errReader{})
+	err = Expand(r, new(bytes.Buffer), func(string) string { return "" })
+	if !errors.Is(err, parse.ErrBadSubstitution) {
+		t.Errorf("Want an unclosed substitution reported, got %v", err)
+	}
+}
+
+// errReader fails every read.
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("read past the pending limit")
+}
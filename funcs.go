@@ -1,6 +1,12 @@
 package envsubst
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 	"unicode"
@@ -12,26 +18,43 @@ import (
 // defines a parameter substitution function.
 type substituteFunc func(string, ...string) string
 
-// toLen returns the length of string s.
+// toLen returns the length of string s in characters.
 func toLen(s string, args ...string) string {
+	return strconv.Itoa(utf8.RuneCountInString(s))
+}
+
+// toByteLen returns the length of string s in bytes.
+func toByteLen(s string, args ...string) string {
 	return strconv.Itoa(len(s))
 }
 
 // toLower returns a copy of the string s with all characters
-// mapped to their lower case.
+// mapped to their lower case. If a pattern is provided only the
+// characters matching the pattern are mapped.
 func toLower(s string, args ...string) string {
+	if len(args) != 0 {
+		return mapMatching(s, args[0], false, unicode.ToLower)
+	}
 	return strings.ToLower(s)
 }
 
 // toUpper returns a copy of the string s with all characters
-// mapped to their upper case.
+// mapped to their upper case. If a pattern is provided only the
+// characters matching the pattern are mapped.
 func toUpper(s string, args ...string) string {
+	if len(args) != 0 {
+		return mapMatching(s, args[0], false, unicode.ToUpper)
+	}
 	return strings.ToUpper(s)
 }
 
 // toLowerFirst returns a copy of the string s with the first
-// character mapped to its lower case.
+// character mapped to its lower case. If a pattern is provided
+// the first character is only mapped if it matches the pattern.
 func toLowerFirst(s string, args ...string) string {
+	if len(args) != 0 {
+		return mapMatching(s, args[0], true, unicode.ToLower)
+	}
 	if s == "" {
 		return s
 	}
@@ -40,8 +63,12 @@ func toLowerFirst(s string, args ...string) string {
 }
 
 // toUpperFirst returns a copy of the string s with the first
-// character mapped to its upper case.
+// character mapped to its upper case. If a pattern is provided
+// the first character is only mapped if it matches the pattern.
 func toUpperFirst(s string, args ...string) string {
+	if len(args) != 0 {
+		return mapMatching(s, args[0], true, unicode.ToUpper)
+	}
 	if s == "" {
 		return s
 	}
@@ -49,6 +76,228 @@ func toUpperFirst(s string, args ...string) string {
 	return string(unicode.ToUpper(r)) + s[n:]
 }
 
+// toggle returns a copy of the string s with the case of all
+// characters toggled, so upper case becomes lower case and lower
+// case upper case. If a pattern is provided only the characters
+// matching the pattern are toggled.
+func toggle(s string, args ...string) string {
+	if len(args) != 0 {
+		return mapMatching(s, args[0], false, toggleCase)
+	}
+	return strings.Map(toggleCase, s)
+}
+
+// toggleFirst returns a copy of the string s with the case of the
+// first character toggled. If a pattern is provided the first
+// character is only toggled if it matches the pattern.
+func toggleFirst(s string, args ...string) string {
+	if len(args) != 0 {
+		return mapMatching(s, args[0], true, toggleCase)
+	}
+	if s == "" {
+		return s
+	}
+	r, n := utf8.DecodeRuneInString(s)
+	return string(toggleCase(r)) + s[n:]
+}
+
+// toggleCase maps an upper case character to lower case and any
+// other character to upper case.
+func toggleCase(r rune) rune {
+	if unicode.IsUpper(r) {
+		return unicode.ToLower(r)
+	}
+	return unicode.ToUpper(r)
+}
+
+// mapMatching returns a copy of the string s with the characters
+// that match the glob pattern modified by the mapping function. If
+// first is true only the first character of the string is
+// considered.
+func mapMatching(s, pattern string, first bool, mapping func(rune) rune) string {
+	var b strings.Builder
+	for i, r := range s {
+		if first && i != 0 {
+			b.WriteString(s[i:])
+			break
+		}
+		if match(pattern, string(r)) {
+			r = mapping(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// toQuoted returns a copy of the string s quoted as a single
+// shell word that can be safely reused as shell input.
+func toQuoted(s string, args ...string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// toJSONEscaped returns a copy of the string s escaped for use
+// inside a JSON string, without the enclosing quotes.
+func toJSONEscaped(s string, args ...string) string {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	v := strings.TrimSuffix(b.String(), "\n")
+	return v[1 : len(v)-1]
+}
+
+// toBase64 returns the standard base64 encoding of the UTF-8 bytes
+// of the string s.
+func toBase64(s string, args ...string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// fromBase64 returns the string whose standard, padded base64
+// encoding is s, or an error if s is not valid base64.
+func fromBase64(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64: %w", err)
+	}
+	return string(b), nil
+}
+
+// toURLEncoded returns a copy of the string s with every byte other
+// than the unreserved characters of RFC 3986, A-Z a-z 0-9 - . _ ~,
+// percent-encoded, so that a space is encoded as %20.
+func toURLEncoded(s string, args ...string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isUnreserved(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return b.String()
+}
+
+// fromURLEncoded returns a copy of the string s with each %XX
+// sequence decoded, or an error if a sequence is malformed. Unlike a
+// query string, a + is left unchanged.
+func fromURLEncoded(s string) (string, error) {
+	return url.PathUnescape(s)
+}
+
+// isUnreserved returns true if c is an unreserved character of
+// RFC 3986.
+func isUnreserved(c byte) bool {
+	return isNameChar(c) || c == '-' || c == '.' || c == '~'
+}
+
+// toSHA256 returns the hex encoded SHA-256 digest of the string s.
+func toSHA256(s string, args ...string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// toUnescaped returns a copy of the string s with backslash escape
+// sequences expanded as in the $'...' shell quoting mechanism. As
+// with echo -e, \0 may be followed by up to three octal digits.
+// Unrecognized escape sequences are left unchanged.
+func toUnescaped(s string, args ...string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'e', 'E':
+			b.WriteByte(0x1b)
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\', '\'', '"', '?':
+			b.WriteByte(c)
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			// a leading zero may be followed by three more
+			// digits, as in \0NNN.
+			max := 3
+			if c == '0' {
+				max = 4
+			}
+			n, w := parseDigits(s[i:], 8, max)
+			b.WriteByte(byte(n))
+			i += w - 1
+		case 'x', 'u', 'U':
+			max := 2
+			switch c {
+			case 'u':
+				max = 4
+			case 'U':
+				max = 8
+			}
+			n, w := parseDigits(s[i+1:], 16, max)
+			switch {
+			case w == 0:
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			case c == 'x':
+				b.WriteByte(byte(n))
+			default:
+				b.WriteRune(rune(n))
+			}
+			i += w
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseDigits parses up to max leading digits of s in the given
+// base, returning the value and the number of digits consumed.
+func parseDigits(s string, base, max int) (n, width int) {
+	for width < max && width < len(s) {
+		d, err := strconv.ParseUint(s[width:width+1], base, 8)
+		if err != nil {
+			break
+		}
+		n = n*base + int(d)
+		width++
+	}
+	return n, width
+}
+
+// toLineEnding returns a copy of the string s with each \n and \r\n
+// line terminator replaced by the line ending.
+func toLineEnding(s string, e LineEnding) string {
+	if strings.IndexByte(s, '\n') < 0 {
+		return s
+	}
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	if e == CRLF {
+		s = strings.Replace(s, "\n", "\r\n", -1)
+	}
+	return s
+}
+
 // toDefault returns a copy of the string s if not empty, else
 // returns a concatenation of the args without a separator.
 func toDefault(s string, args ...string) string {
@@ -60,23 +309,27 @@ func toDefault(s string, args ...string) string {
 }
 
 // toSubstr returns a slice of the string s at the specified
-// length and position.
+// length and position. A negative position counts back from the
+// end of the string, and a negative length stops that many
+// characters before the end of the string. The position and
+// length count characters rather than bytes.
 func toSubstr(s string, args ...string) string {
 	if len(args) == 0 {
 		return s // should never happen
 	}
+	r := []rune(s)
 
-	pos, err := strconv.Atoi(args[0])
+	pos, err := parseOffset(args[0])
 	if err != nil {
-		// bash returns the string if the position
-		// cannot be parsed.
+		// a position that cannot be parsed returns the
+		// string unchanged, see WithStrictOffsets.
 		return s
 	}
 
 	if pos < 0 {
 		// if pos is negative (counts from the end) add it
 		// to length to get first character offset
-		pos = len(s) + pos
+		pos = len(r) + pos
 
 		// if negative offset exceeds the length of the string
 		// start from 0
@@ -85,157 +338,257 @@ func toSubstr(s string, args ...string) string {
 		}
 	}
 
-	if len(args) == 1 {
-		if pos < len(s) {
-			return s[pos:]
-		}
+	if pos > len(r) {
 		// if the position exceeds the length of the
 		// string an empty string is returned
 		return ""
 	}
 
-	length, err := strconv.Atoi(args[1])
+	if len(args) == 1 {
+		return string(r[pos:])
+	}
+
+	length, err := parseOffset(args[1])
 	if err != nil {
-		// bash returns the string if the length
-		// cannot be parsed.
+		// as does a length that cannot be parsed.
 		return s
 	}
 
-	if pos+length >= len(s) {
-		// if the position exceeds the length of the
-		// string just return the rest of it like bash
-		return s[pos:]
+	// if the length exceeds the rest of the string just
+	// return the rest of it like bash. The comparison is
+	// made before adding so a large length cannot overflow.
+	end := len(r)
+	switch {
+	case length < 0:
+		// if length is negative it is an offset from
+		// the end of the string
+		end = len(r) + length
+	case length < len(r)-pos:
+		end = pos + length
 	}
+	if end < pos {
+		end = pos
+	}
+
+	return string(r[pos:end])
+}
 
-	return s[pos : pos+length]
+// parseOffset parses a substring position or length. A negative
+// value must be separated from the colon by a space, or enclosed
+// in parentheses, to not be confused with the ${var:-word} default,
+// for example ${var: -5} or ${var:(-5)}.
+func parseOffset(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		s = strings.TrimSpace(s[1 : len(s)-1])
+	}
+	return strconv.Atoi(s)
 }
 
-// replaceAll returns a copy of the string s with all instances
-// of the substring replaced with the replacement string.
+// replaceAll returns a copy of the string s with all matches of
+// the glob pattern replaced with the replacement string.
 func replaceAll(s string, args ...string) string {
-	switch len(args) {
-	case 0:
+	if len(args) == 0 || args[0] == "" {
 		return s
-	case 1:
-		return strings.Replace(s, args[0], "", -1)
-	default:
-		return strings.Replace(s, args[0], args[1], -1)
 	}
+	pattern, repl := args[0], replacement(args)
+	if !isGlob(pattern) {
+		return strings.Replace(s, pattern, repl, -1)
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		if end := longestMatch(pattern, s, i); end > i {
+			b.WriteString(repl)
+			i = end
+			continue
+		}
+		_, w := utf8.DecodeRuneInString(s[i:])
+		b.WriteString(s[i : i+w])
+		i += w
+	}
+	return b.String()
 }
 
-// replaceFirst returns a copy of the string s with the first
-// instance of the substring replaced with the replacement string.
+// replaceFirst returns a copy of the string s with the first match
+// of the glob pattern replaced with the replacement string.
 func replaceFirst(s string, args ...string) string {
-	switch len(args) {
-	case 0:
+	if len(args) == 0 || args[0] == "" {
 		return s
-	case 1:
-		return strings.Replace(s, args[0], "", 1)
-	default:
-		return strings.Replace(s, args[0], args[1], 1)
 	}
+	pattern, repl := args[0], replacement(args)
+	if !isGlob(pattern) {
+		return strings.Replace(s, pattern, repl, 1)
+	}
+	for _, i := range boundaries(s) {
+		if end := longestMatch(pattern, s, i); end > i {
+			return s[:i] + repl + s[end:]
+		}
+	}
+	return s
 }
 
-// replacePrefix returns a copy of the string s with the matching
-// prefix replaced with the replacement string.
+// replacePrefix returns a copy of the string s with the longest
+// prefix matching the glob pattern replaced with the replacement
+// string.
 func replacePrefix(s string, args ...string) string {
-	if len(args) != 2 {
+	if len(args) == 0 {
 		return s
 	}
-	if strings.HasPrefix(s, args[0]) {
-		return strings.Replace(s, args[0], args[1], 1)
+	if end := longestMatch(args[0], s, 0); end >= 0 {
+		return replacement(args) + s[end:]
 	}
 	return s
 }
 
-// replaceSuffix returns a copy of the string s with the matching
-// suffix replaced with the replacement string.
+// replaceSuffix returns a copy of the string s with the longest
+// suffix matching the glob pattern replaced with the replacement
+// string.
 func replaceSuffix(s string, args ...string) string {
-	if len(args) != 2 {
+	if len(args) == 0 {
 		return s
 	}
-	if strings.HasSuffix(s, args[0]) {
-		s = strings.TrimSuffix(s, args[0])
-		s = s + args[1]
+	for _, i := range boundaries(s) {
+		if match(args[0], s[i:]) {
+			return s[:i] + replacement(args)
+		}
 	}
 	return s
 }
 
-// TODO
+// countMatches returns the number of matches of the glob pattern
+// replaced in the string s by the replace function named op.
+func countMatches(op, s string, args ...string) int {
+	if len(args) == 0 {
+		return 0
+	}
+	pattern := args[0]
+	switch op {
+	case "/#":
+		if longestMatch(pattern, s, 0) >= 0 {
+			return 1
+		}
+	case "/%":
+		for _, i := range boundaries(s) {
+			if match(pattern, s[i:]) {
+				return 1
+			}
+		}
+	case "/", "//":
+		if pattern == "" {
+			return 0
+		}
+		n := 0
+		for i := 0; i < len(s); {
+			if end := longestMatch(pattern, s, i); end > i {
+				if n++; op == "/" {
+					break
+				}
+				i = end
+				continue
+			}
+			_, w := utf8.DecodeRuneInString(s[i:])
+			i += w
+		}
+		return n
+	}
+	return 0
+}
 
-func trimShortestPrefix(s string, args ...string) string {
-	if len(args) != 0 {
-		s = trimShortest(s, args[0])
+// replacement returns the replacement string of a replace
+// function, which is empty when omitted.
+func replacement(args []string) string {
+	if len(args) < 2 {
+		return ""
 	}
-	return s
+	return args[1]
 }
 
-func trimShortestSuffix(s string, args ...string) string {
-	if len(args) != 0 {
-		r := reverse(s)
-		rarg := reverse(args[0])
-		s = reverse(trimShortest(r, rarg))
+// longestMatch returns the end offset of the longest match of the
+// glob pattern in the string s beginning at offset start, or -1 if
+// there is no match.
+func longestMatch(pattern, s string, start int) int {
+	b := boundaries(s)
+	for j := len(b) - 1; j >= 0 && b[j] >= start; j-- {
+		if match(pattern, s[start:b[j]]) {
+			return b[j]
+		}
 	}
-	return s
+	return -1
 }
 
-func trimLongestPrefix(s string, args ...string) string {
+// isGlob returns true if the pattern contains glob metacharacters.
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// trimShortestPrefix returns a copy of the string s with the
+// shortest prefix matching the glob pattern removed.
+func trimShortestPrefix(s string, args ...string) string {
 	if len(args) != 0 {
-		s = trimLongest(s, args[0])
+		for _, i := range boundaries(s) {
+			if match(args[0], s[:i]) {
+				return s[i:]
+			}
+		}
 	}
 	return s
 }
 
-func trimLongestSuffix(s string, args ...string) string {
+// trimLongestPrefix returns a copy of the string s with the
+// longest prefix matching the glob pattern removed.
+func trimLongestPrefix(s string, args ...string) string {
 	if len(args) != 0 {
-		r := reverse(s)
-		rarg := reverse(args[0])
-		s = reverse(trimLongest(r, rarg))
+		b := boundaries(s)
+		for j := len(b) - 1; j >= 0; j-- {
+			if match(args[0], s[:b[j]]) {
+				return s[b[j]:]
+			}
+		}
 	}
 	return s
 }
 
-func trimShortest(s, arg string) string {
-	var shortestMatch string
-	for i := 0; i < len(s); i++ {
-		match, err := path.Match(arg, s[0:len(s)-i])
-
-		if err != nil {
-			return s
-		}
-
-		if match {
-			shortestMatch = s[0 : len(s)-i]
+// trimShortestSuffix returns a copy of the string s with the
+// shortest suffix matching the glob pattern removed.
+func trimShortestSuffix(s string, args ...string) string {
+	if len(args) != 0 {
+		b := boundaries(s)
+		for j := len(b) - 1; j >= 0; j-- {
+			if match(args[0], s[b[j]:]) {
+				return s[:b[j]]
+			}
 		}
 	}
-
-	if shortestMatch != "" {
-		return strings.TrimPrefix(s, shortestMatch)
-	}
-
 	return s
 }
 
-func trimLongest(s, arg string) string {
-	for i := 0; i < len(s); i++ {
-		match, err := path.Match(arg, s[0:len(s)-i])
-
-		if err != nil {
-			return s
-		}
-
-		if match {
-			return strings.TrimPrefix(s, s[0:len(s)-i])
+// trimLongestSuffix returns a copy of the string s with the
+// longest suffix matching the glob pattern removed.
+func trimLongestSuffix(s string, args ...string) string {
+	if len(args) != 0 {
+		for _, i := range boundaries(s) {
+			if match(args[0], s[i:]) {
+				return s[:i]
+			}
 		}
 	}
-
 	return s
 }
 
-func reverse(s string) string {
-	r := []rune(s)
-	for i, j := 0, len(r)-1; i < len(r)/2; i, j = i+1, j-1 {
-		r[i], r[j] = r[j], r[i]
+// match reports whether the string s matches the glob pattern.
+// A malformed pattern never matches.
+func match(pattern, s string) bool {
+	matched, err := path.Match(pattern, s)
+	return err == nil && matched
+}
+
+// boundaries returns the byte offsets in the string s at which a
+// match may begin or end, which are the start of every character
+// and the end of the string.
+func boundaries(s string) []int {
+	b := make([]int, 0, len(s)+1)
+	for i := range s {
+		b = append(b, i)
 	}
-	return string(r)
+	return append(b, len(s))
 }
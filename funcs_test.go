@@ -9,6 +9,13 @@ func Test_len(t *testing.T) {
 	}
 }
 
+func Test_byteLen(t *testing.T) {
+	got, want := toByteLen("Hello Wörld"), "12"
+	if got != want {
+		t.Errorf("Expect byteLen function to return %s, got %s", want, got)
+	}
+}
+
 func Test_lower(t *testing.T) {
 	got, want := toLower("Hello World"), "hello world"
 	if got != want {
@@ -49,6 +56,26 @@ func Test_upperFirst(t *testing.T) {
 	toUpperFirst("")
 }
 
+func Test_toggle(t *testing.T) {
+	got, want := toggle("Hello World 1"), "hELLO wORLD 1"
+	if got != want {
+		t.Errorf("Expect toggle function to return %s, got %s", want, got)
+	}
+}
+
+func Test_toggleFirst(t *testing.T) {
+	got, want := toggleFirst("Hello World"), "hello World"
+	if got != want {
+		t.Errorf("Expect toggleFirst function to return %s, got %s", want, got)
+	}
+	defer func() {
+		if recover() != nil {
+			t.Errorf("Expect empty string does not panic toggleFirst")
+		}
+	}()
+	toggleFirst("")
+}
+
 func Test_default(t *testing.T) {
 	got, want := toDefault("Hello World", "Hola Mundo"), "Hello World"
 	if got != want {
@@ -97,3 +124,324 @@ func Test_substr(t *testing.T) {
 		t.Errorf("Expect substr function to cut from the beginning to length for negative offsets exceeding string length")
 	}
 }
+
+func Test_quoted(t *testing.T) {
+	var tests = []struct {
+		in, out string
+	}{
+		{"", "''"},
+		{"hello world", "'hello world'"},
+		{"$HOME", "'$HOME'"},
+		{"it's", `'it'\''s'`},
+	}
+	for _, test := range tests {
+		if got := toQuoted(test.in); got != test.out {
+			t.Errorf("Expect quoted function to return %s, got %s", test.out, got)
+		}
+	}
+}
+
+func Test_jsonEscaped(t *testing.T) {
+	var tests = []struct {
+		in, out string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{`say "hi"`, `say \"hi\"`},
+		{`C:\dir`, `C:\\dir`},
+		{"a\nb\tc\x01", `a\nb\tc\u0001`},
+		{"<b>&</b>", "<b>&</b>"},
+	}
+	for _, test := range tests {
+		if got := toJSONEscaped(test.in); got != test.out {
+			t.Errorf("Expect json escaped function to return %s, got %s", test.out, got)
+		}
+	}
+}
+
+func Test_unescaped(t *testing.T) {
+	var tests = []struct {
+		in, out string
+	}{
+		{`plain`, "plain"},
+		{`a\tb\nc`, "a\tb\nc"},
+		{`back\\slash`, `back\slash`},
+		{`\x41\x4a`, "AJ"},
+		{`\101\0`, "A\x00"},
+		{`\0101\012`, "A\n"},
+		{`é\U0001F600`, "é😀"},
+		{`\q\x`, `\q\x`},
+		{`trailing\`, `trailing\`},
+	}
+	for _, test := range tests {
+		if got := toUnescaped(test.in); got != test.out {
+			t.Errorf("Expect unescaped function to return %q, got %q", test.out, got)
+		}
+	}
+}
+
+func Test_trim(t *testing.T) {
+	var tests = []struct {
+		fn      substituteFunc
+		s       string
+		pattern string
+		want    string
+	}{
+		{trimShortestPrefix, "archive.tar.gz", "*.", "tar.gz"},
+		{trimLongestPrefix, "archive.tar.gz", "*.", "gz"},
+		{trimShortestSuffix, "archive.tar.gz", ".*", "archive.tar"},
+		{trimLongestSuffix, "archive.tar.gz", ".*", "archive"},
+		{trimShortestPrefix, "abcabc", "*", "abcabc"},
+		{trimLongestPrefix, "abcabc", "*", ""},
+		{trimShortestPrefix, "abcabc", "?b", "cabc"},
+		{trimLongestSuffix, "v1.2.3-rc1", "-rc[0-9]", "v1.2.3"},
+		{trimShortestSuffix, "file123", "[0-9]", "file12"},
+		{trimLongestPrefix, "/path/to/file", "*/", "file"},
+		{trimShortestSuffix, "/path/to/file", "/*", "/path/to"},
+		{trimShortestPrefix, "héllo wörld", "*ö", "rld"},
+		{trimShortestSuffix, "no-match", "*.txt", "no-match"},
+	}
+	for _, test := range tests {
+		if got := test.fn(test.s, test.pattern); got != test.want {
+			t.Errorf("Expect trim of %q with pattern %q to return %q, got %q", test.s, test.pattern, test.want, got)
+		}
+	}
+}
+
+func Test_bracketExpression(t *testing.T) {
+	var tests = []struct {
+		fn      substituteFunc
+		s       string
+		pattern string
+		want    string
+	}{
+		{trimLongestPrefix, "release-v1.2.3", "*[!0-9.]", "1.2.3"},
+		{trimLongestSuffix, "1.2.3-beta+build", "[!0-9.]*", "1.2.3"},
+		{trimLongestPrefix, "abc123", "*[[:alpha:]]", "123"},
+		{trimShortestSuffix, "file123", "[[:digit:]]", "file12"},
+		{trimLongestSuffix, "file123", "[[:digit:]]*", "file"},
+		{trimShortestPrefix, "  indented", "[[:space:]]", " indented"},
+		{trimShortestPrefix, "Hello", "[[:upper:][:digit:]]", "ello"},
+		{trimShortestPrefix, "hello", "[^h]", "hello"},
+		{trimShortestPrefix, "hello", "[!a-g]", "ello"},
+		{trimShortestPrefix, "]x", "[]]", "x"},
+		{trimShortestPrefix, "-x", "[a-]", "x"},
+		{trimShortestPrefix, "[x", "[", "x"},
+		{trimShortestPrefix, "a[b*c", "*[", "b*c"},
+		{trimShortestSuffix, "ab", "[[:nope:]]", "ab"},
+	}
+	for _, test := range tests {
+		if got := test.fn(test.s, test.pattern); got != test.want {
+			t.Errorf("Expect trim of %q with pattern %q to return %q, got %q", test.s, test.pattern, test.want, got)
+		}
+	}
+
+	if got := replaceAll("a1b22c333", "[[:digit:]]", "#"); got != "a#b##c###" {
+		t.Errorf("Expect replace with a character class to return %q, got %q", "a#b##c###", got)
+	}
+}
+
+func Test_replace(t *testing.T) {
+	var tests = []struct {
+		fn   substituteFunc
+		s    string
+		args []string
+		want string
+	}{
+		{replaceFirst, "abcABC123ABCabc", []string{"abc", "xyz"}, "xyzABC123ABCabc"},
+		{replaceAll, "abcABC123ABCabc", []string{"abc", "xyz"}, "xyzABC123ABCxyz"},
+		{replaceFirst, "abcABC123ABCabc", []string{"[0-9]*", "#"}, "abcABC#"},
+		{replaceFirst, "abcABC123ABCabc", []string{"[0-9]", "#"}, "abcABC#23ABCabc"},
+		{replaceAll, "abcABC123ABCabc", []string{"[0-9]", "#"}, "abcABC###ABCabc"},
+		{replaceAll, "abcABC123ABCabc", []string{"b?"}, "aABC123ABCa"},
+		{replaceAll, "foo/bar/baz", []string{"/", "-"}, "foo-bar-baz"},
+		{replaceAll, "a*b*c", []string{`\*`, "+"}, "a+b+c"},
+		{replacePrefix, "abcABC123ABCabc", []string{"a*C", "X"}, "Xabc"},
+		{replacePrefix, "abcABC123ABCabc", []string{"ABC", "X"}, "abcABC123ABCabc"},
+		{replaceSuffix, "abcABC123ABCabc", []string{"[0-9]*", "X"}, "abcABCX"},
+		{replaceSuffix, "abcABC123ABCabc", []string{"abc", "X"}, "abcABC123ABCX"},
+		{replaceSuffix, "abcABC123ABCabc", []string{"ABC", "X"}, "abcABC123ABCabc"},
+	}
+	for _, test := range tests {
+		if got := test.fn(test.s, test.args...); got != test.want {
+			t.Errorf("Expect replace of %q with %q to return %q, got %q", test.s, test.args, test.want, got)
+		}
+	}
+}
+
+func Test_countMatches(t *testing.T) {
+	var tests = []struct {
+		op   string
+		s    string
+		args []string
+		want int
+	}{
+		{"//", "abcABC123ABCabc", []string{"abc", "xyz"}, 2},
+		{"//", "abcABC123ABCabc", []string{"[0-9]", "#"}, 3},
+		{"//", "abcABC123ABCabc", []string{"[0-9]*", "#"}, 1},
+		{"//", "/usr/local/bin", []string{"/", "-"}, 3},
+		{"//", "/usr/local/bin", []string{"x", "-"}, 0},
+		{"//", "/usr/local/bin", []string{""}, 0},
+		{"/", "abcABC123ABCabc", []string{"abc", "xyz"}, 1},
+		{"/", "abcABC123ABCabc", []string{"x", "xyz"}, 0},
+		{"/#", "abcABC123ABCabc", []string{"a*C", "X"}, 1},
+		{"/#", "abcABC123ABCabc", []string{"ABC", "X"}, 0},
+		{"/%", "abcABC123ABCabc", []string{"abc", "X"}, 1},
+		{"/%", "abcABC123ABCabc", []string{"ABC", "X"}, 0},
+	}
+	for _, test := range tests {
+		if got := countMatches(test.op, test.s, test.args...); got != test.want {
+			t.Errorf("Expect %s of %q in %q to count %d matches, got %d", test.op, test.args, test.s, test.want, got)
+		}
+	}
+}
+
+func Test_substrNegative(t *testing.T) {
+	var tests = []struct {
+		args []string
+		want string
+	}{
+		{[]string{" -5"}, "56789"},
+		{[]string{"(-5)"}, "56789"},
+		{[]string{" -5", "2"}, "56"},
+		{[]string{"1", "-2"}, "234567"},
+		{[]string{"1", " -2"}, "234567"},
+		{[]string{" -3", "-1"}, "78"},
+		{[]string{"5", "-7"}, ""},
+		{[]string{"1", "-20"}, ""},
+	}
+	for _, test := range tests {
+		if got := toSubstr("123456789", test.args...); got != test.want {
+			t.Errorf("Expect substr of %q to return %q, got %q", test.args, test.want, got)
+		}
+	}
+}
+
+func Test_substrBounds(t *testing.T) {
+	var tests = []struct {
+		args []string
+		want string
+	}{
+		{[]string{"9"}, ""},               // offset == len
+		{[]string{"100"}, ""},             // offset > len
+		{[]string{"9", "2"}, ""},          // offset == len with length
+		{[]string{"100", "2"}, ""},        // offset > len with length
+		{[]string{"2", "100"}, "3456789"}, // length > remaining
+		{[]string{"8", "2"}, "9"},         // length > remaining at the end
+		{[]string{"2", "0"}, ""},          // length == 0
+		{[]string{"0", "0"}, ""},          // length == 0 at the start
+		{[]string{"0", "9"}, "123456789"}, // length == len
+		{[]string{" -100"}, "123456789"},  // negative offset before the start
+		{[]string{" -9", "1"}, "1"},       // negative offset == -len
+		{[]string{"2", "-100"}, ""},       // negative length before offset
+		{[]string{"2", "9223372036854775807"}, "3456789"},
+	}
+	for _, test := range tests {
+		if got := toSubstr("123456789", test.args...); got != test.want {
+			t.Errorf("Expect substr of %q to return %q, got %q", test.args, test.want, got)
+		}
+	}
+	if got := toSubstr("", "0", "5"); got != "" {
+		t.Errorf("Expect substr of the empty string to return the empty string, got %q", got)
+	}
+}
+
+func Test_unicode(t *testing.T) {
+	got, want := toLen("héllo 😀"), "7"
+	if got != want {
+		t.Errorf("Expect len function to count characters, got %s", got)
+	}
+
+	var tests = []struct {
+		s    string
+		args []string
+		want string
+	}{
+		{"héllo wörld", []string{"0", "3"}, "hél"},
+		{"héllo wörld", []string{"6"}, "wörld"},
+		{"😀😁😂🤣", []string{"1", "2"}, "😁😂"},
+		{"😀😁😂🤣", []string{" -1"}, "🤣"},
+		{"crème brûlée", []string{"6", "-3"}, "brû"},
+	}
+	for _, test := range tests {
+		if got := toSubstr(test.s, test.args...); got != test.want {
+			t.Errorf("Expect substr of %q with %q to return %q, got %q", test.s, test.args, test.want, got)
+		}
+	}
+}
+
+func Test_casePattern(t *testing.T) {
+	got, want := toUpper("hello world", "[lo]"), "heLLO wOrLd"
+	if got != want {
+		t.Errorf("Expect upper function with pattern to return %s, got %s", want, got)
+	}
+	got, want = toUpperFirst("hello world", "[a-g]"), "hello world"
+	if got != want {
+		t.Errorf("Expect upperFirst function with pattern to return %s, got %s", want, got)
+	}
+	got, want = toLowerFirst("ÉCOLE", "[ÀÉ]"), "éCOLE"
+	if got != want {
+		t.Errorf("Expect lowerFirst function with pattern to return %s, got %s", want, got)
+	}
+	got, want = toLower("", "*"), ""
+	if got != want {
+		t.Errorf("Expect lower function with pattern to handle an empty string")
+	}
+}
+
+func Test_base64(t *testing.T) {
+	var tests = []struct {
+		s, want string
+	}{
+		{"", ""},
+		{"a", "YQ=="},
+		{"ab", "YWI="},
+		{"abc", "YWJj"},
+		{"é", "w6k="},
+		{"日本語", "5pel5pys6Kqe"},
+		{"😀!", "8J+YgCE="},
+	}
+	for _, test := range tests {
+		got := toBase64(test.s)
+		if got != test.want {
+			t.Errorf("Expect base64 of %q to return %q, got %q", test.s, test.want, got)
+		}
+		if got, err := fromBase64(got); err != nil || got != test.s {
+			t.Errorf("Expect %q to round trip, got %q, %v", test.s, got, err)
+		}
+	}
+
+	for _, s := range []string{"YQ", "YQ=", "Y===", "Y*=="} {
+		if _, err := fromBase64(s); err == nil {
+			t.Errorf("Expect invalid base64 %q to return an error", s)
+		}
+	}
+}
+
+func Test_urlEncoded(t *testing.T) {
+	var tests = []struct {
+		s, want string
+	}{
+		{"", ""},
+		{"AZaz09-._~", "AZaz09-._~"},
+		{"a b", "a%20b"},
+		{"k=v&x=y", "k%3Dv%26x%3Dy"},
+		{"/?#[]@!$'()*+,;%", "%2F%3F%23%5B%5D%40%21%24%27%28%29%2A%2B%2C%3B%25"},
+		{"crème 日本", "cr%C3%A8me%20%E6%97%A5%E6%9C%AC"},
+	}
+	for _, test := range tests {
+		got := toURLEncoded(test.s)
+		if got != test.want {
+			t.Errorf("Expect urlEncoded of %q to return %q, got %q", test.s, test.want, got)
+		}
+		if got, err := fromURLEncoded(got); err != nil || got != test.s {
+			t.Errorf("Expect %q to round trip, got %q, %v", test.s, got, err)
+		}
+	}
+
+	for _, s := range []string{"%", "%2", "%zz", "a%G0"} {
+		if _, err := fromURLEncoded(s); err == nil {
+			t.Errorf("Expect malformed %q to return an error", s)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build go1.18
+// +build go1.18
+
+package envsubst
+
+import "testing"
+
+func FuzzEval(f *testing.F) {
+	f.Add("${a:-${b:1:2}}$((1+$c))${#a} ${!a} ${a[@]} ${a//x/y}", "value")
+	f.Add("${a:${b}:-1} $((a/b)) ${a@Q} ${a^^[a-z]}", "2")
+	f.Add("${a:0:9223372036854775807} $((9223372036854775807+1))", "-9223372036854775808")
+	f.Add(`${a/\//\\} \${a} $$ ~/x`, "[[:alpha:]]*")
+	f.Fuzz(func(t *testing.T, text, value string) {
+		mapping := func(string) string { return value }
+		Eval(text, mapping)
+		Eval(text, mapping, WithRecursiveExpansion(), WithStrictOffsets(), WithTildeExpansion())
+		Eval(text, mapping, WithDelims("{{", "}}"), WithUnescape())
+	})
+}
@@ -0,0 +1,140 @@
+package envsubst
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Enumerator is implemented by variable sources that can list the
+// names of the variables they define.
+type Enumerator interface {
+	Names() []string
+}
+
+// Lister is implemented by variable sources that can hold lists of
+// values, which are expanded by ${var[@]}, ${var[*]}, ${var[index]}
+// and ${#var[@]}. List reports whether the named variable is a list.
+type Lister interface {
+	List(name string) ([]string, bool)
+}
+
+// Keyer is implemented by a Lister whose variables can be maps, such
+// as associative arrays, to list the keys expanded by ${!var[@]} and
+// ${!var[*]}. Keys reports whether the named variable is a map. The
+// keys of any other list are its indices.
+type Keyer interface {
+	Keys(name string) ([]string, bool)
+}
+
+// environ enumerates the current environment variables.
+type environ struct{}
+
+// Names returns the names of the current environment variables.
+func (environ) Names() []string {
+	var names []string
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			names = append(names, kv[:i])
+		}
+	}
+	return names
+}
+
+// LayeredMapping returns a mapping function that looks up the named
+// variable in the overlay map first, falling back to the base map.
+// The boolean result reports whether either map contains the name.
+func LayeredMapping(base, overlay map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		if v, ok := overlay[name]; ok {
+			return v, true
+		}
+		v, ok := base[name]
+		return v, ok
+	}
+}
+
+// MappingChain returns a mapping function that returns the value
+// from the first source that maps the name to a non-empty string.
+// Sources are consulted in the order given, so earlier sources take
+// precedence. Because a mapping function cannot report whether a
+// variable is set, an empty value falls through to the next source;
+// use LookupChain to stop at variables that are set but empty.
+func MappingChain(sources ...func(string) string) func(string) string {
+	return func(name string) string {
+		for _, source := range sources {
+			if v := source(name); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+}
+
+// LookupChain returns a lookup function that returns the value from
+// the first source reporting the name as set, in the style of
+// os.LookupEnv. Sources are consulted in the order given, so earlier
+// sources take precedence.
+func LookupChain(sources ...func(string) (string, bool)) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		for _, source := range sources {
+			if v, ok := source(name); ok {
+				return v, true
+			}
+		}
+		return "", false
+	}
+}
+
+// ArgsLookup returns a lookup function that resolves the positional
+// parameters ${0} to ${n} to the elements of args, so that ${0} is
+// args[0], and the special parameter # to the number of parameters
+// after ${0}, which ${@}, ${*}, ${#@} and ${#*} rely on. Names that are
+// not a number, or that are beyond the end of args, are reported as not
+// set.
+func ArgsLookup(args []string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		if name == "#" {
+			if len(args) == 0 {
+				return "0", true
+			}
+			return strconv.Itoa(len(args) - 1), true
+		}
+		if name == "" || strings.TrimLeft(name, "0123456789") != "" {
+			return "", false
+		}
+		i, err := strconv.Atoi(name)
+		if err != nil || i >= len(args) {
+			return "", false
+		}
+		return args[i], true
+	}
+}
+
+// foldCase returns a lookup function that resolves names without
+// regard to case, as configured by WithCaseInsensitiveNames. The
+// enumerator, if not nil, supplies the names to match against when
+// neither the name nor its upper case form is set.
+func foldCase(lookup func(string) (string, bool, error), e Enumerator) func(string) (string, bool, error) {
+	return func(name string) (string, bool, error) {
+		v, ok, err := lookup(name)
+		if err != nil || ok {
+			return v, ok, err
+		}
+		if upper := strings.ToUpper(name); upper != name {
+			if v, ok, err := lookup(upper); err != nil || ok {
+				return v, ok, err
+			}
+		}
+		if e != nil {
+			for _, other := range e.Names() {
+				if other != name && strings.EqualFold(other, name) {
+					if v, ok, err := lookup(other); err != nil || ok {
+						return v, ok, err
+					}
+				}
+			}
+		}
+		return v, ok, nil
+	}
+}
@@ -0,0 +1,110 @@
+package envsubst
+
+import "testing"
+
+func TestLayeredMapping(t *testing.T) {
+	base := map[string]string{"HOST": "localhost", "PORT": "8080"}
+	overlay := map[string]string{"HOST": "prod.example.com", "DEBUG": ""}
+	mapping := LayeredMapping(base, overlay)
+
+	var tests = []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"HOST", "prod.example.com", true}, // overlay wins
+		{"PORT", "8080", true},             // falls back to base
+		{"DEBUG", "", true},                // set in overlay, but empty
+		{"USER", "", false},                // set in neither
+	}
+
+	for _, test := range tests {
+		value, ok := mapping(test.name)
+		if value != test.value || ok != test.ok {
+			t.Errorf("Want %s to resolve to %q, %v, got %q, %v",
+				test.name, test.value, test.ok, value, ok)
+		}
+	}
+}
+
+func TestMappingChain(t *testing.T) {
+	overrides := map[string]string{"HOST": "override.example.com", "EMPTY": ""}
+	dotenv := map[string]string{"HOST": "dotenv.example.com", "PORT": "8080", "EMPTY": "dotenv"}
+	mapping := MappingChain(
+		func(s string) string { return overrides[s] },
+		func(s string) string { return dotenv[s] },
+	)
+
+	var tests = []struct {
+		name  string
+		value string
+	}{
+		{"HOST", "override.example.com"}, // first source wins
+		{"PORT", "8080"},                 // falls through to dotenv
+		{"EMPTY", "dotenv"},              // empty values fall through
+		{"USER", ""},                     // set in neither
+	}
+	for _, test := range tests {
+		if value := mapping(test.name); value != test.value {
+			t.Errorf("Want %s to resolve to %q, got %q", test.name, test.value, value)
+		}
+	}
+}
+
+func TestLookupChain(t *testing.T) {
+	overrides := map[string]string{"HOST": "override.example.com", "EMPTY": ""}
+	dotenv := map[string]string{"HOST": "dotenv.example.com", "PORT": "8080", "EMPTY": "dotenv"}
+	lookup := func(m map[string]string) func(string) (string, bool) {
+		return func(s string) (string, bool) {
+			v, ok := m[s]
+			return v, ok
+		}
+	}
+	mapping := LookupChain(lookup(overrides), lookup(dotenv))
+
+	var tests = []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"HOST", "override.example.com", true}, // first source wins
+		{"PORT", "8080", true},                 // falls through to dotenv
+		{"EMPTY", "", true},                    // set but empty stops the chain
+		{"USER", "", false},                    // set in neither
+	}
+	for _, test := range tests {
+		value, ok := mapping(test.name)
+		if value != test.value || ok != test.ok {
+			t.Errorf("Want %s to resolve to %q, %v, got %q, %v",
+				test.name, test.value, test.ok, value, ok)
+		}
+	}
+}
+
+func TestArgsLookup(t *testing.T) {
+	lookup := ArgsLookup([]string{"prog", "one", ""})
+
+	var tests = []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"0", "prog", true},
+		{"1", "one", true},
+		{"2", "", true},  // set, but empty
+		{"3", "", false}, // beyond the arguments
+		{"01", "one", true},
+		{"1a", "", false},
+		{"#", "2", true},
+		{"HOME", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		value, ok := lookup(test.name)
+		if value != test.value || ok != test.ok {
+			t.Errorf("Want %s to resolve to %q, %v, got %q, %v",
+				test.name, test.value, test.ok, value, ok)
+		}
+	}
+}
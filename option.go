@@ -0,0 +1,433 @@
+package envsubst
+
+// Option configures template execution. The options that configure
+// parsing, such as WithDelims, apply only to the Eval functions, which
+// parse the string; the Execute methods of a Template, which is
+// already parsed, fail with ErrParseOption if given one.
+type Option func(*options)
+
+// options holds the configuration applied by a set of Options.
+type options struct {
+	strict       bool
+	allUndefined bool
+	forbidEmpty  map[string]bool
+	enumerator   Enumerator
+	lister       Lister
+	maxDepth     int
+	maxOutput    int
+	foldCase     bool
+	recursive    bool
+	transform    func(name, value string) string
+	keepUnset    bool
+	defaults     map[string]string
+	tilde        bool
+	byteLength   bool
+
+	// if true, a substring offset that is written literally
+	// and is not an integer returns an OffsetError.
+	strictOffsets bool
+
+	// if not zero, the line terminators of the output are
+	// normalized, including those of the values if lineValues.
+	lineEnding LineEnding
+	lineValues bool
+
+	// if not nil, collects statistics about the execution.
+	stats *Stats
+
+	// if true, removes the white space left around a standalone
+	// substitution that expands to the empty string.
+	trimEmpty bool
+
+	// if not nil, only these variables are expanded.
+	allowed map[string]bool
+
+	// if true, expands the backslash escapes in the value of each
+	// substitution before any escape is applied.
+	unescape bool
+
+	// if not nil, escapes the value of each substitution.
+	escape substituteFunc
+
+	// substitution delimiters and syntax checks, used when
+	// parsing. parseOnly names the last such option given.
+	parseOnly       string
+	leftDelim       string
+	rightDelim      string
+	strictSyntax    bool
+	directives      bool
+	stripDirectives bool
+	balancedBraces  bool
+	literalDollar   bool
+	firstLine       int
+}
+
+// DefaultMaxDepth is the default maximum expansion depth.
+const DefaultMaxDepth = 50
+
+// newOptions returns the configuration resulting from applying
+// the Options in order.
+func newOptions(opts ...Option) *options {
+	o := new(options)
+	o.maxDepth = DefaultMaxDepth
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithStrict returns an Option that causes execution to fail when
+// the template references a variable that is not set, rather than
+// substituting the empty string. Substitutions that supply their own
+// default, such as ${var:-word}, are exempt. Only a lookup function
+// can report a variable as not set; see Template.ExecuteLookup.
+func WithStrict() Option {
+	return func(o *options) {
+		o.strict = true
+	}
+}
+
+// WithAllUndefined returns an Option that causes strict execution to
+// continue past variables that are not set, substituting the empty
+// string, and then fail with UndefinedErrors listing each of them once
+// at its first reference. It implies WithStrict.
+func WithAllUndefined() Option {
+	return func(o *options) {
+		o.strict = true
+		o.allUndefined = true
+	}
+}
+
+// WithKeepUnset returns an Option that writes a substitution of a
+// variable that is not set exactly as it appears in the template, such
+// as ${var} or ${var^^}, so that a later pass can expand it. A
+// variable set to the empty string still expands to the empty string,
+// and substitutions that supply their own default, such as
+// ${var:-word}, use the default. Only a lookup function can report a
+// variable as not set; see Template.ExecuteLookup.
+func WithKeepUnset() Option {
+	return func(o *options) {
+		o.keepUnset = true
+	}
+}
+
+// WithDefaults returns an Option that supplies the value of each
+// variable in defaults when the lookup reports the variable not set,
+// as if ${var} were written ${var-default}, so that templates sharing
+// many fallbacks need not repeat them. A variable set to the empty
+// string keeps its value. A mapping function reports every variable
+// as set, so the defaults apply only where variables are looked up in
+// the style of os.LookupEnv, as by EvalLookup and EvalEnv. A
+// substitution that supplies its own word, such as ${var:-word} or
+// ${var+word}, takes precedence and does not consult defaults. The
+// defaults also apply to the variables of an arithmetic expansion.
+func WithDefaults(defaults map[string]string) Option {
+	return func(o *options) {
+		o.defaults = defaults
+	}
+}
+
+// WithForbidEmpty returns an Option that causes execution to fail
+// with an *EmptyError when any of the named variables resolves to the
+// empty string, even if the variable is technically set. A
+// substitution that replaces an empty value, such as ${var:-word},
+// ${var:=word} or ${var:?message}, is exempt, while one that keeps
+// it, such as ${var-word}, still fails.
+func WithForbidEmpty(names ...string) Option {
+	return func(o *options) {
+		if o.forbidEmpty == nil {
+			o.forbidEmpty = map[string]bool{}
+		}
+		for _, name := range names {
+			o.forbidEmpty[name] = true
+		}
+	}
+}
+
+// WithEnumerator returns an Option that supplies the variable names
+// matched by the ${!prefix*} and ${!prefix@} expansions. Without an
+// Enumerator these expansions produce the empty string.
+func WithEnumerator(e Enumerator) Option {
+	return func(o *options) {
+		o.enumerator = e
+	}
+}
+
+// WithLister returns an Option that supplies the lists expanded by
+// the ${var[@]}, ${var[*]}, ${var[index]}, ${#var[@]} and ${!var[@]}
+// expansions. A variable that is not a list is treated as a list of
+// one element, as in bash, so ${var[0]} expands to its value.
+func WithLister(l Lister) Option {
+	return func(o *options) {
+		o.lister = l
+	}
+}
+
+// WithMaxDepth returns an Option that limits how deeply expansions
+// may nest, counting both substitutions nested in the arguments of
+// another substitution and indirect references. Execution fails with
+// ErrMaxDepth once the limit is exceeded.
+func WithMaxDepth(n int) Option {
+	return func(o *options) {
+		o.maxDepth = n
+	}
+}
+
+// WithMaxOutputSize returns an Option that limits the output to n
+// bytes, so that a template expanding untrusted values, such as a
+// global replacement of a large value, cannot exhaust memory.
+// Execution fails with ErrMaxOutputSize once the output, or the value
+// of any substitution as it is computed, exceeds the limit. A limit of
+// zero, the default, means no limit.
+func WithMaxOutputSize(n int) Option {
+	return func(o *options) {
+		o.maxOutput = n
+	}
+}
+
+// WithCaseInsensitiveNames returns an Option that resolves variable
+// names without regard to case, so ${Path} and ${PATH} expand to the
+// same value. A name is first looked up as written; if it is not set,
+// it is looked up in upper case and then, given an Enumerator, as any
+// name that differs only in case. A name set to the empty string is
+// used as is. Since a plain mapping reports every name as set, names
+// are only folded with a lookup function, as given to EvalLookup.
+// Errors report the name as written in the template.
+func WithCaseInsensitiveNames() Option {
+	return func(o *options) {
+		o.foldCase = true
+	}
+}
+
+// WithRecursiveExpansion returns an Option that expands the value of
+// each variable again, so that given URL=${SCHEME}://${HOST} the
+// template ${URL} expands to the scheme and host. Each level counts
+// towards the maximum depth, so variables that refer to each other
+// fail with ErrMaxDepth.
+func WithRecursiveExpansion() Option {
+	return func(o *options) {
+		o.recursive = true
+	}
+}
+
+// WithValueTransform returns an Option that passes the value of each
+// variable that is set through fn, which receives the variable name
+// so that it can, for example, redact only the variables ending in
+// _SECRET. The transform applies to the value as resolved, before any
+// function such as ${var:0:4} or default; the template text and the
+// words of defaults are not transformed.
+func WithValueTransform(fn func(name, value string) string) Option {
+	return func(o *options) {
+		o.transform = fn
+	}
+}
+
+// WithStrictOffsets returns an Option that fails with an *OffsetError
+// when a substring offset or length written literally is not an
+// integer, as in ${var:x}, rather than expanding to the value
+// unchanged. One given by an expansion always fails.
+func WithStrictOffsets() Option {
+	return func(o *options) {
+		o.strictOffsets = true
+	}
+}
+
+// WithByteLength returns an Option that measures the length given by
+// ${#var}, ${#var[index]} and ${#${...}} in bytes rather than in
+// characters, such as for tools that care about storage size. The
+// value naïve is 5 characters long but 6 bytes.
+func WithByteLength() Option {
+	return func(o *options) {
+		o.byteLength = true
+	}
+}
+
+// WithTildeExpansion returns an Option that expands a ~ at the start
+// of a word in the template text, or at the start of the word of a
+// default such as ${BIN:-~/bin}, to the value of HOME. As in the shell
+// the ~ must be followed by a slash, white space or the end of the
+// word, so ~user and a ~ in the middle of a word, as in a~b or
+// ${A}~, are left unchanged. The ~ is also left unchanged if HOME is
+// not set.
+func WithTildeExpansion() Option {
+	return func(o *options) {
+		o.tilde = true
+	}
+}
+
+// LineEnding is a line terminator to which WithLineEnding normalizes
+// the output.
+type LineEnding int
+
+// The line endings.
+const (
+	LF   LineEnding = iota + 1 // \n
+	CRLF                       // \r\n
+)
+
+// WithLineEnding returns an Option that normalizes the \n and \r\n
+// line terminators of the template text to the line ending. The
+// values of substitutions are written unchanged unless
+// WithValueLineEndings is also given.
+func WithLineEnding(e LineEnding) Option {
+	return func(o *options) {
+		o.lineEnding = e
+	}
+}
+
+// WithValueLineEndings returns an Option that extends WithLineEnding
+// to the line terminators in the value of each substitution.
+func WithValueLineEndings() Option {
+	return func(o *options) {
+		o.lineValues = true
+	}
+}
+
+// WithStats returns an Option that records statistics about the
+// execution in stats, such as the number of matches replaced by each
+// ${var/pattern/replacement} substitution, so that a test can verify
+// the behavior of a template. The statistics are appended to stats,
+// which must not be shared by concurrent executions.
+func WithStats(stats *Stats) Option {
+	return func(o *options) {
+		o.stats = stats
+	}
+}
+
+// WithTrimEmptyExpansionWhitespace returns an Option that removes the
+// white space left behind by a substitution that expands to the empty
+// string when it stands alone, preceded by white space or the start of
+// a line and followed by white space or the end of a line. The white
+// space before it is removed, so key: ${VALUE} expands to key: without
+// a trailing space, unless it indents the line, in which case the white
+// space after it is removed instead. A line holding only the
+// substitution is left empty. A substitution within a word, as in
+// prefix-${VALUE}, is left alone.
+func WithTrimEmptyExpansionWhitespace() Option {
+	return func(o *options) {
+		o.trimEmpty = true
+	}
+}
+
+// WithDelims returns an Option that parses substitutions between the
+// left and right delimiters instead of ${ and }. See
+// parse.ParseWithDelims for the syntax.
+func WithDelims(left, right string) Option {
+	return func(o *options) {
+		o.parseOnly = "WithDelims"
+		o.leftDelim = left
+		o.rightDelim = right
+	}
+}
+
+// WithStrictSyntax returns an Option that rejects a closing brace that
+// does not close an opening brace, such as the last brace of ${a}},
+// with a parse error rather than writing it as is.
+func WithStrictSyntax() Option {
+	return func(o *options) {
+		o.parseOnly = "WithStrictSyntax"
+		o.strictSyntax = true
+	}
+}
+
+// WithBalancedBraces returns an Option that allows the word of a
+// default substitution to contain balanced braces, such as the JSON
+// object in ${JSON:-{"k":"v"}}. Without it, as in bash, the first
+// closing brace ends the substitution.
+func WithBalancedBraces() Option {
+	return func(o *options) {
+		o.parseOnly = "WithBalancedBraces"
+		o.balancedBraces = true
+	}
+}
+
+// WithLiteralDoubleDollar returns an Option that writes $$ unchanged
+// rather than as a single $, such as for a $$ process ID placeholder
+// meant for another tool. The trade-off is that $$ no longer escapes
+// a substitution: $${HOST} is a $ followed by the value of HOST, and
+// \${HOST} must be used for the literal text ${HOST}.
+func WithLiteralDoubleDollar() Option {
+	return func(o *options) {
+		o.parseOnly = "WithLiteralDoubleDollar"
+		o.literalDollar = true
+	}
+}
+
+// WithFirstLine returns an Option that numbers the lines of the string
+// from n rather than 1, so that the positions in errors are those of
+// a larger input the string was taken from, such as a file expanded
+// one line at a time.
+func WithFirstLine(n int) Option {
+	return func(o *options) {
+		o.parseOnly = "WithFirstLine"
+		o.firstLine = n
+	}
+}
+
+// WithDirectives returns an Option that takes literally the lines from
+// a line containing envsubst:off to the next line containing
+// envsubst:on, such as examples of shell syntax embedded in the
+// template. The marker lines are kept in the output.
+func WithDirectives() Option {
+	return func(o *options) {
+		o.parseOnly = "WithDirectives"
+		o.directives = true
+	}
+}
+
+// WithStripDirectives returns an Option that removes the envsubst:off
+// and envsubst:on marker lines from the output. It implies
+// WithDirectives.
+func WithStripDirectives() Option {
+	return func(o *options) {
+		o.parseOnly = "WithStripDirectives"
+		o.directives = true
+		o.stripDirectives = true
+	}
+}
+
+// WithAllowed returns an Option that expands only the named
+// variables. Every other substitution, and any escape such as $$, is
+// written exactly as it appears in the template, so the output can be
+// expanded again by a later pass.
+func WithAllowed(names ...string) Option {
+	return func(o *options) {
+		if o.allowed == nil {
+			o.allowed = map[string]bool{}
+		}
+		for _, name := range names {
+			o.allowed[name] = true
+		}
+	}
+}
+
+// WithUnescape returns an Option that expands backslash escapes such
+// as \n, \t, \\, \xHH and \0NNN in the value of each substitution, in
+// the same manner as ${var@E}. It applies to the resolved value,
+// including a default such as the word in ${var:-a\tb}, and precedes
+// any escaping such as WithJSONEscape.
+func WithUnescape() Option {
+	return func(o *options) {
+		o.unescape = true
+	}
+}
+
+// WithJSONEscape returns an Option that escapes the value of each
+// substitution for use inside a JSON string, so that a template such
+// as {"name": "${NAME}"} remains valid JSON whatever the value. The
+// template text itself is written unchanged.
+func WithJSONEscape() Option {
+	return func(o *options) {
+		o.escape = toJSONEscaped
+	}
+}
+
+// WithShellQuote returns an Option that quotes the value of each
+// substitution as a single shell word, in the same manner as ${var@Q},
+// so that generated scripts are safe whatever the value. The template
+// text itself is written unchanged.
+func WithShellQuote() Option {
+	return func(o *options) {
+		o.escape = toQuoted
+	}
+}
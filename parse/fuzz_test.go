@@ -0,0 +1,39 @@
+//go:build go1.18
+// +build go1.18
+
+package parse
+
+import "testing"
+
+func FuzzParse(f *testing.F) {
+	for _, test := range tests {
+		f.Add(test.Text)
+	}
+	f.Add("${a:-${b:1:2}}$((1+$c))\n# envsubst:off\n${d}")
+	f.Add("${")
+	f.Add("$((")
+	f.Add("${a/#/}")
+	f.Fuzz(func(t *testing.T, text string) {
+		tree, err := Parse(text)
+		if err != nil {
+			_ = err.Error()
+			return
+		}
+		// the text of a parsed tree parses to an equivalent tree.
+		if _, err := Parse(tree.Root.String()); err != nil {
+			t.Errorf("Want %q written as %q to parse, got %v", text, tree.Root.String(), err)
+		}
+
+		for _, tree := range []*Tree{
+			{Strict: true},
+			{Directives: true, StripDirectives: true},
+			{BalancedBraces: true},
+			new(Tree).Delims("{{", "}}"),
+			new(Tree).Delims("%", "%"),
+		} {
+			if _, err := tree.Parse(text); err != nil {
+				_ = err.Error()
+			}
+		}
+	})
+}
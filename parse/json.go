@@ -0,0 +1,192 @@
+package parse
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// jsonNode is the JSON representation of a node. The type is one of
+// text, func, arith or list, and determines which other fields are
+// present.
+type jsonNode struct {
+	Type   string   `json:"type"`
+	Value  string   `json:"value,omitempty"`
+	Param  string   `json:"param,omitempty"`
+	Name   string   `json:"name,omitempty"`
+	Args   []Node   `json:"args,omitempty"`
+	Nodes  []Node   `json:"nodes,omitempty"`
+	Pos    *jsonPos `json:"pos,omitempty"`
+	Source string   `json:"source,omitempty"`
+}
+
+// rawNode is the JSON representation of a node whose arguments and
+// nodes are yet to be unmarshaled.
+type rawNode struct {
+	jsonNode
+	Args  []json.RawMessage `json:"args"`
+	Nodes []json.RawMessage `json:"nodes"`
+}
+
+// jsonPos is the JSON representation of a position.
+type jsonPos struct {
+	Line int `json:"line"`
+	Col  int `json:"col"`
+}
+
+// MarshalJSON returns the text as a JSON object of type text, such
+// as {"type":"text","value":"$x","source":"$$x"}.
+func (t *TextNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{
+		Type:   "text",
+		Value:  t.Value,
+		Source: t.Source,
+	})
+}
+
+// MarshalJSON returns the function as a JSON object of type func,
+// such as {"type":"func","param":"a","name":":-","args":[...],
+// "pos":{"line":1,"col":1},"source":"${a:-b}"}.
+func (f *FuncNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{
+		Type:   "func",
+		Param:  f.Param,
+		Name:   f.Name,
+		Args:   f.Args,
+		Pos:    &jsonPos{f.Pos.Line, f.Pos.Col},
+		Source: f.Source,
+	})
+}
+
+// MarshalJSON returns the arithmetic expansion as a JSON object of
+// type arith, such as {"type":"arith","args":[...],
+// "pos":{"line":1,"col":1},"source":"$((a+1))"}.
+func (a *ArithNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{
+		Type:   "arith",
+		Args:   a.Args,
+		Pos:    &jsonPos{a.Pos.Line, a.Pos.Col},
+		Source: a.Source,
+	})
+}
+
+// MarshalJSON returns the list as a JSON object of type list, such
+// as {"type":"list","nodes":[...]}.
+func (l *ListNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{
+		Type:  "list",
+		Nodes: l.Nodes,
+	})
+}
+
+// MarshalJSON returns the root node of the tree as JSON.
+func (t *Tree) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Root)
+}
+
+// UnmarshalJSON sets the root node of the tree to the node represented
+// by the JSON, as returned by UnmarshalNode.
+func (t *Tree) UnmarshalJSON(data []byte) error {
+	root, err := UnmarshalNode(data)
+	if err != nil {
+		return err
+	}
+	t.Root = root
+	return nil
+}
+
+// UnmarshalNode returns the node represented by the JSON produced by
+// marshaling a node, so that json.Marshal and UnmarshalNode round
+// trip. A node of unknown type, a function without a parameter other
+// than the length of a nested substitution, and a function of unknown
+// name or with the wrong number of arguments are reported with the
+// path from the root, such as root.nodes[1].args[0].
+func UnmarshalNode(data []byte) (Node, error) {
+	return unmarshalNode(data, "root")
+}
+
+func unmarshalNode(data []byte, path string) (Node, error) {
+	var v rawNode
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	args, err := unmarshalNodes(v.Args, path, "args")
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := unmarshalNodes(v.Nodes, path, "nodes")
+	if err != nil {
+		return nil, err
+	}
+	var pos Pos
+	if v.Pos != nil {
+		pos = Pos{Line: v.Pos.Line, Col: v.Pos.Col}
+	}
+
+	switch v.Type {
+	case "text":
+		return &TextNode{Value: v.Value, Source: v.Source}, nil
+	case "func":
+		if v.Param == "" && (v.Name != "#" || len(args) != 1) {
+			return nil, fmt.Errorf("%s: func node without a param", path)
+		}
+		if err := checkFunc(v.Name, len(args)); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return &FuncNode{Param: v.Param, Name: v.Name, Args: args, Pos: pos, Source: v.Source}, nil
+	case "arith":
+		return &ArithNode{Args: args, Pos: pos, Source: v.Source}, nil
+	case "list":
+		return &ListNode{Nodes: nodes}, nil
+	case "":
+		return nil, fmt.Errorf("%s: missing node type", path)
+	}
+	return nil, fmt.Errorf("%s: unknown node type %q, want text, func, arith or list", path, v.Type)
+}
+
+// checkFunc returns an error if the name is not that of a function
+// produced by the parser, or the function cannot take the number of
+// arguments.
+func checkFunc(name string, args int) error {
+	min, max := 0, 0 // a max of -1 is unbounded
+	switch name {
+	case "", "!", "!*", "!@",
+		"@U", "@L", "@u", "@Q", "@E", "@b64", "@b64d", "@url", "@urld":
+	case "#", ",", ",,", "^", "^^", "~", "~~":
+		max = 1
+	case "##", "%", "%%", "[", "#[", "![":
+		min, max = 1, 1
+	case ":", "/", "//", "/#", "/%":
+		min, max = 1, 2
+	case "|":
+		if args == 0 {
+			return fmt.Errorf("func node %q without a function name", name)
+		}
+		max = -1
+	case "=", ":=", ":-", ":?", ":+", "-", "+", "?", ":num:":
+		max = -1
+	default:
+		return fmt.Errorf("unknown func name %q", name)
+	}
+	switch {
+	case args >= min && (max == -1 || args <= max):
+		return nil
+	case min == max:
+		return fmt.Errorf("func node %q with %d args, want %d", name, args, min)
+	default:
+		return fmt.Errorf("func node %q with %d args, want %d to %d", name, args, min, max)
+	}
+}
+
+// unmarshalNodes returns the nodes represented by each JSON value of
+// the named field of the node at path.
+func unmarshalNodes(data []json.RawMessage, path, field string) ([]Node, error) {
+	var nodes []Node
+	for i, d := range data {
+		node, err := unmarshalNode(d, fmt.Sprintf("%s.%s[%d]", path, field, i))
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
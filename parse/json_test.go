@@ -0,0 +1,118 @@
+package parse
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	var tests = []struct {
+		text string
+		want string
+	}{
+		{
+			text: "plain $$text",
+			want: `{"type":"text","value":"plain $text","source":"plain $$text"}`,
+		},
+		{
+			text: "$HOST",
+			want: `{"type":"func","param":"HOST","pos":{"line":1,"col":1},"source":"$HOST"}`,
+		},
+		{
+			text: "${a:-b}",
+			want: `{"type":"func","param":"a","name":":-","args":[{"type":"text","value":"b","source":"b"}],"pos":{"line":1,"col":1},"source":"${a:-b}"}`,
+		},
+		{
+			text: "x\n$((a+1))",
+			want: `{"type":"list","nodes":[{"type":"text","value":"x\n","source":"x\n"},{"type":"arith","args":[{"type":"text","value":"a+1","source":"a+1"}],"pos":{"line":2,"col":1},"source":"$((a+1))"}]}`,
+		},
+	}
+	for _, test := range tests {
+		tree, err := Parse(test.text)
+		if err != nil {
+			t.Errorf("%q: %s", test.text, err)
+			continue
+		}
+		b, err := json.Marshal(tree.Root)
+		if err != nil {
+			t.Errorf("%q: %s", test.text, err)
+			continue
+		}
+		if got := string(b); got != test.want {
+			t.Errorf("Want %q marshaled to\n%s\ngot\n%s", test.text, test.want, got)
+		}
+	}
+}
+
+func TestUnmarshalNode(t *testing.T) {
+	for _, test := range tests {
+		tree, err := Parse(test.Text)
+		if err != nil {
+			t.Errorf("%q: %s", test.Text, err)
+			continue
+		}
+		b, err := json.Marshal(tree.Root)
+		if err != nil {
+			t.Errorf("%q: %s", test.Text, err)
+			continue
+		}
+		node, err := UnmarshalNode(b)
+		if err != nil {
+			t.Errorf("%q: %s", test.Text, err)
+			continue
+		}
+		if diff := cmp.Diff(tree.Root, node); diff != "" {
+			t.Errorf("Want %q to round trip: %s", test.Text, diff)
+		}
+	}
+
+	var errs = []struct {
+		json string
+		err  string
+	}{
+		{`{"type":"list","nodes":[{"type":"text"},{"type":"func","param":"a","args":[{"type":"other"}]}]}`,
+			`root.nodes[1].args[0]: unknown node type "other", want text, func, arith or list`},
+		{`{"value":"text"}`, "root: missing node type"},
+		{`{"type":"func","name":":-"}`, "root: func node without a param"},
+		{`{"type":"list","nodes":[1]}`, "root.nodes[0]: json: cannot unmarshal number"},
+		{`{"type":"func","param":"a","name":"["}`, `root: func node "[" with 0 args, want 1`},
+		{`{"type":"func","param":"a","name":"#[","args":[{"type":"text"},{"type":"text"}]}`, `root: func node "#[" with 2 args, want 1`},
+		{`{"type":"func","param":"a","name":"|"}`, `root: func node "|" without a function name`},
+		{`{"type":"func","param":"a","name":":"}`, `root: func node ":" with 0 args, want 1 to 2`},
+		{`{"type":"func","param":"a","name":"//","args":[{"type":"text"},{"type":"text"},{"type":"text"}]}`, `root: func node "//" with 3 args, want 1 to 2`},
+		{`{"type":"func","param":"a","name":"@U","args":[{"type":"text"}]}`, `root: func node "@U" with 1 args, want 0`},
+		{`{"type":"func","param":"a","name":"%"}`, `root: func node "%" with 0 args, want 1`},
+		{`{"type":"func","param":"a","name":"^^","args":[{"type":"text"},{"type":"text"}]}`, `root: func node "^^" with 2 args, want 0 to 1`},
+		{`{"type":"list","nodes":[{"type":"func","param":"a","name":"?!"}]}`, `root.nodes[0]: unknown func name "?!"`},
+	}
+	for _, test := range errs {
+		_, err := UnmarshalNode([]byte(test.json))
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("Want %s to return error %q, got %v", test.json, test.err, err)
+		}
+	}
+}
+
+func TestTreeJSON(t *testing.T) {
+	tree, err := Parse("host=${HOST:-localhost}:$((PORT+1))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(Tree)
+	if err := json.Unmarshal(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(tree.Root, got.Root); diff != "" {
+		t.Errorf("Want tree to round trip: %s", diff)
+	}
+	if got, want := got.Root.String(), "host=${HOST:-localhost}:$((PORT+1))"; got != want {
+		t.Errorf("Want unmarshaled tree written as %q, got %q", want, got)
+	}
+}
@@ -1,8 +1,20 @@
 package parse
 
+import "strings"
+
 // Node is an element in the parse tree.
 type Node interface {
 	node()
+
+	// String returns the template text of the node. Parsing the
+	// text yields an equivalent node.
+	String() string
+}
+
+// Pos represents a position in the template source.
+type Pos struct {
+	Line int // line number, starting at 1
+	Col  int // column number in runes, starting at 1
 }
 
 // empty string node
@@ -14,13 +26,33 @@ type (
 	// TextNode represents a string of text.
 	TextNode struct {
 		Value string
+
+		// Source is the text exactly as it appears in the
+		// template, including escapes such as $$.
+		Source string
 	}
 
-	// FuncNode represents a string function.
+	// FuncNode represents a string function. The length of a
+	// nested substitution, as in ${#${var%.*}}, is a # function
+	// without a parameter whose argument is the substitution.
 	FuncNode struct {
 		Param string
 		Name  string
 		Args  []Node
+		Pos   Pos // position of the opening dollar sign
+
+		// Source is the text of the substitution exactly as it
+		// appears in the template, such as ${var:-word}.
+		Source string
+	}
+
+	// ArithNode represents a $((expression)) arithmetic expansion.
+	// The expression is the concatenation of the arguments once
+	// any substitutions among them are expanded.
+	ArithNode struct {
+		Args   []Node
+		Pos    Pos    // position of the opening dollar sign
+		Source string // text of the expansion as it appears in the template
 	}
 
 	// ListNode represents a list of nodes.
@@ -65,8 +97,8 @@ type (
 )
 
 // newTextNode returns a new TextNode.
-func newTextNode(text string) *TextNode {
-	return &TextNode{Value: text}
+func newTextNode(text, source string) *TextNode {
+	return &TextNode{Value: text, Source: source}
 }
 
 // newListNode returns a new ListNode.
@@ -81,6 +113,166 @@ func newFuncNode(name string) *FuncNode {
 
 // node() defines the node in a parse tree
 
-func (*TextNode) node() {}
-func (*ListNode) node() {}
-func (*FuncNode) node() {}
+func (*TextNode) node()  {}
+func (*ListNode) node()  {}
+func (*FuncNode) node()  {}
+func (*ArithNode) node() {}
+
+// Walk traverses the tree rooted at n depth-first, calling fn for
+// each node. It descends into the nodes of a ListNode and the
+// arguments of a FuncNode or ArithNode unless fn returns false.
+func Walk(n Node, fn func(Node) bool) {
+	if !fn(n) {
+		return
+	}
+	switch n := n.(type) {
+	case *ListNode:
+		for _, c := range n.Nodes {
+			Walk(c, fn)
+		}
+	case *FuncNode:
+		for _, c := range n.Args {
+			Walk(c, fn)
+		}
+	case *ArithNode:
+		for _, c := range n.Args {
+			Walk(c, fn)
+		}
+	}
+}
+
+// String returns the text as it appears in the template. If the
+// source text is not known, the characters that would otherwise be
+// parsed as a substitution or escape sequence are escaped.
+func (t *TextNode) String() string {
+	if t.Source != "" {
+		return t.Source
+	}
+	return escapeText(t.Value, false)
+}
+
+// String returns the template text of each node in the list.
+func (l *ListNode) String() string {
+	var b strings.Builder
+	for _, n := range l.Nodes {
+		b.WriteString(n.String())
+	}
+	return b.String()
+}
+
+// String returns the ${param...} substitution. Bare $param variables
+// are written in the equivalent ${param} form.
+func (f *FuncNode) String() string {
+	var b strings.Builder
+	b.WriteString("${")
+	switch f.Name {
+	case "!", "#":
+		if f.Name == "#" && len(f.Args) != 0 {
+			break
+		}
+		b.WriteString(f.Name)
+		b.WriteString(f.Param)
+		b.WriteString("}")
+		return b.String()
+	case "!*", "!@":
+		b.WriteString("!")
+		b.WriteString(f.Param)
+		b.WriteString(f.Name[1:])
+		b.WriteString("}")
+		return b.String()
+	case "[", "#[", "![":
+		if f.Name != "[" {
+			b.WriteString(f.Name[:1])
+		}
+		b.WriteString(f.Param)
+		b.WriteString("[")
+		for _, arg := range f.Args {
+			b.WriteString(argString(arg, false))
+		}
+		b.WriteString("]}")
+		return b.String()
+	}
+
+	b.WriteString(f.Param)
+	b.WriteString(f.Name)
+	switch f.Name {
+	case ":":
+		for i, arg := range f.Args {
+			if i != 0 {
+				b.WriteString(":")
+			}
+			b.WriteString(argString(arg, false))
+		}
+	case "|":
+		for i, arg := range f.Args {
+			if i > 0 {
+				b.WriteString(":")
+			}
+			b.WriteString(argString(arg, false))
+		}
+	case "/", "//", "/#", "/%":
+		for i, arg := range f.Args {
+			if i != 0 {
+				b.WriteString("/")
+			}
+			b.WriteString(argString(arg, true))
+		}
+		if len(f.Args) == 1 && argString(f.Args[0], true) != "" {
+			b.WriteString("/")
+		}
+	default:
+		for _, arg := range f.Args {
+			b.WriteString(argString(arg, false))
+		}
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// String returns the $((expression)) arithmetic expansion.
+func (a *ArithNode) String() string {
+	var b strings.Builder
+	b.WriteString("$((")
+	for _, arg := range a.Args {
+		b.WriteString(argString(arg, false))
+	}
+	b.WriteString("))")
+	return b.String()
+}
+
+// argString returns the template text of a function argument. Text
+// is written verbatim unless escape is true, as it is in the pattern
+// and replacement of the replace functions where escape sequences
+// are recognized.
+func argString(node Node, escape bool) string {
+	text, ok := node.(*TextNode)
+	switch {
+	case !ok:
+		return node.String()
+	case text.Source != "":
+		return text.Source
+	case !escape:
+		return text.Value
+	}
+	return escapeText(text.Value, true)
+}
+
+// escapeText escapes the dollar signs and backslashes in s. In a
+// function argument, where the text is followed by a delimiter,
+// every backslash and forward slash is escaped.
+func escapeText(s string, arg bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '$':
+			b.WriteString("$$")
+		case c == '\\' && (arg || i+1 < len(s) && (s[i+1] == '\\' || s[i+1] == '/')):
+			b.WriteString(`\\`)
+		case c == '/' && arg:
+			b.WriteString(`\/`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
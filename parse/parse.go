@@ -2,42 +2,308 @@ package parse
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"strings"
 )
 
 // ErrBadSubstitution represents a substitution parsing error.
 var ErrBadSubstitution = errors.New("bad substitution")
 
+// ErrUnexpectedBrace is returned in strict mode for a closing brace
+// that does not close an opening brace.
+var ErrUnexpectedBrace = errors.New("unexpected closing brace")
+
+// ErrFunc describes a malformed substitution function, naming the
+// kind of function and what the parser expected to find. It wraps
+// ErrBadSubstitution.
+type ErrFunc struct {
+	Func     string // kind of function, such as "replace"
+	Expected string // what was expected, such as "second '/'"
+}
+
+func (e *ErrFunc) Error() string {
+	return fmt.Sprintf("%s: expected %s in %s expression", ErrBadSubstitution, e.Expected, e.Func)
+}
+
+// Unwrap returns ErrBadSubstitution.
+func (e *ErrFunc) Unwrap() error {
+	return ErrBadSubstitution
+}
+
+// ErrParse describes a template parsing error and the position of
+// the offending character.
+type ErrParse struct {
+	Err        error  // underlying error
+	Pos        Pos    // position of the offending character
+	Context    string // source text surrounding the offending character
+	SourceLine string // line containing the offending character
+	Filename   string // name of the template file, if known
+}
+
+func (e *ErrParse) Error() string {
+	if e.Filename != "" {
+		return fmt.Sprintf("%s:%d:%d: %s near %q", e.Filename, e.Pos.Line, e.Pos.Col, e.Err, e.Context)
+	}
+	return fmt.Sprintf("%d:%d: %s near %q", e.Pos.Line, e.Pos.Col, e.Err, e.Context)
+}
+
+// Pretty returns the error followed by the line of the template that
+// contains the offending character, with a caret beneath it, so that
+// logs show exactly where the substitution went wrong:
+//
+//	2:14: bad substitution: expected argument in substring expression near "t: ${PORT:}\n"
+//	    port: ${PORT:}
+//	                 ^
+//
+// It returns the same as Error if the line is not known.
+func (e *ErrParse) Pretty() string {
+	if e.SourceLine == "" {
+		return e.Error()
+	}
+	var b strings.Builder
+	b.WriteString(e.Error())
+	b.WriteString("\n    ")
+	b.WriteString(e.SourceLine)
+	b.WriteString("\n    ")
+	col := 1
+	for _, r := range e.SourceLine {
+		if col >= e.Pos.Col {
+			break
+		}
+		// keep tabs so the caret lines up with the line above.
+		if r == '\t' {
+			b.WriteByte('\t')
+		} else {
+			b.WriteByte(' ')
+		}
+		col++
+	}
+	b.WriteByte('^')
+	return b.String()
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrParse) Unwrap() error {
+	return e.Err
+}
+
+// Debug, if not nil, receives diagnostic output describing the
+// tokens scanned and the functions parsed. It is nil by default so
+// that parsing is silent. It must not be changed while templates
+// are being parsed.
+var Debug io.Writer
+
+// debugf writes a line of diagnostic output to Debug, if set.
+func debugf(format string, args ...interface{}) {
+	if Debug != nil {
+		fmt.Fprintf(Debug, format+"\n", args...)
+	}
+}
+
 // Tree is the representation of a single parsed SQL statement.
 type Tree struct {
 	Root Node
 
+	// Strict causes a closing brace in the template text that does
+	// not close an opening brace, such as the last brace of ${a}},
+	// to be reported as ErrUnexpectedBrace. Braces in the text are
+	// otherwise taken literally.
+	Strict bool
+
+	// Directives causes the lines from a line containing envsubst:off
+	// to the next line containing envsubst:on, typically written in a
+	// comment such as # envsubst:off, to be taken literally. The
+	// marker lines are kept in the text unless StripDirectives is
+	// also set. A region that is not turned back on extends to the
+	// end of the template.
+	Directives      bool
+	StripDirectives bool
+
+	// BalancedBraces allows the word of a default substitution, such
+	// as ${var:-word}, to contain braces so long as they are balanced,
+	// as in ${JSON:-{"k":"v"}}. A closing brace otherwise ends the
+	// substitution.
+	BalancedBraces bool
+
+	// LiteralDoubleDollar causes $$ to be taken literally rather than
+	// as an escaped dollar sign, for text such as a $$ placeholder
+	// meant for another tool. A single $ still begins a substitution,
+	// so $${var} is a $ followed by the expansion of var; use \${var}
+	// for the literal text ${var}.
+	LiteralDoubleDollar bool
+
+	// Line is the line number of the first line of the text, which
+	// is otherwise taken to be 1. It offsets the positions of the
+	// nodes and errors when the text is part of a larger input, such
+	// as a single line of a file.
+	Line int
+
 	// Parsing only; cleared after parse.
-	scanner *scanner
+	scanner    *scanner
+	leftDelim  string
+	rightDelim string
+	braces     int
 }
 
 // Parse parses the string and returns a Tree.
 func Parse(buf string) (*Tree, error) {
-	t := new(Tree)
-	t.scanner = new(scanner)
-	return t.Parse(buf)
+	return new(Tree).Parse(buf)
+}
+
+// ParseWithDelims parses the string using the given left and right
+// delimiters in place of ${ and }. With custom delimiters bare $name
+// variables are not recognized, and a literal left delimiter is
+// written by doubling its first character, so %%% yields %% when
+// the left delimiter is %%. Nested substitutions are only supported
+// when the delimiters differ, and operators that begin with the
+// right delimiter are not available.
+func ParseWithDelims(buf, left, right string) (*Tree, error) {
+	return new(Tree).Delims(left, right).Parse(buf)
+}
+
+// Delims sets the substitution delimiters used by subsequent calls to
+// Parse. An empty delimiter selects the default ${ or }. It returns
+// the tree so calls can be chained.
+func (t *Tree) Delims(left, right string) *Tree {
+	t.leftDelim = left
+	t.rightDelim = right
+	return t
+}
+
+// Reset clears the parse tree, keeping the delimiters and options,
+// so that the tree can be reused to parse another template without
+// allocating a new one. A tree must not be reset while a previous
+// parse of it is still in use.
+func (t *Tree) Reset() *Tree {
+	t.Root = nil
+	t.braces = 0
+	return t
 }
 
 // Parse parses the string buffer to construct an ast
-// representation for expansion.
+// representation for expansion. The tree is read-only once
+// parsed and may be shared by multiple goroutines.
 func (t *Tree) Parse(buf string) (tree *Tree, err error) {
-	t.scanner.init(buf)
-	t.Root, err = t.parseAny()
+	t.scanner = scanners.Get().(*scanner)
+	t.scanner.literalDollar = t.LiteralDoubleDollar
+	t.scanner.firstLine = t.Line
+	t.Reset()
+	if t.Directives {
+		t.Root, err = t.parseRegions(buf)
+	} else {
+		t.scanner.init(buf, t.leftDelim, t.rightDelim)
+		t.Root, err = t.parseAny()
+	}
+	if err != nil {
+		err = &ErrParse{
+			Err:        err,
+			Pos:        t.scanner.position(t.scanner.start),
+			Context:    t.scanner.context(),
+			SourceLine: t.scanner.line(),
+		}
+	}
+	t.scanner.release()
+	t.scanner = nil
 	return t, err
 }
 
+// parseRegions parses the regions of the buffer in which expansion is
+// enabled by directives, taking the other regions literally. Each
+// region is scanned in place so that positions are relative to the
+// start of the buffer.
+func (t *Tree) parseRegions(buf string) (Node, error) {
+	var nodes []Node
+	for _, r := range splitRegions(buf, t.StripDirectives) {
+		if r.literal {
+			text := buf[r.start:r.end]
+			nodes = append(nodes, newTextNode(text, text))
+			continue
+		}
+		t.scanner.init(buf[:r.end], t.leftDelim, t.rightDelim)
+		t.scanner.pos = r.start
+		node, err := t.parseAny()
+		if err != nil {
+			return nil, err
+		}
+		if node != empty {
+			nodes = append(nodes, node)
+		}
+	}
+	switch len(nodes) {
+	case 0:
+		return empty, nil
+	case 1:
+		return nodes[0], nil
+	}
+	return newListNode(nodes...), nil
+}
+
+// markers of the directives that disable and enable expansion.
+const (
+	directiveOff = "envsubst:off"
+	directiveOn  = "envsubst:on"
+)
+
+// region is a range of the buffer that is either parsed or, between
+// directives, taken literally.
+type region struct {
+	start, end int
+	literal    bool
+}
+
+// splitRegions splits the buffer into the regions separated by the
+// directive marker lines. The marker lines are part of the literal
+// regions unless strip is true, in which case they are omitted.
+func splitRegions(buf string, strip bool) []region {
+	var regions []region
+	add := func(start, end int, literal bool) {
+		if start < end {
+			regions = append(regions, region{start, end, literal})
+		}
+	}
+	start, off := 0, false
+	for pos := 0; pos < len(buf); {
+		end := len(buf)
+		if i := strings.IndexByte(buf[pos:], '\n'); i >= 0 {
+			end = pos + i + 1
+		}
+		line := buf[pos:end]
+		switch {
+		case !off && strings.Contains(line, directiveOff):
+			add(start, pos, false)
+			start, off = pos, true
+			if strip {
+				start = end
+			}
+		case off && strings.Contains(line, directiveOn):
+			if strip {
+				add(start, pos, true)
+			} else {
+				add(start, end, true)
+			}
+			start, off = end, false
+		}
+		pos = end
+	}
+	add(start, len(buf), off)
+	return regions
+}
+
 func (t *Tree) parseAny() (Node, error) {
 	t.scanner.accept = acceptRune
-	t.scanner.mode = scanIdent | scanLbrack | scanEscape
+	t.scanner.mode = scanIdent | scanLbrack | scanEscape | scanVar | scanArith
 
 	switch t.scanner.scan() {
 	case tokenIdent:
+		if t.Strict {
+			if err := t.checkBraces(); err != nil {
+				return nil, err
+			}
+		}
 		left := newTextNode(
 			t.scanner.string(),
+			t.scanner.source(),
 		)
 		right, err := t.parseAny()
 		switch {
@@ -55,6 +321,34 @@ func (t *Tree) parseAny() (Node, error) {
 			return nil, err
 		}
 
+		right, err := t.parseAny()
+		switch {
+		case err != nil:
+			return nil, err
+		case right == empty:
+			return left, nil
+		}
+		return newListNode(left, right), nil
+	case tokenVar:
+		left, err := t.parseVar()
+		if err != nil {
+			return nil, err
+		}
+
+		right, err := t.parseAny()
+		switch {
+		case err != nil:
+			return nil, err
+		case right == empty:
+			return left, nil
+		}
+		return newListNode(left, right), nil
+	case tokenArith:
+		left, err := t.parseArith()
+		if err != nil {
+			return nil, err
+		}
+
 		right, err := t.parseAny()
 		switch {
 		case err != nil:
@@ -68,10 +362,121 @@ func (t *Tree) parseAny() (Node, error) {
 	return nil, ErrBadSubstitution
 }
 
+// checkBraces tracks the nesting of braces in the most recently
+// scanned text, returning an error positioned at the first closing
+// brace that does not close an opening brace.
+func (t *Tree) checkBraces() error {
+	s := t.scanner
+	text := s.buf[s.start:s.pos]
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '{':
+			t.braces++
+		case '}':
+			if t.braces == 0 {
+				s.start += i
+				return ErrUnexpectedBrace
+			}
+			t.braces--
+		}
+	}
+	return nil
+}
+
+// parses the $((expression)) arithmetic expansion. The expression
+// ends at the first )) that is not closing a parenthesis opened in
+// the expression. Substitutions in the expression are parsed, the
+// remaining text is left for the evaluator.
+func (t *Tree) parseArith() (Node, error) {
+	start := t.scanner.start
+	node := new(ArithNode)
+	node.Pos = t.scanner.position(start)
+
+	depth := 0
+	accept := func(r rune, i int) bool {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return false
+			}
+			depth--
+		}
+		return true
+	}
+
+	for {
+		t.scanner.accept = accept
+		t.scanner.mode = scanIdent | scanLbrack | scanVar | scanArith
+		var arg Node
+		var err error
+		switch t.scanner.scan() {
+		case tokenIdent:
+			arg = newTextNode(t.scanner.string(), t.scanner.source())
+		case tokenLbrack:
+			arg, err = t.parseFunc()
+		case tokenVar:
+			arg, err = t.parseVar()
+		case tokenArith:
+			arg, err = t.parseArith()
+		case tokenIllegal:
+			// the first closing parenthesis was rejected, so
+			// expect the second.
+			if t.scanner.string() != ")" || t.scanner.read() != ')' {
+				return nil, badFunc("arithmetic", "closing '))'")
+			}
+			node.Source = t.scanner.buf[start:t.scanner.pos]
+			return node, nil
+		default:
+			return nil, badFunc("arithmetic", "closing '))'")
+		}
+		if err != nil {
+			return nil, err
+		}
+		node.Args = append(node.Args, arg)
+	}
+}
+
+// parses the bare $param variable. The name ends at the first rune
+// that is not a letter, digit or underscore.
+func (t *Tree) parseVar() (Node, error) {
+	start := t.scanner.start
+	pos := t.scanner.position(start)
+	t.scanner.accept = acceptVarName
+	t.scanner.mode = scanIdent
+	switch t.scanner.scan() {
+	case tokenIdent:
+		node := newFuncNode(t.scanner.string())
+		node.Pos = pos
+		node.Source = t.scanner.buf[start:t.scanner.pos]
+		return node, nil
+	default:
+		return nil, ErrBadSubstitution
+	}
+}
+
+// parses a ${param...} substitution. The scanner is expected to
+// have just consumed the opening bracket.
 func (t *Tree) parseFunc() (Node, error) {
+	start := t.scanner.start
+	pos := t.scanner.position(start)
+	node, err := t.parseFuncBody()
+	if fn, ok := node.(*FuncNode); ok && err == nil {
+		fn.Pos = pos
+		fn.Source = t.scanner.buf[start:t.scanner.pos]
+	}
+	return node, err
+}
+
+func (t *Tree) parseFuncBody() (Node, error) {
 	switch t.scanner.peek() {
 	case '#':
 		return t.parseLenFunc()
+	case '!':
+		return t.parseIndirectFunc()
+	case '@', '*':
+		return t.parseParamsFunc(new(FuncNode), "parameter")
 	}
 
 	var name string
@@ -82,15 +487,21 @@ func (t *Tree) parseFunc() (Node, error) {
 	case tokenIdent:
 		name = t.scanner.string()
 	default:
-		return nil, ErrBadSubstitution
+		return nil, badFunc("parameter", "variable name")
+	}
+
+	debugf("function %q operator %q", name, t.scanner.peek())
+
+	if t.scanner.atClose() {
+		return newFuncNode(name), t.consumeRbrack("parameter")
 	}
 
 	switch t.scanner.peek() {
 	case ':':
 		return t.parseDefaultOrSubstr(name)
-	case '=':
+	case '=', '-', '+', '?':
 		return t.parseDefaultFunc(name)
-	case ',', '^':
+	case ',', '^', '~':
 		return t.parseCasingFunc(name)
 	case '/':
 		return t.parseReplaceFunc(name)
@@ -98,6 +509,12 @@ func (t *Tree) parseFunc() (Node, error) {
 		return t.parseRemoveFunc(name, acceptHashFunc)
 	case '%':
 		return t.parseRemoveFunc(name, acceptPercentFunc)
+	case '@':
+		return t.parseTransformFunc(name)
+	case '[':
+		return t.parseIndexFunc(name, "[")
+	case '|':
+		return t.parseCallFunc(name)
 	}
 
 	t.scanner.accept = acceptIdent
@@ -106,32 +523,47 @@ func (t *Tree) parseFunc() (Node, error) {
 	case tokenRbrack:
 		return newFuncNode(name), nil
 	default:
-		return nil, ErrBadSubstitution
+		return nil, badFunc("parameter", "operator or "+t.closing())
 	}
 }
 
 // parse a substitution function parameter.
-func (t *Tree) parseParam(accept acceptFunc, mode byte) (Node, error) {
+func (t *Tree) parseParam(fn string, accept acceptFunc, mode byte) (Node, error) {
+	return t.parseArg(fn, accept, mode|scanLbrack|scanClose)
+}
+
+// parse a substitution function parameter using exactly the given
+// scanner mode.
+func (t *Tree) parseArg(fn string, accept acceptFunc, mode byte) (Node, error) {
 	t.scanner.accept = accept
-	t.scanner.mode = mode | scanLbrack
+	t.scanner.mode = mode
 	switch t.scanner.scan() {
 	case tokenLbrack:
 		return t.parseFunc()
+	case tokenVar:
+		return t.parseVar()
 	case tokenIdent:
 		return newTextNode(
 			t.scanner.string(),
+			t.scanner.source(),
 		), nil
 	case tokenRbrack:
 		return newTextNode(
 			t.scanner.string(),
+			t.scanner.source(),
 		), nil
+	case tokenEOF:
+		return nil, badFunc(fn, t.closing())
 	default:
-		return nil, ErrBadSubstitution
+		return nil, badFunc(fn, "argument")
 	}
 }
 
-// parse either a default or substring substitution function.
+// parse either a default, integer or substring substitution function.
 func (t *Tree) parseDefaultOrSubstr(name string) (Node, error) {
+	if strings.HasPrefix(t.scanner.buf[t.scanner.pos:], numFunc) {
+		return t.parseNumFunc(name)
+	}
 	t.scanner.read()
 	r := t.scanner.peek()
 	t.scanner.unread()
@@ -155,12 +587,12 @@ func (t *Tree) parseSubstrFunc(name string) (Node, error) {
 	case tokenIdent:
 		node.Name = t.scanner.string()
 	default:
-		return nil, ErrBadSubstitution
+		return nil, badFunc("substring", "':'")
 	}
 
 	// scan arg[1]
 	{
-		param, err := t.parseParam(rejectColonClose, scanIdent)
+		param, err := t.parseParam("substring", rejectColonClose, scanIdent|scanVar)
 		if err != nil {
 			return nil, err
 		}
@@ -178,19 +610,19 @@ func (t *Tree) parseSubstrFunc(name string) (Node, error) {
 	case tokenIdent:
 		// no-op
 	default:
-		return nil, ErrBadSubstitution
+		return nil, badFunc("substring", "':' or "+t.closing())
 	}
 
 	// scan arg[2]
 	{
-		param, err := t.parseParam(acceptNotClosing, scanIdent)
+		param, err := t.parseParam("substring", acceptNotClosing, scanIdent|scanVar)
 		if err != nil {
 			return nil, err
 		}
 		node.Args = append(node.Args, param)
 	}
 
-	return node, t.consumeRbrack()
+	return node, t.consumeRbrack("substring")
 }
 
 // parses the ${param%word} string function
@@ -207,12 +639,12 @@ func (t *Tree) parseRemoveFunc(name string, accept acceptFunc) (Node, error) {
 	case tokenIdent:
 		node.Name = t.scanner.string()
 	default:
-		return nil, ErrBadSubstitution
+		return nil, badFunc("removal", "'#' or '%'")
 	}
 
 	// scan arg[1]
 	{
-		param, err := t.parseParam(acceptNotClosing, scanIdent)
+		param, err := t.parseParam("removal", acceptNotClosing, scanIdent)
 		if err != nil {
 			return nil, err
 		}
@@ -221,13 +653,15 @@ func (t *Tree) parseRemoveFunc(name string, accept acceptFunc) (Node, error) {
 		node.Args = append(node.Args, param)
 	}
 
-	return node, t.consumeRbrack()
+	return node, t.consumeRbrack("removal")
 }
 
 // parses the ${param/pattern/string} string function
 // parses the ${param//pattern/string} string function
 // parses the ${param/#pattern/string} string function
 // parses the ${param/%pattern/string} string function
+// parses the ${param/pattern} string function
+// parses the ${param//pattern} string function
 func (t *Tree) parseReplaceFunc(name string) (Node, error) {
 	node := new(FuncNode)
 	node.Param = name
@@ -238,18 +672,31 @@ func (t *Tree) parseReplaceFunc(name string) (Node, error) {
 	case tokenIdent:
 		node.Name = t.scanner.string()
 	default:
-		return nil, ErrBadSubstitution
+		return nil, badFunc("replace", "'/'")
+	}
+
+	// an empty pattern, as in ${param/}, matches nothing and
+	// leaves the value unchanged.
+	if t.scanner.atClose() {
+		node.Args = append(node.Args, newTextNode("", ""))
+		return node, t.consumeRbrack("replace")
 	}
 
 	// scan arg[1]
 	{
-		param, err := t.parseParam(acceptNotSlash, scanIdent|scanEscape)
+		param, err := t.parseParam("replace", acceptNotSlash, scanIdent|scanEscape)
 		if err != nil {
 			return nil, err
 		}
 		node.Args = append(node.Args, param)
 	}
 
+	// a missing replacement, as in ${param//pattern}, deletes
+	// the matches.
+	if t.scanner.atClose() {
+		return node, t.consumeRbrack("replace")
+	}
+
 	// expect delimiter
 	t.scanner.accept = acceptSlash
 	t.scanner.mode = scanIdent
@@ -257,28 +704,30 @@ func (t *Tree) parseReplaceFunc(name string) (Node, error) {
 	case tokenIdent:
 		// no-op
 	default:
-		return nil, ErrBadSubstitution
+		return nil, badFunc("replace", "second '/' or "+t.closing())
 	}
 
 	// check for blank string
-	switch t.scanner.peek() {
-	case '}':
-		return node, t.consumeRbrack()
+	if t.scanner.atClose() {
+		return node, t.consumeRbrack("replace")
 	}
 
 	// scan arg[2]
 	{
-		param, err := t.parseParam(acceptNotClosing, scanIdent|scanEscape)
+		param, err := t.parseParam("replace", acceptNotClosing, scanIdent|scanEscape)
 		if err != nil {
 			return nil, err
 		}
 		node.Args = append(node.Args, param)
 	}
 
-	return node, t.consumeRbrack()
+	return node, t.consumeRbrack("replace")
 }
 
 // parses the ${parameter=word} string function
+// parses the ${parameter-word} string function
+// parses the ${parameter+word} string function
+// parses the ${parameter?word} string function
 // parses the ${parameter:=word} string function
 // parses the ${parameter:-word} string function
 // parses the ${parameter:?word} string function
@@ -288,25 +737,72 @@ func (t *Tree) parseDefaultFunc(name string) (Node, error) {
 	node.Param = name
 
 	t.scanner.accept = acceptDefaultFunc
-	if t.scanner.peek() == '=' {
-		t.scanner.accept = acceptOneEqual
+	if t.scanner.peek() != ':' {
+		t.scanner.accept = acceptOneDefault
 	}
 	t.scanner.mode = scanIdent
 	switch t.scanner.scan() {
 	case tokenIdent:
 		node.Name = t.scanner.string()
 	default:
-		return nil, ErrBadSubstitution
+		return nil, badFunc("default", "operator")
 	}
+	return t.parseWord(node, "default")
+}
 
-	// loop through all possible runes in default param
+// parses the ${param:num:word} string function, an envsubst extension
+// that expands to the value of param only if it is an integer.
+func (t *Tree) parseNumFunc(name string) (Node, error) {
+	node := new(FuncNode)
+	node.Param = name
+
+	t.scanner.accept = acceptNumFunc
+	t.scanner.mode = scanIdent
+	switch t.scanner.scan() {
+	case tokenIdent:
+		node.Name = t.scanner.string()
+	default:
+		return nil, badFunc("integer", "'"+numFunc+"'")
+	}
+	return t.parseWord(node, "integer")
+}
+
+// parses the word of a default or integer function up to the closing
+// bracket, appending its parts to the arguments of the node. Only the
+// closing bracket and a $ that begins a substitution are special in
+// the word, so operator characters such as : / # and % are literal,
+// as in ${URL:-http://localhost:8080/#top}.
+func (t *Tree) parseWord(node *FuncNode, fn string) (Node, error) {
+	// with balanced braces a closing brace only ends the
+	// substitution once every brace opened in the word is closed.
+	depth := 0
+	balanced := func(r rune, i int) bool {
+		switch r {
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				return false
+			}
+			depth--
+		}
+		return true
+	}
+
+	// loop through all possible runes in default param, which may
+	// include substitutions and bare $name variables.
 	for {
 		// this acts as the break condition. Peek to see if we reached the end
-		switch t.scanner.peek() {
-		case '}':
-			return node, t.consumeRbrack()
+		if depth == 0 && t.scanner.atClose() {
+			return node, t.consumeRbrack(fn)
+		}
+		var param Node
+		var err error
+		if t.BalancedBraces && t.scanner.rdelim == rightDelim {
+			param, err = t.parseArg(fn, balanced, scanIdent|scanLbrack|scanVar)
+		} else {
+			param, err = t.parseParam(fn, acceptNotClosing, scanIdent|scanVar)
 		}
-		param, err := t.parseParam(acceptNotClosing, scanIdent)
 		if err != nil {
 			return nil, err
 		}
@@ -319,6 +815,14 @@ func (t *Tree) parseDefaultFunc(name string) (Node, error) {
 // parses the ${param,,} string function
 // parses the ${param^} string function
 // parses the ${param^^} string function
+// parses the ${param,pattern} string function
+// parses the ${param,,pattern} string function
+// parses the ${param^pattern} string function
+// parses the ${param^^pattern} string function
+// parses the ${param~} string function
+// parses the ${param~~} string function
+// parses the ${param~pattern} string function
+// parses the ${param~~pattern} string function
 func (t *Tree) parseCasingFunc(name string) (Node, error) {
 	node := new(FuncNode)
 	node.Param = name
@@ -329,13 +833,104 @@ func (t *Tree) parseCasingFunc(name string) (Node, error) {
 	case tokenIdent:
 		node.Name = t.scanner.string()
 	default:
-		return nil, ErrBadSubstitution
+		return nil, badFunc("casing", "'^', ',' or '~'")
 	}
 
-	return node, t.consumeRbrack()
+	// the operator is doubled to apply to every character, so
+	// a mixed operator such as ,^ is not valid.
+	if len(node.Name) == 2 && node.Name[0] != node.Name[1] {
+		return nil, badFunc("casing", "'^', ',' or '~'")
+	}
+
+	// check for an optional pattern
+	if t.scanner.atClose() {
+		return node, t.consumeRbrack("casing")
+	}
+
+	// scan arg[1]
+	{
+		param, err := t.parseParam("casing", acceptNotClosing, scanIdent)
+		if err != nil {
+			return nil, err
+		}
+		node.Args = append(node.Args, param)
+	}
+
+	return node, t.consumeRbrack("casing")
+}
+
+// parses the ${param|name} string function
+// parses the ${param|name:arg...} string function
+//
+// This is an envsubst extension that calls the function registered
+// by name with the value of param. The name is the first argument of
+// the node, followed by the arguments of the call.
+func (t *Tree) parseCallFunc(name string) (Node, error) {
+	node := new(FuncNode)
+	node.Param = name
+
+	t.scanner.accept = acceptOnePipe
+	t.scanner.mode = scanIdent
+	switch t.scanner.scan() {
+	case tokenIdent:
+		node.Name = t.scanner.string()
+	default:
+		return nil, badFunc("function", "'|'")
+	}
+
+	t.scanner.accept = acceptIdent
+	t.scanner.mode = scanIdent
+	switch t.scanner.scan() {
+	case tokenIdent:
+		node.Args = append(node.Args, newTextNode(
+			t.scanner.string(),
+			t.scanner.source(),
+		))
+	default:
+		return nil, badFunc("function", "function name")
+	}
+
+	// scan the arguments, each preceded by a colon.
+	for t.scanner.peek() == ':' {
+		t.scanner.accept = acceptOneColon
+		t.scanner.mode = scanIdent
+		t.scanner.scan()
+
+		param, err := t.parseParam("function", rejectColonClose, scanIdent|scanVar)
+		if err != nil {
+			return nil, err
+		}
+		node.Args = append(node.Args, param)
+	}
+
+	return node, t.consumeRbrack("function")
+}
+
+// parses the ${param@operator} string function
+func (t *Tree) parseTransformFunc(name string) (Node, error) {
+	node := new(FuncNode)
+	node.Param = name
+
+	t.scanner.accept = acceptTransformFunc
+	t.scanner.mode = scanIdent
+	switch t.scanner.scan() {
+	case tokenIdent:
+		node.Name = t.scanner.string()
+	default:
+		return nil, badFunc("transform", "operator")
+	}
+
+	switch node.Name {
+	case "@U", "@L", "@u", "@Q", "@E", "@b64", "@b64d", "@url", "@urld":
+	default:
+		return nil, badFunc("transform", "operator U, L, u, Q, E, b64, b64d, url or urld")
+	}
+
+	return node, t.consumeRbrack("transform")
 }
 
 // parses the ${#param} string function
+// parses the ${#${...}} string function
 func (t *Tree) parseLenFunc() (Node, error) {
 	node := new(FuncNode)
 
@@ -345,7 +940,23 @@ func (t *Tree) parseLenFunc() (Node, error) {
 	case tokenIdent:
 		node.Name = t.scanner.string()
 	default:
-		return nil, ErrBadSubstitution
+		return nil, badFunc("length", "'#'")
+	}
+
+	// the length of a nested substitution, which is the only
+	// argument of a function without a parameter.
+	if t.scanner.atOpen() {
+		arg, err := t.parseArg("length", acceptIdent, scanLbrack)
+		if err != nil {
+			return nil, err
+		}
+		node.Args = append(node.Args, arg)
+		return node, t.consumeRbrack("length")
+	}
+
+	switch t.scanner.peek() {
+	case '@', '*':
+		return t.parseParamsFunc(node, "length")
 	}
 
 	t.scanner.accept = acceptIdent
@@ -354,22 +965,139 @@ func (t *Tree) parseLenFunc() (Node, error) {
 	case tokenIdent:
 		node.Param = t.scanner.string()
 	default:
-		return nil, ErrBadSubstitution
+		return nil, badFunc("length", "variable name")
+	}
+
+	if t.scanner.peek() == '[' {
+		return t.parseIndexFunc(node.Param, "#[")
+	}
+
+	return node, t.consumeRbrack("length")
+}
+
+// parses the ${@} and ${*} positional parameters function
+// parses the ${#@} and ${#*} positional parameters count function
+func (t *Tree) parseParamsFunc(node *FuncNode, fn string) (Node, error) {
+	t.scanner.accept = acceptOneStarOrAt
+	t.scanner.mode = scanIdent
+	if t.scanner.scan() != tokenIdent {
+		return nil, badFunc(fn, "'@' or '*'")
+	}
+	node.Param = t.scanner.string()
+	return node, t.consumeRbrack(fn)
+}
+
+// parses the ${param[@]} string function
+// parses the ${param[*]} string function
+// parses the ${param[index]} string function
+// parses the ${#param[@]} string function
+// parses the ${#param[index]} string function
+func (t *Tree) parseIndexFunc(name, op string) (Node, error) {
+	node := new(FuncNode)
+	node.Param = name
+	node.Name = op
+
+	t.scanner.accept = acceptOneLsquare
+	t.scanner.mode = scanIdent
+	if t.scanner.scan() != tokenIdent {
+		return nil, badFunc("index", "'['")
+	}
+
+	// scan arg[1]
+	{
+		param, err := t.parseParam("index", rejectRsquareClose, scanIdent)
+		if err != nil {
+			return nil, err
+		}
+		node.Args = append(node.Args, param)
 	}
 
-	return node, t.consumeRbrack()
+	t.scanner.accept = acceptOneRsquare
+	t.scanner.mode = scanIdent
+	if t.scanner.scan() != tokenIdent {
+		return nil, badFunc("index", "']'")
+	}
+
+	return node, t.consumeRbrack("index")
+}
+
+// parses the ${!param} string function
+// parses the ${!prefix*} string function
+// parses the ${!prefix@} string function
+// parses the ${!param[@]} string function
+// parses the ${!param[*]} string function
+func (t *Tree) parseIndirectFunc() (Node, error) {
+	node := new(FuncNode)
+
+	t.scanner.accept = acceptOneBang
+	t.scanner.mode = scanIdent
+	switch t.scanner.scan() {
+	case tokenIdent:
+		node.Name = t.scanner.string()
+	default:
+		return nil, badFunc("indirect", "'!'")
+	}
+
+	t.scanner.accept = acceptIdent
+	t.scanner.mode = scanIdent
+	switch t.scanner.scan() {
+	case tokenIdent:
+		node.Param = t.scanner.string()
+	default:
+		return nil, badFunc("indirect", "variable name")
+	}
+
+	switch t.scanner.peek() {
+	case '[':
+		return t.parseKeysFunc(node.Param)
+	case '*', '@':
+		t.scanner.accept = acceptOneStarOrAt
+		t.scanner.mode = scanIdent
+		t.scanner.scan()
+		node.Name += t.scanner.string()
+	}
+
+	return node, t.consumeRbrack("indirect")
+}
+
+// parseKeysFunc parses the ${!param[@]} and ${!param[*]} functions,
+// whose index must list all the keys of the variable.
+func (t *Tree) parseKeysFunc(name string) (Node, error) {
+	node, err := t.parseIndexFunc(name, "![")
+	if err != nil {
+		return nil, err
+	}
+	if text, ok := node.(*FuncNode).Args[0].(*TextNode); ok {
+		switch strings.TrimSpace(text.Value) {
+		case "@", "*":
+			return node, nil
+		}
+	}
+	return nil, badFunc("keys", "'@' or '*'")
 }
 
 // consumeRbrack consumes a right closing bracket. If a closing
-// bracket token is not consumed an ErrBadSubstitution is returned.
-func (t *Tree) consumeRbrack() error {
+// bracket token is not consumed an ErrFunc naming the function is
+// returned.
+func (t *Tree) consumeRbrack(fn string) error {
 	t.scanner.mode = scanRbrack
 	if t.scanner.scan() != tokenRbrack {
-		return ErrBadSubstitution
+		return badFunc(fn, t.closing())
 	}
 	return nil
 }
 
+// badFunc returns an ErrFunc describing what was expected by the
+// named kind of substitution function.
+func badFunc(fn, expected string) error {
+	return &ErrFunc{Func: fn, Expected: expected}
+}
+
+// closing describes the closing delimiter for use in errors.
+func (t *Tree) closing() string {
+	return "closing '" + t.scanner.rdelim + "'"
+}
+
 // consumeDelimiter consumes a function argument delimiter. If a
 // delimiter is not consumed an ErrBadSubstitution is returned.
 // func (t *Tree) consumeDelimiter(accept acceptFunc, mode uint) error {
@@ -1,9 +1,13 @@
 package parse
 
 import (
+	"bytes"
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 var tests = []struct {
@@ -34,6 +38,10 @@ var tests = []struct {
 		Text: "$$string",
 		Node: &TextNode{Value: "$string"}, // should not escape double dollar
 	},
+	{
+		Text: `\${string}`,
+		Node: &TextNode{Value: "${string}"}, // should not escape backslash dollar
+	},
 
 	//
 	// variable only
@@ -43,6 +51,191 @@ var tests = []struct {
 		Node: &FuncNode{Param: "string"},
 	},
 
+	{
+		Text: "${string^^[aeiou]}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "^^",
+			Args: []Node{
+				&TextNode{Value: "[aeiou]"},
+			},
+		},
+	},
+	{
+		Text: "${string,${pattern}}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ",",
+			Args: []Node{
+				&FuncNode{Param: "pattern"},
+			},
+		},
+	},
+	{
+		Text: "${string@U}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "@U",
+		},
+	},
+	{
+		Text: "${string@Q}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "@Q",
+		},
+	},
+	{
+		Text: "${string@b64d}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "@b64d",
+		},
+	},
+
+	//
+	// indirect expansion
+	//
+	{
+		Text: "${!string}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "!",
+		},
+	},
+
+	{
+		Text: "${!string*}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "!*",
+		},
+	},
+	{
+		Text: "${!string@}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "!@",
+		},
+	},
+
+	//
+	// bare variables
+	//
+	{
+		Text: "$string",
+		Node: &FuncNode{Param: "string"},
+	},
+	{
+		Text: "$HOME/bin",
+		Node: &ListNode{
+			Nodes: []Node{
+				&FuncNode{Param: "HOME"},
+				&TextNode{Value: "/bin"},
+			},
+		},
+	},
+	{
+		Text: "$",
+		Node: &TextNode{Value: "$"}, // lone dollar is literal
+	},
+	{
+		Text: "cost: $ 5",
+		Node: &TextNode{Value: "cost: $ 5"},
+	},
+	{
+		Text: "$1 $- $.",
+		Node: &TextNode{Value: "$1 $- $."}, // not a variable name
+	},
+	{
+		Text: "price$",
+		Node: &TextNode{Value: "price$"},
+	},
+	{
+		Text: "$HOST:${PORT}/path",
+		Node: &ListNode{
+			Nodes: []Node{
+				&FuncNode{Param: "HOST"},
+				&ListNode{
+					Nodes: []Node{
+						&TextNode{Value: ":"},
+						&ListNode{
+							Nodes: []Node{
+								&FuncNode{Param: "PORT"},
+								&TextNode{Value: "/path"},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		Text: "$A.$B",
+		Node: &ListNode{
+			Nodes: []Node{
+				&FuncNode{Param: "A"},
+				&ListNode{
+					Nodes: []Node{
+						&TextNode{Value: "."},
+						&FuncNode{Param: "B"},
+					},
+				},
+			},
+		},
+	},
+	{
+		Text: "$A/$B",
+		Node: &ListNode{
+			Nodes: []Node{
+				&FuncNode{Param: "A"},
+				&ListNode{
+					Nodes: []Node{
+						&TextNode{Value: "/"},
+						&FuncNode{Param: "B"},
+					},
+				},
+			},
+		},
+	},
+	{
+		Text: "$A-$B", // hyphen is not an identifier character
+		Node: &ListNode{
+			Nodes: []Node{
+				&FuncNode{Param: "A"},
+				&ListNode{
+					Nodes: []Node{
+						&TextNode{Value: "-"},
+						&FuncNode{Param: "B"},
+					},
+				},
+			},
+		},
+	},
+	{
+		Text: "$A_$B", // underscore is an identifier character
+		Node: &ListNode{
+			Nodes: []Node{
+				&FuncNode{Param: "A_"},
+				&FuncNode{Param: "B"},
+			},
+		},
+	},
+	{
+		Text: "text $A9 text",
+		Node: &ListNode{
+			Nodes: []Node{
+				&TextNode{Value: "text "},
+				&ListNode{
+					Nodes: []Node{
+						&FuncNode{Param: "A9"},
+						&TextNode{Value: " text"},
+					},
+				},
+			},
+		},
+	},
+
 	//
 	// text transform functions
 	//
@@ -78,6 +271,46 @@ var tests = []struct {
 			Args:  nil,
 		},
 	},
+	{
+		Text: "${string~}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "~",
+			Args:  nil,
+		},
+	},
+	{
+		Text: "${string|sha256}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "|",
+			Args: []Node{
+				&TextNode{Value: "sha256"},
+			},
+		},
+	},
+	{
+		Text: "${string|pad:10:$x}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "|",
+			Args: []Node{
+				&TextNode{Value: "pad"},
+				&TextNode{Value: "10"},
+				&FuncNode{Param: "x"},
+			},
+		},
+	},
+	{
+		Text: "${string~~[a-z]}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "~~",
+			Args: []Node{
+				&TextNode{Value: "[a-z]"},
+			},
+		},
+	},
 
 	//
 	// substring functions
@@ -173,6 +406,36 @@ var tests = []struct {
 			},
 		},
 	},
+	{
+		Text: "${string//substring}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "//",
+			Args: []Node{
+				&TextNode{Value: "substring"},
+			},
+		},
+	},
+	{
+		Text: "${string/}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "/",
+			Args: []Node{
+				&TextNode{Value: ""},
+			},
+		},
+	},
+	{
+		Text: "${string//}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "//",
+			Args: []Node{
+				&TextNode{Value: ""},
+			},
+		},
+	},
 	{
 		Text: "${string/#substring/replacement}",
 		Node: &FuncNode{
@@ -195,10 +458,51 @@ var tests = []struct {
 			},
 		},
 	},
+	{
+		Text: "${string/#substring/}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "/#",
+			Args: []Node{
+				&TextNode{Value: "substring"},
+			},
+		},
+	},
+	{
+		Text: "${string/%substring/}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "/%",
+			Args: []Node{
+				&TextNode{Value: "substring"},
+			},
+		},
+	},
 
 	//
 	// default value functions
 	//
+	{
+		Text: "${string:-$HOME/cache}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":-",
+			Args: []Node{
+				&FuncNode{Param: "HOME"},
+				&TextNode{Value: "/cache"},
+			},
+		},
+	},
+	{
+		Text: "${string:-$default}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":-",
+			Args: []Node{
+				&FuncNode{Param: "default"},
+			},
+		},
+	},
 	{
 		Text: "${string=default}",
 		Node: &FuncNode{
@@ -249,6 +553,17 @@ var tests = []struct {
 			},
 		},
 	},
+	{
+		Text: "${port:num:${default}0}",
+		Node: &FuncNode{
+			Param: "port",
+			Name:  ":num:",
+			Args: []Node{
+				&FuncNode{Param: "default"},
+				&TextNode{Value: "0"},
+			},
+		},
+	},
 
 	//
 	// length function
@@ -260,6 +575,19 @@ var tests = []struct {
 			Name:  "#",
 		},
 	},
+	{
+		Text: "${#${string%.*}}",
+		Node: &FuncNode{
+			Name: "#",
+			Args: []Node{
+				&FuncNode{
+					Param: "string",
+					Name:  "%",
+					Args:  []Node{&TextNode{Value: ".*"}},
+				},
+			},
+		},
+	},
 
 	//
 	// special characters in argument
@@ -360,6 +688,83 @@ var tests = []struct {
 		},
 	},
 
+	// array functions
+	{
+		Text: "${string[@]}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "[",
+			Args:  []Node{&TextNode{Value: "@"}},
+		},
+	},
+	{
+		Text: "${#string[*]}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "#[",
+			Args:  []Node{&TextNode{Value: "*"}},
+		},
+	},
+	{
+		Text: "${string[${i}]}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "[",
+			Args:  []Node{&FuncNode{Param: "i"}},
+		},
+	},
+	{
+		Text: "${!string[@]}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "![",
+			Args:  []Node{&TextNode{Value: "@"}},
+		},
+	},
+
+	// positional parameters
+	{
+		Text: "${@}",
+		Node: &FuncNode{Param: "@"},
+	},
+	{
+		Text: "${#*}",
+		Node: &FuncNode{Param: "*", Name: "#"},
+	},
+
+	// arithmetic expansion
+	{
+		Text: "$((PORT+1))",
+		Node: &ArithNode{
+			Args: []Node{&TextNode{Value: "PORT+1"}},
+		},
+	},
+	{
+		Text: "$(( (${a}*2) + $b ))x",
+		Node: &ListNode{
+			Nodes: []Node{
+				&ArithNode{
+					Args: []Node{
+						&TextNode{Value: " ("},
+						&FuncNode{Param: "a"},
+						&TextNode{Value: "*2) + "},
+						&FuncNode{Param: "b"},
+						&TextNode{Value: " "},
+					},
+				},
+				&TextNode{Value: "x"},
+			},
+		},
+	},
+	{
+		Text: "$(($((1))))",
+		Node: &ArithNode{
+			Args: []Node{
+				&ArithNode{Args: []Node{&TextNode{Value: "1"}}},
+			},
+		},
+	},
+
 	// functions in functions
 	{
 		Text: "${string:${position}}",
@@ -373,6 +778,17 @@ var tests = []struct {
 			},
 		},
 	},
+	{
+		Text: "${string:$position:$length}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":",
+			Args: []Node{
+				&FuncNode{Param: "position"},
+				&FuncNode{Param: "length"},
+			},
+		},
+	},
 	{
 		Text: "${string:${stringy:position:length}:${stringz,,}}",
 		Node: &FuncNode{
@@ -404,6 +820,36 @@ var tests = []struct {
 			},
 		},
 	},
+	{
+		Text: "${string-default}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "-",
+			Args: []Node{
+				&TextNode{Value: "default"},
+			},
+		},
+	},
+	{
+		Text: "${string+alternate}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "+",
+			Args: []Node{
+				&TextNode{Value: "alternate"},
+			},
+		},
+	},
+	{
+		Text: "${string?message}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "?",
+			Args: []Node{
+				&TextNode{Value: "message"},
+			},
+		},
+	},
 	{
 		Text: "${string=${stringz}}",
 		Node: &FuncNode{
@@ -460,6 +906,28 @@ var tests = []struct {
 			},
 		},
 	},
+	{
+		Text: "${string:-http://host:8080/a?b=c#d%20}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":-",
+			Args: []Node{
+				&TextNode{Value: "http://host:8080/a?b=c#d%20"},
+			},
+		},
+	},
+	{
+		Text: "${string-a:b ${var}:/#%}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "-",
+			Args: []Node{
+				&TextNode{Value: "a:b "},
+				&FuncNode{Param: "var"},
+				&TextNode{Value: ":/#%"},
+			},
+		},
+	},
 	{
 		Text: "${string//${stringy}/${stringz}}",
 		Node: &FuncNode{
@@ -481,8 +949,598 @@ func TestParse(t *testing.T) {
 			t.Error(err)
 		}
 
-		if diff := cmp.Diff(test.Node, got.Root); diff != "" {
+		if diff := cmp.Diff(test.Node, got.Root, ignorePos); diff != "" {
+			t.Errorf(diff)
+		}
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	for _, text := range []string{"", "\n", " \t"} {
+		tree, err := Parse(text)
+		if err != nil {
+			t.Errorf("Want %q parsed, got %v", text, err)
+			continue
+		}
+		if tree.Root == nil {
+			t.Errorf("Want %q parsed to a root node, got nil", text)
+			continue
+		}
+		if got := tree.Root.String(); got != text {
+			t.Errorf("Want %q written as is, got %q", text, got)
+		}
+	}
+}
+
+func TestTreeReset(t *testing.T) {
+	tree := new(Tree)
+	for _, test := range tests {
+		want, err := Parse(test.Text)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		got, err := tree.Reset().Parse(test.Text)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got != tree {
+			t.Errorf("Want Parse to reuse the tree")
+		}
+		if diff := cmp.Diff(want.Root, got.Root); diff != "" {
+			t.Errorf("Want reused tree to parse %q as a new tree: %s", test.Text, diff)
+		}
+	}
+
+	// the options are kept and the root is cleared
+	tree = new(Tree).Delims("%%", "%%")
+	tree.Strict = true
+	if _, err := tree.Parse("%%HOST%%"); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Reset(); tree.Root != nil {
+		t.Errorf("Want Reset to clear the root")
+	}
+	if _, err := tree.Parse("%%PORT%%}"); !errors.Is(err, ErrUnexpectedBrace) {
+		t.Errorf("Want Reset to keep the strict option, got %v", err)
+	}
+	if _, err := tree.Parse("%%PORT%%"); err != nil || tree.Root.String() != "${PORT}" {
+		t.Errorf("Want Reset to keep the delimiters, got %v, %v", tree.Root, err)
+	}
+}
+
+func TestParseWithDelims(t *testing.T) {
+	var tests = []struct {
+		Text        string
+		Left, Right string
+		Node        Node
+	}{
+		{
+			Text: "host=%%HOST%%", Left: "%%", Right: "%%",
+			Node: &ListNode{
+				Nodes: []Node{
+					&TextNode{Value: "host="},
+					&FuncNode{Param: "HOST"},
+				},
+			},
+		},
+		{
+			Text: "%%HOST:-localhost%% $HOME ${HOME}", Left: "%%", Right: "%%",
+			Node: &ListNode{
+				Nodes: []Node{
+					&FuncNode{
+						Param: "HOST",
+						Name:  ":-",
+						Args:  []Node{&TextNode{Value: "localhost"}},
+					},
+					&TextNode{Value: " $HOME ${HOME}"},
+				},
+			},
+		},
+		{
+			Text: "%%%HOST%%%", Left: "%%", Right: "%%",
+			Node: &TextNode{Value: "%%HOST%%"},
+		},
+		{
+			Text: "{{name%.txt}}", Left: "{{", Right: "}}",
+			Node: &FuncNode{
+				Param: "name",
+				Name:  "%",
+				Args:  []Node{&TextNode{Value: ".txt"}},
+			},
+		},
+		{
+			Text: "{{a:-{{b}}}}", Left: "{{", Right: "}}",
+			Node: &FuncNode{
+				Param: "a",
+				Name:  ":-",
+				Args:  []Node{&FuncNode{Param: "b"}},
+			},
+		},
+		{
+			Text: "${a}", Left: "${", Right: "}",
+			Node: &FuncNode{Param: "a"},
+		},
+	}
+	for _, test := range tests {
+		got, err := ParseWithDelims(test.Text, test.Left, test.Right)
+		if err != nil {
+			t.Errorf("%q: %s", test.Text, err)
+			continue
+		}
+		if diff := cmp.Diff(test.Node, got.Root, ignorePos); diff != "" {
 			t.Errorf(diff)
 		}
 	}
+
+	if _, err := ParseWithDelims("%%HOST", "%%", "%%"); !errors.Is(err, ErrBadSubstitution) {
+		t.Errorf("Want unclosed substitution to return ErrBadSubstitution, got %v", err)
+	}
+}
+
+func TestNodeString(t *testing.T) {
+	for _, test := range tests {
+		text := test.Node.String()
+		got, err := Parse(text)
+		if err != nil {
+			t.Errorf("%q: %s", text, err)
+			continue
+		}
+		if diff := cmp.Diff(test.Node, got.Root, ignorePos); diff != "" {
+			t.Errorf("%q: %s", text, diff)
+		}
+	}
+
+	var texts = []struct {
+		Text string
+		Want string
+	}{
+		{"$var text", "${var} text"},
+		{"$$ and $${x}", "$$ and $${x}"},
+		{`\${x}`, `\${x}`},
+		{"$ and $", "$ and $"},
+		{"${a}$$${b}", "${a}$$${b}"},
+		{`${a/\\/\\}`, `${a/\\/\\}`},
+		{`${a/x\\\\y/}`, `${a/x\\\\y/}`},
+		{`${a//x/y\/z}`, `${a//x/y\/z}`},
+		{"${a/} ${a//} ${a/#}", "${a/} ${a//} ${a/#}"},
+		{"${a:-$$b}", "${a:-$${b}}"},
+		{"${a:1:2} ${#b} ${!c} ${!d@} ${e@Q}", "${a:1:2} ${#b} ${!c} ${!d@} ${e@Q}"},
+		{"${a:-${b,,}x}", "${a:-${b,,}x}"},
+	}
+	for _, test := range texts {
+		tree, err := Parse(test.Text)
+		if err != nil {
+			t.Errorf("%q: %s", test.Text, err)
+			continue
+		}
+		if got := tree.Root.String(); got != test.Want {
+			t.Errorf("Want %q string %q, got %q", test.Text, test.Want, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	var tests = []string{
+		"${string[@}",
+		"${string[@]",
+		"${string[]}",
+		"$((1+2)",
+		"$((1+2) )",
+		"${string@}",
+		"${string@X}",
+		"${string@UL}",
+		"${string@U",
+	}
+	for _, text := range tests {
+		if _, err := Parse(text); !errors.Is(err, ErrBadSubstitution) {
+			t.Errorf("Want %q to return ErrBadSubstitution, got %v", text, err)
+		}
+	}
+}
+
+func TestParseStrict(t *testing.T) {
+	var valid = []string{
+		"${a}",
+		`{"name": "${a}"}`,
+		"{{${a}}}",
+		"$${a}",
+	}
+	for _, text := range valid {
+		tree := &Tree{Strict: true}
+		if _, err := tree.Parse(text); err != nil {
+			t.Errorf("Want %q parsed in strict mode, got %v", text, err)
+		}
+	}
+
+	var tests = []struct {
+		text string
+		pos  Pos
+	}{
+		{"${a}}", Pos{1, 5}},
+		{"}text", Pos{1, 1}},
+		{"line one\n  {${a}}}", Pos{2, 9}},
+	}
+	for _, test := range tests {
+		tree := &Tree{Strict: true}
+		_, err := tree.Parse(test.text)
+		perr, ok := err.(*ErrParse)
+		if !ok || !errors.Is(err, ErrUnexpectedBrace) {
+			t.Errorf("Want %q to return ErrUnexpectedBrace, got %v", test.text, err)
+			continue
+		}
+		if perr.Pos != test.pos {
+			t.Errorf("Want %q error at %v, got %v", test.text, test.pos, perr.Pos)
+		}
+
+		// lenient mode takes the brace literally
+		if _, err := Parse(test.text); err != nil {
+			t.Errorf("Want %q parsed in lenient mode, got %v", test.text, err)
+		}
+	}
+}
+
+func TestParseLiteralDoubleDollar(t *testing.T) {
+	tree := &Tree{LiteralDoubleDollar: true}
+	got, err := tree.Parse("pid $$ $${a}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ListNode{
+		Nodes: []Node{
+			&TextNode{Value: "pid $$ $"},
+			&FuncNode{Param: "a"},
+		},
+	}
+	if diff := cmp.Diff(want, got.Root, ignorePos); diff != "" {
+		t.Errorf("Want $$ taken literally: %s", diff)
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	tree := &Tree{Line: 5}
+	got, err := tree.Parse("a\n${b}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos := got.Root.(*ListNode).Nodes[1].(*FuncNode).Pos; pos != (Pos{Line: 6, Col: 1}) {
+		t.Errorf("Want the node at 6:1, got %d:%d", pos.Line, pos.Col)
+	}
+
+	_, err = tree.Parse("x\ny\n${b:}")
+	var perr *ErrParse
+	if !errors.As(err, &perr) || perr.Pos.Line != 7 {
+		t.Errorf("Want the error on line 7, got %v", err)
+	}
+}
+
+func TestParseDirectives(t *testing.T) {
+	text := "a=${a}\n# envsubst:off\nb=${b}\n# envsubst:on\nc=${c}"
+
+	tree := &Tree{Directives: true}
+	got, err := tree.Parse(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ListNode{Nodes: []Node{
+		&ListNode{Nodes: []Node{
+			&TextNode{Value: "a="},
+			&ListNode{Nodes: []Node{
+				&FuncNode{Param: "a"},
+				&TextNode{Value: "\n"},
+			}},
+		}},
+		&TextNode{Value: "# envsubst:off\nb=${b}\n# envsubst:on\n"},
+		&ListNode{Nodes: []Node{
+			&TextNode{Value: "c="},
+			&FuncNode{Param: "c"},
+		}},
+	}}
+	if diff := cmp.Diff(want, got.Root, ignorePos); diff != "" {
+		t.Errorf(diff)
+	}
+
+	var tests = []struct {
+		text  string
+		strip bool
+		want  string
+	}{
+		{text, true, "b=${b}\n"},
+		{"# envsubst:off\n${a}", false, "# envsubst:off\n${a}"},
+		{"# envsubst:off\n${a}", true, "${a}"},
+		{"// envsubst:off\n${a}\n// envsubst:on", true, "${a}\n"},
+	}
+	for _, test := range tests {
+		tree := &Tree{Directives: true, StripDirectives: test.strip}
+		got, err := tree.Parse(test.text)
+		if err != nil {
+			t.Errorf("Want %q parsed, got %v", test.text, err)
+			continue
+		}
+		var literal []string
+		Walk(got.Root, func(n Node) bool {
+			if text, ok := n.(*TextNode); ok && strings.Contains(text.Value, "${") {
+				literal = append(literal, text.Value)
+			}
+			return true
+		})
+		if len(literal) != 1 || literal[0] != test.want {
+			t.Errorf("Want %q to take %q literally, got %q", test.text, test.want, literal)
+		}
+	}
+
+	// positions after a literal region are relative to the start
+	// of the template.
+	_, err = (&Tree{Directives: true}).Parse("#envsubst:off\n${\n#envsubst:on\n${a b}")
+	perr, ok := err.(*ErrParse)
+	if !ok || perr.Pos != (Pos{4, 4}) {
+		t.Errorf("Want error at 4:4, got %v", err)
+	}
+
+	// without directives the markers are ordinary text.
+	if got, err := Parse("# envsubst:off\n${a}"); err != nil || len(got.Root.(*ListNode).Nodes) != 2 {
+		t.Errorf("Want markers ignored by default, got %v, %v", got.Root, err)
+	}
+}
+
+func TestParseErrorPos(t *testing.T) {
+	var tests = []struct {
+		text string
+		pos  Pos
+	}{
+		{"${a b}", Pos{1, 4}},
+		{"${a} ${b} ${c d}", Pos{1, 14}},
+		{"line one\nline ${two", Pos{2, 11}},
+		{"${a}\n${b}\n  ${c@X}", Pos{3, 6}},
+		{"héllo ${wörld!}", Pos{1, 14}},
+		{"$$$$ ${a b}", Pos{1, 9}},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.text)
+		perr, ok := err.(*ErrParse)
+		if !ok {
+			t.Errorf("Want %q to return ErrParse, got %v", test.text, err)
+			continue
+		}
+		if perr.Pos != test.pos {
+			t.Errorf("Want %q error at %v, got %v", test.text, test.pos, perr.Pos)
+		}
+	}
+}
+
+// ignorePos ignores node positions and source text when comparing
+// trees, which are instead covered by TestParsePos and TestParseSource.
+var ignorePos = cmp.Options{
+	cmpopts.IgnoreFields(TextNode{}, "Source"),
+	cmpopts.IgnoreFields(FuncNode{}, "Pos", "Source"),
+	cmpopts.IgnoreFields(ArithNode{}, "Pos", "Source"),
+}
+
+func TestErrParsePretty(t *testing.T) {
+	var tests = []struct {
+		text string
+		want string
+	}{
+		{
+			text: "name: app\nport: ${PORT:}\n",
+			want: "2:14: bad substitution: expected argument in substring expression near \"t: ${PORT:}\\n\"\n" +
+				"    port: ${PORT:}\n" +
+				"                 ^",
+		},
+		{
+			text: "\tx=${}\r\n",
+			want: "1:6: bad substitution: expected variable name in parameter expression near \"\\tx=${}\\r\\n\"\n" +
+				"    \tx=${}\n" +
+				"    \t    ^",
+		},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.text)
+		perr, ok := err.(*ErrParse)
+		if !ok {
+			t.Errorf("Want %q to return *ErrParse, got %v", test.text, err)
+			continue
+		}
+		if got := perr.Pretty(); got != test.want {
+			t.Errorf("Want %q reported as\n%s\ngot\n%s", test.text, test.want, got)
+		}
+	}
+
+	// without the line, the error is reported as usual.
+	err := &ErrParse{Err: ErrBadSubstitution, Pos: Pos{1, 1}, Context: "${"}
+	if got, want := err.Pretty(), err.Error(); got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
+
+func TestParsePos(t *testing.T) {
+	got, err := Parse("a ${b}\nc $d ${e:-${f}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var positions []Pos
+	var walk func(Node)
+	walk = func(node Node) {
+		switch node := node.(type) {
+		case *ListNode:
+			for _, n := range node.Nodes {
+				walk(n)
+			}
+		case *FuncNode:
+			positions = append(positions, node.Pos)
+			for _, n := range node.Args {
+				walk(n)
+			}
+		}
+	}
+	walk(got.Root)
+
+	want := []Pos{{1, 3}, {2, 3}, {2, 6}, {2, 11}}
+	if diff := cmp.Diff(want, positions); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	tree, err := Parse("a $b ${c:-${d}} ${e//x/y}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	Walk(tree.Root, func(node Node) bool {
+		if fn, ok := node.(*FuncNode); ok {
+			got = append(got, fn.Source)
+			return false
+		}
+		return true
+	})
+	want := []string{"$b", "${c:-${d}}", "${e//x/y}"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	tree, err := Parse("a ${b:-${c}} $((d+${e})) ${f}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	Walk(tree.Root, func(node Node) bool {
+		switch node := node.(type) {
+		case *TextNode:
+			got = append(got, "text "+node.Value)
+		case *FuncNode:
+			got = append(got, "func "+node.Param)
+			return node.Param != "f"
+		case *ArithNode:
+			got = append(got, "arith")
+		}
+		return true
+	})
+	want := []string{
+		"text a ",
+		"func b",
+		"func c",
+		"text  ",
+		"arith",
+		"text d+",
+		"func e",
+		"text  ",
+		"func f",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf(diff)
+	}
+
+	// stop descending into the arguments of b
+	got = nil
+	Walk(tree.Root, func(node Node) bool {
+		if fn, ok := node.(*FuncNode); ok {
+			got = append(got, fn.Param)
+			return fn.Param != "b"
+		}
+		return true
+	})
+	if diff := cmp.Diff([]string{"b", "e", "f"}, got); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	var buf bytes.Buffer
+	Debug = &buf
+	defer func() { Debug = nil }()
+
+	if _, err := Parse("text ${var:-default}"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`1:1: ident "text "`,
+		`1:6: lbrack "${"`,
+		`function "var" operator ':'`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Want debug output to contain %q, got %q", want, buf.String())
+		}
+	}
+}
+
+func TestParseManyEscapes(t *testing.T) {
+	text := strings.Repeat("$$", 1000) + strings.Repeat(`${a//\//-}`, 1000)
+	got, err := Parse(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := got.Root.(*ListNode).Nodes[0]
+	if diff := cmp.Diff(&TextNode{Value: strings.Repeat("$", 1000)}, first, ignorePos); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func BenchmarkParseEscapes(b *testing.B) {
+	text := strings.Repeat("$${a} ", 5000) + strings.Repeat(`${a//\//-}`, 5000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(text); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseParallel(b *testing.B) {
+	text := "server ${HOST}:${PORT:-8080} path=${PREFIX//\\//-}/static"
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := Parse(text); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestParseErrFunc(t *testing.T) {
+	var tests = []struct {
+		text     string
+		fn       string
+		expected string
+	}{
+		{"${a/b", "replace", "second '/' or closing '}'"},
+		{"${a:1:2", "substring", "closing '}'"},
+		{"${a::2}", "substring", "argument"},
+		{"${a#x", "removal", "closing '}'"},
+		{"${a^^x", "casing", "closing '}'"},
+		{"${a,^}", "casing", "'^', ',' or '~'"},
+		{"${a~^x}", "casing", "'^', ',' or '~'"},
+		{"${a:-x", "default", "closing '}'"},
+		{"${a|}", "function", "function name"},
+		{"${a|b:c", "function", "closing '}'"},
+		{"${a@X}", "transform", "operator U, L, u, Q, E, b64, b64d, url or urld"},
+		{"${#}", "length", "variable name"},
+		{"${#${a}", "length", "closing '}'"},
+		{"${a[1}", "index", "']'"},
+		{"${!}", "indirect", "variable name"},
+		{"${!a[0]}", "keys", "'@' or '*'"},
+		{"${a b}", "parameter", "operator or closing '}'"},
+		{"$((1+2)", "arithmetic", "closing '))'"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.text)
+		var ferr *ErrFunc
+		if !errors.As(err, &ferr) || !errors.Is(err, ErrBadSubstitution) {
+			t.Errorf("Want %q to return ErrFunc, got %v", test.text, err)
+			continue
+		}
+		if ferr.Func != test.fn || ferr.Expected != test.expected {
+			t.Errorf("Want %q to expect %s in %s, got %s in %s", test.text, test.expected, test.fn, ferr.Expected, ferr.Func)
+		}
+	}
+
+	_, err := Parse("line\n${a/b")
+	if want := `2:6: bad substitution: expected second '/' or closing '}' in replace expression near "line\n${a/b"`; err == nil || err.Error() != want {
+		t.Errorf("Want error %q, got %v", want, err)
+	}
 }
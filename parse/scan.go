@@ -1,6 +1,8 @@
 package parse
 
 import (
+	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf8"
 )
@@ -24,14 +26,46 @@ const (
 	tokenLbrack
 	tokenRbrack
 	tokenQuote
+	tokenVar
+	tokenArith
 )
 
+func (t token) String() string {
+	switch t {
+	case tokenEOF:
+		return "eof"
+	case tokenIdent:
+		return "ident"
+	case tokenLbrack:
+		return "lbrack"
+	case tokenRbrack:
+		return "rbrack"
+	case tokenQuote:
+		return "quote"
+	case tokenVar:
+		return "var"
+	case tokenArith:
+		return "arith"
+	default:
+		return "illegal"
+	}
+}
+
 // predefined mode bits to control recognition of tokens.
 const (
 	scanIdent byte = 1 << iota
 	scanLbrack
 	scanRbrack
 	scanEscape
+	scanVar
+	scanClose
+	scanArith
+)
+
+// default delimiters of a substitution.
+const (
+	leftDelim  = "${"
+	rightDelim = "}"
 )
 
 // returns true if rune is accepted.
@@ -43,44 +77,134 @@ type scanner struct {
 	buf   string
 	pos   int
 	start int
-	width int
+	atEOF bool // last read returned eof
 	mode  byte
 
 	accept acceptFunc
+
+	// delimiters of a substitution.
+	ldelim string
+	rdelim string
+
+	// if true, $$ is not an escape.
+	literalDollar bool
+
+	// the line number of the first line of the buffer, if not 1.
+	firstLine int
+
+	// the unescaped text of the current token, which is
+	// only used once the token contains an escape.
+	text    strings.Builder
+	escaped bool
+	mark    int
+
+	// caches the most recently computed position.
+	last    int
+	lastPos Pos
+}
+
+// scanners holds scanners for reuse, so that parsing many small
+// templates does not allocate a scanner for each one.
+var scanners = sync.Pool{
+	New: func() interface{} { return new(scanner) },
 }
 
-// init initializes a scanner with a new buffer.
-func (s *scanner) init(buf string) {
+// init initializes a scanner with a new buffer and the
+// substitution delimiters, which default to ${ and }.
+func (s *scanner) init(buf, ldelim, rdelim string) {
+	if ldelim == "" {
+		ldelim = leftDelim
+	}
+	if rdelim == "" {
+		rdelim = rightDelim
+	}
 	s.buf = buf
+	s.ldelim = ldelim
+	s.rdelim = rdelim
 	s.pos = 0
 	s.start = 0
-	s.width = 0
+	s.atEOF = false
+	s.mode = 0
 	s.accept = nil
+	s.text.Reset()
+	s.escaped = false
+	s.mark = 0
+	s.last = 0
+	s.lastPos = s.firstPos()
+}
+
+// release returns the scanner to the pool. The buffer is dropped so
+// the pool does not retain the parsed string.
+func (s *scanner) release() {
+	s.buf = ""
+	s.accept = nil
+	s.text.Reset()
+	scanners.Put(s)
 }
 
 // read returns the next unicode character. It returns eof at
 // the end of the string buffer.
 func (s *scanner) read() rune {
 	if s.pos >= len(s.buf) {
-		s.width = 0
+		s.atEOF = true
 		return eof
 	}
 	r, w := utf8.DecodeRuneInString(s.buf[s.pos:])
-	s.width = w
-	s.pos += s.width
+	s.atEOF = false
+	s.pos += w
 	return r
 }
 
+// unread steps back over the most recently read unicode character,
+// or does nothing if the last read returned eof. The width of the
+// character is decoded from the buffer rather than remembered, so
+// the position remains exact under any sequence of read, unread and
+// peek.
 func (s *scanner) unread() {
-	s.pos -= s.width
+	if s.atEOF {
+		s.atEOF = false
+		return
+	}
+	_, w := utf8.DecodeLastRuneInString(s.buf[:s.pos])
+	s.pos -= w
+}
+
+// escape drops the escape character that was just read from the
+// current token and consumes the escaped character that follows
+// it. The unescaped token text is accumulated separately so the
+// buffer itself is never modified.
+func (s *scanner) escape() {
+	if !s.escaped {
+		s.escaped = true
+		s.text.Reset()
+		s.mark = s.start
+	}
+	s.text.WriteString(s.buf[s.mark : s.pos-1])
+	s.mark = s.pos
+	if s.ldelim != leftDelim && strings.HasPrefix(s.buf[s.pos:], s.ldelim) {
+		s.pos += len(s.ldelim)
+		return
+	}
+	s.read()
+}
+
+// prev returns the byte offset of the most recently read unicode
+// character.
+func (s *scanner) prev() int {
+	_, w := utf8.DecodeLastRuneInString(s.buf[:s.pos])
+	return s.pos - w
+}
+
+// atOpen returns true if the scanner is positioned at the opening
+// delimiter.
+func (s *scanner) atOpen() bool {
+	return strings.HasPrefix(s.buf[s.pos:], s.ldelim)
 }
 
-// skip skips over the curring unicode character in the buffer
-// by slicing and removing from the buffer.
-func (s *scanner) skip() {
-	l := s.buf[:s.pos-1]
-	r := s.buf[s.pos:]
-	s.buf = l + r
+// atClose returns true if the scanner is positioned at the closing
+// delimiter.
+func (s *scanner) atClose() bool {
+	return strings.HasPrefix(s.buf[s.pos:], s.rdelim)
 }
 
 // peek returns the next unicode character in the buffer without
@@ -92,16 +216,100 @@ func (s *scanner) peek() rune {
 	return r
 }
 
+// firstPos returns the position of the start of the buffer.
+func (s *scanner) firstPos() Pos {
+	if s.firstLine > 0 {
+		return Pos{Line: s.firstLine, Col: 1}
+	}
+	return Pos{Line: 1, Col: 1}
+}
+
+// position returns the line and column of the byte offset in the
+// buffer. The position is derived from the offset rather than being
+// tracked while reading, so it is not affected by read and unread.
+func (s *scanner) position(off int) Pos {
+	if off < s.last {
+		s.last = 0
+		s.lastPos = s.firstPos()
+	}
+	pos := s.lastPos
+	for _, r := range s.buf[s.last:off] {
+		if r == '\n' {
+			pos.Line++
+			pos.Col = 1
+		} else {
+			pos.Col++
+		}
+	}
+	s.last = off
+	s.lastPos = pos
+	return pos
+}
+
+// line returns the line of the buffer containing the start of the
+// most recently scanned token, without its line terminator.
+func (s *scanner) line() string {
+	start := strings.LastIndexByte(s.buf[:s.start], '\n') + 1
+	end := len(s.buf)
+	if i := strings.IndexByte(s.buf[s.start:], '\n'); i >= 0 {
+		end = s.start + i
+	}
+	return strings.TrimSuffix(s.buf[start:end], "\r")
+}
+
+// context returns the source text surrounding the start of the
+// most recently scanned token, for use in error messages.
+func (s *scanner) context() string {
+	start := s.start - 10
+	if start < 0 {
+		start = 0
+	}
+	end := s.start + 10
+	if end > len(s.buf) {
+		end = len(s.buf)
+	}
+	// avoid splitting a multi-byte character
+	for start > 0 && !utf8.RuneStart(s.buf[start]) {
+		start--
+	}
+	for end < len(s.buf) && !utf8.RuneStart(s.buf[end]) {
+		end++
+	}
+	return s.buf[start:end]
+}
+
 // string returns the string corresponding to the most recently
-// scanned token. Valid after calling scan().
+// scanned token, with any escape characters removed. Valid after
+// calling scan().
 func (s *scanner) string() string {
+	if s.escaped {
+		return s.text.String() + s.buf[s.mark:s.pos]
+	}
+	return s.buf[s.start:s.pos]
+}
+
+// source returns the most recently scanned token exactly as it
+// appears in the buffer, including any escape characters.
+func (s *scanner) source() string {
 	return s.buf[s.start:s.pos]
 }
 
 // scan reads the next token or Unicode character from source and
 // returns it. It returns EOF at the end of the source.
 func (s *scanner) scan() token {
+	tok := s.next()
+	if Debug != nil {
+		pos := s.position(s.start)
+		debugf("%d:%d: %s %q", pos.Line, pos.Col, tok, s.string())
+	}
+	return tok
+}
+
+// next reads the next token or Unicode character from source and
+// returns it.
+func (s *scanner) next() token {
 	s.start = s.pos
+	s.escaped = false
 	r := s.read()
 	switch {
 	case r == eof:
@@ -110,6 +318,10 @@ func (s *scanner) scan() token {
 		return tokenLbrack
 	case s.scanRbrack(r):
 		return tokenRbrack
+	case s.scanArith(r):
+		return tokenArith
+	case s.scanVar(r):
+		return tokenVar
 	case s.scanIdent(r):
 		return tokenIdent
 	}
@@ -122,25 +334,28 @@ func (s *scanner) scanIdent(r rune) bool {
 	if s.mode&scanIdent == 0 {
 		return false
 	}
+	if s.scanClose(r) {
+		return false
+	}
 	if s.scanEscaped(r) {
-		s.skip()
+		s.escape()
 	} else if !s.accept(r, s.pos-s.start) {
 		return false
 	}
 loop:
 	for {
+		mark := s.pos
 		r := s.read()
 		switch {
 		case r == eof:
 			s.unread()
 			break loop
-		case s.scanLbrack(r):
-			s.unread()
-			s.unread()
+		case s.scanLbrack(r), s.scanArith(r), s.scanVar(r), s.scanClose(r):
+			s.pos = mark
 			break loop
 		}
 		if s.scanEscaped(r) {
-			s.skip()
+			s.escape()
 			continue
 		}
 		if !s.accept(r, s.pos-s.start) {
@@ -154,14 +369,38 @@ loop:
 // scanLbrack reads the next token or Unicode character from source
 // and returns true if the open bracket is encountered.
 func (s *scanner) scanLbrack(r rune) bool {
-	if s.mode&scanLbrack == 0 {
+	if s.mode&scanLbrack == 0 || s.scanEscaped(r) {
 		return false
 	}
-	if r == '$' {
-		if s.read() == '{' {
-			return true
-		}
-		s.unread()
+	if start := s.prev(); strings.HasPrefix(s.buf[start:], s.ldelim) {
+		s.pos = start + len(s.ldelim)
+		return true
+	}
+	return false
+}
+
+// scanVar reads the next token or Unicode character from source
+// and returns true if the dollar sign of a bare $name variable is
+// encountered. The variable name itself is not consumed. Bare
+// variables are only recognized with the default delimiters.
+func (s *scanner) scanVar(r rune) bool {
+	if s.mode&scanVar == 0 || s.ldelim != leftDelim {
+		return false
+	}
+	return r == '$' && acceptVarName(s.peek(), 1)
+}
+
+// scanArith reads the next token or Unicode character from source
+// and returns true if the opening $(( of an arithmetic expansion is
+// encountered. Arithmetic is only recognized with the default
+// delimiters.
+func (s *scanner) scanArith(r rune) bool {
+	if s.mode&scanArith == 0 || s.ldelim != leftDelim {
+		return false
+	}
+	if r == '$' && strings.HasPrefix(s.buf[s.pos:], "((") {
+		s.pos += 2
+		return true
 	}
 	return false
 }
@@ -172,16 +411,40 @@ func (s *scanner) scanRbrack(r rune) bool {
 	if s.mode&scanRbrack == 0 {
 		return false
 	}
-	return r == '}'
+	if start := s.prev(); strings.HasPrefix(s.buf[start:], s.rdelim) {
+		s.pos = start + len(s.rdelim)
+		return true
+	}
+	return false
+}
+
+// scanClose reads the next token or Unicode character from source
+// and returns true if the closing delimiter is encountered. The
+// delimiter itself is not consumed.
+func (s *scanner) scanClose(r rune) bool {
+	if s.mode&scanClose == 0 {
+		return false
+	}
+	return strings.HasPrefix(s.buf[s.prev():], s.rdelim)
 }
 
 // scanEscaped reads the next token or Unicode character from source
-// and returns true if it being escaped and should be sipped.
+// and returns true if it being escaped and should be sipped. The
+// escapes are $$, \$, \/ and \\, where a custom left delimiter is
+// escaped by doubling its first character or by a backslash. $$ is
+// not an escape if literalDollar is set.
 func (s *scanner) scanEscaped(r rune) bool {
 	if s.mode&scanEscape == 0 {
 		return false
 	}
-	if r == '$' {
+	if s.ldelim != leftDelim {
+		// a custom left delimiter is escaped by doubling its
+		// first character.
+		first, _ := utf8.DecodeRuneInString(s.ldelim)
+		if r == first && strings.HasPrefix(s.buf[s.pos:], s.ldelim) {
+			return true
+		}
+	} else if r == '$' && !s.literalDollar {
 		if s.peek() == '$' {
 			return true
 		}
@@ -193,7 +456,12 @@ func (s *scanner) scanEscaped(r rune) bool {
 	case '/', '\\':
 		return true
 	default:
-		return false
+		// a backslash also escapes the left delimiter, so \${var}
+		// is the literal text ${var}.
+		if s.ldelim != leftDelim {
+			return strings.HasPrefix(s.buf[s.pos:], s.ldelim)
+		}
+		return s.peek() == '$'
 	}
 }
 
@@ -209,6 +477,19 @@ func acceptIdent(r rune, i int) bool {
 	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
 }
 
+// acceptVarName accepts the runes of a bare variable name, which
+// must match [A-Za-z_][A-Za-z0-9_]*.
+func acceptVarName(r rune, i int) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		return true
+	case r >= '0' && r <= '9':
+		return i > 1
+	default:
+		return false
+	}
+}
+
 func acceptColon(r rune, i int) bool {
 	return r == ':'
 }
@@ -217,6 +498,14 @@ func acceptOneHash(r rune, i int) bool {
 	return r == '#' && i == 1
 }
 
+func acceptOneBang(r rune, i int) bool {
+	return r == '!' && i == 1
+}
+
+func acceptOneStarOrAt(r rune, i int) bool {
+	return (r == '*' || r == '@') && i == 1
+}
+
 func acceptNone(r rune, i int) bool {
 	return false
 }
@@ -255,8 +544,19 @@ func acceptReplaceFunc(r rune, i int) bool {
 	}
 }
 
-func acceptOneEqual(r rune, i int) bool {
-	return i == 1 && r == '='
+func acceptOnePipe(r rune, i int) bool {
+	return i == 1 && r == '|'
+}
+
+func acceptOneDefault(r rune, i int) bool {
+	return i == 1 && (r == '=' || r == '-' || r == '?' || r == '+')
+}
+
+// numFunc is the operator of the ${param:num:word} function.
+const numFunc = ":num:"
+
+func acceptNumFunc(r rune, i int) bool {
+	return i <= len(numFunc) && r == rune(numFunc[i-1])
 }
 
 func acceptOneColon(r rune, i int) bool {
@@ -267,6 +567,18 @@ func rejectColonClose(r rune, i int) bool {
 	return r != ':' && r != '}'
 }
 
+func acceptOneLsquare(r rune, i int) bool {
+	return i == 1 && r == '['
+}
+
+func acceptOneRsquare(r rune, i int) bool {
+	return i == 1 && r == ']'
+}
+
+func rejectRsquareClose(r rune, i int) bool {
+	return r != ']' && r != '}'
+}
+
 func acceptSlash(r rune, i int) bool {
 	return r == '/'
 }
@@ -276,5 +588,14 @@ func acceptNotSlash(r rune, i int) bool {
 }
 
 func acceptCasingFunc(r rune, i int) bool {
-	return (r == ',' || r == '^') && i < 3
+	return (r == ',' || r == '^' || r == '~') && i < 3
+}
+
+func acceptTransformFunc(r rune, i int) bool {
+	switch {
+	case i == 1:
+		return r == '@'
+	default:
+		return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))
+	}
 }
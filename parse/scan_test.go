@@ -1 +1,61 @@
 package parse
+
+import "testing"
+
+func TestScannerUnread(t *testing.T) {
+	s := new(scanner)
+	s.init("aé\n😀\n\nb", "", "")
+
+	var tests = []struct {
+		op   func()
+		pos  int
+		line int
+	}{
+		{func() { s.read() }, 1, 1},
+		{func() { s.read() }, 3, 1},
+		{func() { s.peek() }, 3, 1},
+		{func() { s.read(); s.read() }, 8, 2},
+		{func() { s.peek(); s.peek() }, 8, 2},
+		{func() { s.unread() }, 4, 2},
+		{func() { s.unread(); s.unread() }, 1, 1},
+		{func() { s.read(); s.read(); s.read(); s.read(); s.read() }, 10, 4},
+		{func() { s.peek() }, 10, 4},
+		{func() { s.read(); s.read() }, 11, 4},
+		{func() { s.unread(); s.unread(); s.unread() }, 9, 3},
+	}
+	for i, test := range tests {
+		test.op()
+		if s.pos != test.pos {
+			t.Errorf("Want position %d after step %d, got %d", test.pos, i, s.pos)
+		}
+		if line := s.position(s.pos).Line; line != test.line {
+			t.Errorf("Want line %d after step %d, got %d", test.line, i, line)
+		}
+	}
+}
+
+func TestScannerUnreadAfterPeek(t *testing.T) {
+	// unread must step back over the character that was read,
+	// not the wider character that was peeked at.
+	s := new(scanner)
+	s.init("$é", "", "")
+	s.read()
+	s.peek()
+	s.unread()
+	if s.pos != 0 {
+		t.Errorf("Want position 0, got %d", s.pos)
+	}
+}
+
+func TestParseErrorLineAfterPeek(t *testing.T) {
+	// the default value spans several lines and is peeked at
+	// repeatedly before the error on the last line is reported.
+	_, err := Parse("${a:-\n\n${b}\n}\n${c d}")
+	perr, ok := err.(*ErrParse)
+	if !ok {
+		t.Fatalf("Want ErrParse, got %v", err)
+	}
+	if want := (Pos{Line: 5, Col: 4}); perr.Pos != want {
+		t.Errorf("Want error at %v, got %v", want, perr.Pos)
+	}
+}
@@ -6,6 +6,8 @@ package path
 
 import (
 	"errors"
+	"strings"
+	"unicode"
 	"unicode/utf8"
 )
 
@@ -20,7 +22,7 @@ var ErrBadPattern = errors.New("syntax error in pattern")
 //	term:
 //		'*'         matches any sequence of non-/ characters
 //		'?'         matches any single non-/ character
-//		'[' [ '^' ] { character-range } ']'
+//		'[' [ '!' | '^' ] { character-range } ']'
 //		            character class (must be non-empty)
 //		c           matches character c (c != '*', '?', '\\', '[')
 //		'\\' c      matches character c
@@ -29,6 +31,12 @@ var ErrBadPattern = errors.New("syntax error in pattern")
 //		c           matches character c (c != '\\', '-', ']')
 //		'\\' c      matches character c
 //		lo '-' hi   matches character c for lo <= c <= hi
+//		'[:' name ':]'
+//		            matches a character in the POSIX class name,
+//		            such as alpha, digit or space
+//
+// A ']' immediately following the opening '[', or '[!', is taken
+// literally, and a '[' that is not closed matches itself.
 //
 // Match requires pattern to match all of name, not just a substring.
 // The only possible returned error is ErrBadPattern, when pattern
@@ -88,7 +96,6 @@ func scanChunk(pattern string) (star bool, chunk, rest string) {
 		pattern = pattern[1:]
 		star = true
 	}
-	inrange := false
 	var i int
 Scan:
 	for i = 0; i < len(pattern); i++ {
@@ -99,13 +106,11 @@ Scan:
 				i++
 			}
 		case '[':
-			inrange = true
-		case ']':
-			inrange = false
-		case '*':
-			if !inrange {
-				break Scan
+			if n := classEnd(pattern[i:]); n > 0 {
+				i += n - 1
 			}
+		case '*':
+			break Scan
 		}
 	}
 	return star, pattern[0:i], pattern[i:]
@@ -121,42 +126,23 @@ func matchChunk(chunk, s string) (rest string, ok bool, err error) {
 		}
 		switch chunk[0] {
 		case '[':
-			// character class
-			r, n := utf8.DecodeRuneInString(s)
-			s = s[n:]
-			chunk = chunk[1:]
-			// possibly negated
-			notNegated := true
-			if len(chunk) > 0 && chunk[0] == '^' {
-				notNegated = false
-				chunk = chunk[1:]
-			}
-			// parse all ranges
-			match := false
-			nrange := 0
-			for {
-				if len(chunk) > 0 && chunk[0] == ']' && nrange > 0 {
-					chunk = chunk[1:]
-					break
-				}
-				var lo, hi rune
-				if lo, chunk, err = getEsc(chunk); err != nil {
+			// character class, or a literal [ if not closed
+			n := classEnd(chunk)
+			if n < 0 {
+				if s[0] != '[' {
 					return
 				}
-				hi = lo
-				if chunk[0] == '-' {
-					if hi, chunk, err = getEsc(chunk[1:]); err != nil {
-						return
-					}
-				}
-				if lo <= r && r <= hi {
-					match = true
-				}
-				nrange++
+				s = s[1:]
+				chunk = chunk[1:]
+				continue
 			}
-			if match != notNegated {
+			r, w := utf8.DecodeRuneInString(s)
+			s = s[w:]
+			var match bool
+			if match, err = matchClass(chunk[1:n-1], r); err != nil || !match {
 				return
 			}
+			chunk = chunk[n:]
 
 		case '?':
 			_, n := utf8.DecodeRuneInString(s)
@@ -182,9 +168,99 @@ func matchChunk(chunk, s string) (rest string, ok bool, err error) {
 	return s, true, nil
 }
 
-// getEsc gets a possibly-escaped character from chunk, for a character class.
-func getEsc(chunk string) (r rune, nchunk string, err error) {
-	if len(chunk) == 0 || chunk[0] == '-' || chunk[0] == ']' {
+// classEnd returns the length of the character class at the start of
+// pattern, including the brackets, or -1 if the class is not closed.
+func classEnd(pattern string) int {
+	i := 1
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		i++
+	}
+	if i < len(pattern) && pattern[i] == ']' {
+		i++
+	}
+	for i < len(pattern) {
+		switch {
+		case pattern[i] == ']':
+			return i + 1
+		case pattern[i] == '\\':
+			i += 2
+		case strings.HasPrefix(pattern[i:], "[:"):
+			if j := strings.Index(pattern[i+2:], ":]"); j >= 0 {
+				i += j + 4
+				continue
+			}
+			i++
+		default:
+			i++
+		}
+	}
+	return -1
+}
+
+// matchClass reports whether the character r matches the character
+// class, which excludes the enclosing brackets.
+func matchClass(class string, r rune) (bool, error) {
+	negated := false
+	if len(class) > 0 && (class[0] == '!' || class[0] == '^') {
+		negated = true
+		class = class[1:]
+	}
+	match := false
+	for first := true; len(class) > 0; first = false {
+		if strings.HasPrefix(class, "[:") {
+			if j := strings.Index(class[2:], ":]"); j >= 0 {
+				is, ok := classes[class[2:j+2]]
+				if !ok {
+					return false, ErrBadPattern
+				}
+				if is(r) {
+					match = true
+				}
+				class = class[j+4:]
+				continue
+			}
+		}
+		lo, rest, err := getEsc(class, first)
+		if err != nil {
+			return false, err
+		}
+		hi := lo
+		if len(rest) > 1 && rest[0] == '-' {
+			if hi, rest, err = getEsc(rest[1:], false); err != nil {
+				return false, err
+			}
+		}
+		if lo <= r && r <= hi {
+			match = true
+		}
+		class = rest
+	}
+	return match != negated, nil
+}
+
+// classes maps the names of the POSIX character classes to functions
+// reporting whether a character is in the class.
+var classes = map[string]func(rune) bool{
+	"alnum":  func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) },
+	"alpha":  unicode.IsLetter,
+	"ascii":  func(r rune) bool { return r < utf8.RuneSelf },
+	"blank":  func(r rune) bool { return r == ' ' || r == '\t' },
+	"cntrl":  unicode.IsControl,
+	"digit":  func(r rune) bool { return '0' <= r && r <= '9' },
+	"graph":  func(r rune) bool { return unicode.IsGraphic(r) && !unicode.IsSpace(r) },
+	"lower":  unicode.IsLower,
+	"print":  unicode.IsPrint,
+	"punct":  unicode.IsPunct,
+	"space":  unicode.IsSpace,
+	"upper":  unicode.IsUpper,
+	"word":   func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' },
+	"xdigit": func(r rune) bool { return strings.ContainsRune("0123456789abcdefABCDEF", r) },
+}
+
+// getEsc gets a possibly-escaped character from a character class.
+// A ']' or '-' is only taken literally as the first character.
+func getEsc(chunk string, first bool) (r rune, nchunk string, err error) {
+	if len(chunk) == 0 || !first && chunk[0] == ']' {
 		err = ErrBadPattern
 		return
 	}
@@ -200,8 +276,5 @@ func getEsc(chunk string) (r rune, nchunk string, err error) {
 		err = ErrBadPattern
 	}
 	nchunk = chunk[n:]
-	if len(nchunk) == 0 {
-		err = ErrBadPattern
-	}
 	return
 }
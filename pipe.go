@@ -0,0 +1,55 @@
+package envsubst
+
+// Transform is a step that modifies the value of a variable, such as
+// strings.ToLower or the transforms returned by ReplaceAll.
+type Transform func(string) string
+
+// Pipe replaces ${var} and $var in the string based on the mapping
+// function, passing the value of each variable through the transforms
+// in order. This composes steps that would otherwise need nesting, so
+//
+//	Pipe("${PATH}", mapping, ReplaceAll("/", "-"), strings.ToLower)
+//
+// replaces every slash in the value and then lowercases the result.
+// The transforms apply to the value as resolved, before any function
+// in the substitution itself; see WithValueTransform.
+func Pipe(s string, mapping func(string) string, transforms ...Transform) (string, error) {
+	return Eval(s, mapping, WithValueTransform(func(_, value string) string {
+		for _, fn := range transforms {
+			value = fn(value)
+		}
+		return value
+	}))
+}
+
+// Replace returns a Transform that replaces the first match of the
+// glob pattern, as in ${var/pattern/repl}.
+func Replace(pattern, repl string) Transform {
+	return func(s string) string {
+		return replaceFirst(s, pattern, repl)
+	}
+}
+
+// ReplaceAll returns a Transform that replaces every match of the
+// glob pattern, as in ${var//pattern/repl}.
+func ReplaceAll(pattern, repl string) Transform {
+	return func(s string) string {
+		return replaceAll(s, pattern, repl)
+	}
+}
+
+// TrimPrefix returns a Transform that removes the shortest prefix
+// matching the glob pattern, as in ${var#pattern}.
+func TrimPrefix(pattern string) Transform {
+	return func(s string) string {
+		return trimShortestPrefix(s, pattern)
+	}
+}
+
+// TrimSuffix returns a Transform that removes the shortest suffix
+// matching the glob pattern, as in ${var%pattern}.
+func TrimSuffix(pattern string) Transform {
+	return func(s string) string {
+		return trimShortestSuffix(s, pattern)
+	}
+}
@@ -0,0 +1,36 @@
+package envsubst
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPipe(t *testing.T) {
+	params := map[string]string{"PATH": "/Usr/Local/Bin", "FILE": "Report.TAR.GZ", "EMPTY": ""}
+	mapping := func(s string) string { return params[s] }
+
+	var tests = []struct {
+		input      string
+		transforms []Transform
+		output     string
+	}{
+		// the global replace runs first, then the lowercase.
+		{"${PATH}", []Transform{ReplaceAll("/", "-"), strings.ToLower}, "-usr-local-bin"},
+		{"${PATH}", []Transform{strings.ToLower, TrimPrefix("/"), Replace("/", ":")}, "usr:local/bin"},
+		{"${FILE}", []Transform{TrimSuffix(".*"), strings.ToUpper}, "REPORT.TAR"},
+		{"${FILE}", []Transform{ReplaceAll("[A-Z]", "_")}, "_eport.___.__"},
+		// functions in the substitution apply to the piped value.
+		{"${FILE,,}", []Transform{TrimSuffix(".*")}, "report.tar"},
+		{"${PATH}", nil, "/Usr/Local/Bin"},
+		{"<${EMPTY}> ${UNSET:-Default}", []Transform{strings.ToLower}, "<> Default"},
+	}
+	for _, test := range tests {
+		output, err := Pipe(test.input, mapping, test.transforms...)
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package envsubst
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/drone/envsubst/parse"
+)
+
+// EvalReader replaces ${var} and $var in the string based on the
+// mapping function, returning a reader of the output. The string is
+// parsed up front, so a syntax error is returned immediately, but the
+// output is produced lazily as the reader is consumed, one node of the
+// template at a time, so a consumer that stops early never causes the
+// rest to be expanded. An error during execution is returned by Read
+// once the output that precedes it has been read.
+func EvalReader(s string, mapping func(string) string, opts ...Option) (io.Reader, error) {
+	o := newOptions(opts...)
+	if isLiteral(s, o) {
+		return strings.NewReader(s), nil
+	}
+	t, err := parseOptions(s, o)
+	if err != nil {
+		return nil, err
+	}
+	return t.ExecuteReader(mapping, opts...), nil
+}
+
+// ExecuteReader applies a parsed template to the specified data
+// mapping, returning a reader that produces the output as it is read.
+// See EvalReader.
+func (t *Template) ExecuteReader(mapping func(string) string, opts ...Option) io.Reader {
+	r := &reader{template: t, state: new(state)}
+	if r.err = t.checkParsed(); r.err != nil {
+		return r
+	}
+	r.state.lookup = func(name string) (string, bool, error) {
+		return mapping(name), true, nil
+	}
+	if r.state.opts, r.err = t.executeOptions(opts); r.err != nil {
+		return r
+	}
+	r.state.writer = &r.buf
+	t.prepare(r.state)
+
+	// the white space trimmed around empty substitutions depends
+	// on the output that follows, so the template is expanded as
+	// a whole.
+	if r.state.opts.trimEmpty {
+		r.nodes = []parse.Node{t.tree.Root}
+	} else {
+		r.nodes = topLevel(t.tree.Root)
+	}
+	return r
+}
+
+// reader expands the nodes of a template as its output is read.
+type reader struct {
+	template *Template
+	state    *state
+	nodes    []parse.Node // the nodes yet to be expanded
+	buf      bytes.Buffer // the output yet to be read
+	err      error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 && r.err == nil {
+		if len(r.nodes) == 0 {
+			if r.err = r.template.finish(r.state, nil); r.err == nil {
+				r.err = io.EOF
+			}
+			break
+		}
+		r.state.node = r.nodes[0]
+		r.nodes = r.nodes[1:]
+		if r.state.opts.trimEmpty {
+			r.err = r.template.evalTrim(r.state)
+		} else {
+			r.err = r.template.eval(r.state)
+		}
+		if r.err != nil {
+			r.err = r.template.finish(r.state, r.err)
+		}
+	}
+	if r.buf.Len() != 0 {
+		return r.buf.Read(p)
+	}
+	return 0, r.err
+}
@@ -0,0 +1,83 @@
+package envsubst
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEvalReader(t *testing.T) {
+	params := map[string]string{"HOST": "localhost", "PORT": "8080"}
+	mapping := func(s string) string { return params[s] }
+
+	var tests = []struct {
+		input  string
+		output string
+		opts   []Option
+	}{
+		{"http://${HOST}:${PORT:-80}/$((PORT+1))", "http://localhost:8080/8081", nil},
+		{"no substitutions", "no substitutions", nil},
+		{"", "", nil},
+		{"key: ${UNSET}\n", "key:\n", []Option{WithTrimEmptyExpansionWhitespace()}},
+	}
+	for _, test := range tests {
+		r, err := EvalReader(test.input, mapping, test.opts...)
+		if err != nil {
+			t.Errorf("Want %q parsed but got error %q", test.input, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("Want %q expanded but got error %q", test.input, err)
+		}
+		if output := string(b); output != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, output)
+		}
+	}
+}
+
+func TestEvalReaderParseError(t *testing.T) {
+	r, err := EvalReader("${HOST", func(string) string { return "" })
+	if err == nil || r != nil {
+		t.Errorf("Want a parse error before reading, got %v, %v", r, err)
+	}
+}
+
+func TestEvalReaderLazy(t *testing.T) {
+	var looked []string
+	mapping := func(name string) string {
+		looked = append(looked, name)
+		return name
+	}
+	r, err := EvalReader("${A}-${B}-${C}", mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(looked) != 0 {
+		t.Errorf("Want no lookups before reading, got %v", looked)
+	}
+	p := make([]byte, 1)
+	if n, err := r.Read(p); n != 1 || err != nil || string(p) != "A" {
+		t.Errorf("Want A read, got %q, %d, %v", p, n, err)
+	}
+	if len(looked) != 1 {
+		t.Errorf("Want only A looked up after the first read, got %v", looked)
+	}
+}
+
+func TestEvalReaderExecError(t *testing.T) {
+	r, err := EvalReader("a=${A} b=${B}", func(string) string { return "" }, WithForbidEmpty("B"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if output := string(b); output != "a= b=" {
+		t.Errorf("Want the output preceding the error, got %q", output)
+	}
+	if !errors.Is(err, ErrEmpty) {
+		t.Errorf("Want ErrEmpty, got %v", err)
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, ErrEmpty) {
+		t.Errorf("Want the error to persist, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package envsubst
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/drone/envsubst/parse"
+)
+
+// ErrUnknownFunc is returned when a ${var|name} substitution calls a
+// function that is not registered.
+var ErrUnknownFunc = errors.New("unknown function")
+
+// ErrUnexpectedArgs is returned when a built-in function that takes
+// no arguments, such as base64, is called with some.
+var ErrUnexpectedArgs = errors.New("takes no arguments")
+
+// Func is a function that can be called by name in a template, as in
+// ${var|name} or ${var|name:arg1:arg2}. It receives the value of the
+// variable and the arguments, and returns the expansion.
+type Func func(value string, args []string) (string, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Func{
+		"base64":    noArgs(toBase64),
+		"sha256":    noArgs(toSHA256),
+		"urlencode": noArgs(toURLEncoded),
+	}
+)
+
+// RegisterFunc registers the function under the name, so that
+// templates can call it as ${var|name}. The functions base64, sha256
+// and urlencode, which encodes as ${var@url} does, are registered by
+// default, and may be replaced.
+// Registering a nil function removes the name. RegisterFunc is safe
+// to call concurrently with template execution, though it is
+// typically called during initialization.
+func RegisterFunc(name string, fn Func) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if fn == nil {
+		delete(registry, name)
+		return
+	}
+	registry[name] = fn
+}
+
+// callFunc calls the registered function named by the first argument
+// of the ${var|name:arg...} node with the value and the remaining
+// arguments.
+func callFunc(node *parse.FuncNode, v string, args []string) (string, error) {
+	name := args[0]
+	registryMu.RLock()
+	fn := registry[name]
+	registryMu.RUnlock()
+	if fn == nil {
+		return "", fmt.Errorf("%d:%d: %s: %w %q", node.Pos.Line, node.Pos.Col, node.Param, ErrUnknownFunc, name)
+	}
+	v, err := fn(v, args[1:])
+	if err != nil {
+		return "", fmt.Errorf("%d:%d: %s: %s: %w", node.Pos.Line, node.Pos.Col, node.Param, name, err)
+	}
+	return v, nil
+}
+
+// noArgs returns a Func that applies fn to the value, failing if it
+// is called with arguments.
+func noArgs(fn substituteFunc) Func {
+	return func(value string, args []string) (string, error) {
+		if len(args) != 0 {
+			return "", ErrUnexpectedArgs
+		}
+		return fn(value), nil
+	}
+}
@@ -0,0 +1,70 @@
+package envsubst
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRegisterFunc(t *testing.T) {
+	RegisterFunc("repeat", func(value string, args []string) (string, error) {
+		if len(args) != 1 {
+			return "", errors.New("want a count")
+		}
+		n, err := parseInt(args[0])
+		if err != nil {
+			return "", err
+		}
+		return strings.Repeat(value, int(n)), nil
+	})
+	defer RegisterFunc("repeat", nil)
+
+	env := map[string]string{
+		"HOST":  "hello",
+		"QUERY": "a b&c",
+		"N":     "3",
+	}
+	var tests = []struct {
+		input, output string
+	}{
+		{"${HOST|base64}", "aGVsbG8="},
+		{"${HOST|sha256}", "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{"q=${QUERY|urlencode}", "q=a%20b%26c"},
+		{"${HOST|repeat:2}", "hellohello"},
+		{"${HOST|repeat:$N}", "hellohellohello"},
+		{"${UNSET|base64}", ""},
+	}
+	for _, test := range tests {
+		got, err := Eval(test.input, func(name string) string { return env[name] })
+		if err != nil {
+			t.Errorf("%q: %s", test.input, err)
+			continue
+		}
+		if got != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, got)
+		}
+	}
+
+	var errs = []struct {
+		input, err string
+	}{
+		{"${HOST|nope}", `1:1: HOST: unknown function "nope"`},
+		{"${HOST|base64:x}", "1:1: HOST: base64: takes no arguments"},
+		{"${HOST|repeat}", "1:1: HOST: repeat: want a count"},
+	}
+	for _, test := range errs {
+		_, err := Eval(test.input, func(name string) string { return env[name] })
+		if err == nil || err.Error() != test.err {
+			t.Errorf("Want %q to return error %q, got %v", test.input, test.err, err)
+		}
+	}
+
+	_, err := Eval("${HOST|nope}", func(string) string { return "" })
+	if !errors.Is(err, ErrUnknownFunc) {
+		t.Errorf("Want ErrUnknownFunc, got %v", err)
+	}
+	_, err = Eval("${HOST|sha256:x}", func(string) string { return "" })
+	if !errors.Is(err, ErrUnexpectedArgs) {
+		t.Errorf("Want ErrUnexpectedArgs, got %v", err)
+	}
+}
@@ -2,12 +2,140 @@ package envsubst
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/drone/envsubst/parse"
 )
 
+// ErrEmpty is returned when a variable that must not be empty
+// resolves to the empty string.
+var ErrEmpty = errors.New("parameter null")
+
+// EmptyError is returned by WithForbidEmpty when a variable that must
+// not be empty resolves to the empty string. It wraps ErrEmpty.
+type EmptyError struct {
+	Name string
+	Pos  parse.Pos
+}
+
+func (e *EmptyError) Error() string {
+	return fmt.Sprintf("%d:%d: %s: %s", e.Pos.Line, e.Pos.Col, e.Name, ErrEmpty)
+}
+
+// Unwrap returns ErrEmpty.
+func (e *EmptyError) Unwrap() error {
+	return ErrEmpty
+}
+
+// ErrMaxDepth is returned when expansions nest deeper than the
+// maximum expansion depth.
+var ErrMaxDepth = errors.New("maximum expansion depth exceeded")
+
+// ErrMaxOutputSize is returned when the output of a template, or the
+// value of a substitution, exceeds the maximum output size.
+var ErrMaxOutputSize = errors.New("maximum output size exceeded")
+
+// ErrBadNode is returned when a function node has the wrong number of
+// arguments, as a tree built or unmarshaled by hand may, rather than
+// one returned by the parser.
+var ErrBadNode = errors.New("bad function node")
+
+// ErrParseOption is returned when a Template is executed with an
+// Option that configures parsing, such as WithDelims.
+var ErrParseOption = errors.New("option applies only when parsing")
+
+// UndefinedError is returned in strict mode when the template
+// references a variable that is not set.
+type UndefinedError struct {
+	Name string
+	Pos  parse.Pos
+}
+
+func (e *UndefinedError) Error() string {
+	return fmt.Sprintf("%d:%d: %s: unbound variable", e.Pos.Line, e.Pos.Col, e.Name)
+}
+
+// UndefinedErrors is returned in strict mode with WithAllUndefined,
+// listing every variable that is referenced but not set, in order of
+// first reference.
+type UndefinedErrors []*UndefinedError
+
+func (e UndefinedErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// ParameterError is returned by the ${var?word} and ${var:?word}
+// substitutions when the variable is not set, or for the colon
+// form, set to the empty string.
+type ParameterError struct {
+	Name    string
+	Message string
+	Pos     parse.Pos
+}
+
+func (e *ParameterError) Error() string {
+	return fmt.Sprintf("%d:%d: %s: %s", e.Pos.Line, e.Pos.Col, e.Name, e.Message)
+}
+
+// LookupError is returned when the mapping function fails to look
+// up a variable.
+type LookupError struct {
+	Name string
+	Pos  parse.Pos
+	Err  error
+}
+
+func (e *LookupError) Error() string {
+	return fmt.Sprintf("%d:%d: %s: %s", e.Pos.Line, e.Pos.Col, e.Name, e.Err)
+}
+
+// Unwrap returns the error returned by the mapping function.
+func (e *LookupError) Unwrap() error {
+	return e.Err
+}
+
+// Stats holds the statistics recorded by WithStats.
+type Stats struct {
+	// Replacements records each replace substitution in the
+	// order executed.
+	Replacements []Replacement
+}
+
+// Replacement records the number of matches replaced by a
+// ${var/pattern/replacement} substitution, or one of its //, /# and
+// /% forms.
+type Replacement struct {
+	Name  string
+	Count int
+	Pos   parse.Pos
+}
+
+// OffsetError is returned when the offset or length of a
+// ${var:offset:length} substring is not an integer, whether written
+// literally, as in ${var:x}, or given by an expansion, such as
+// ${var:${start}}. See WithStrictOffsets.
+type OffsetError struct {
+	Name   string
+	Offset string
+	Pos    parse.Pos
+}
+
+func (e *OffsetError) Error() string {
+	return fmt.Sprintf("%d:%d: %s: %q: offset is not an integer", e.Pos.Line, e.Pos.Col, e.Name, e.Offset)
+}
+
 // state represents the state of template execution. It is not part of the
 // template so that multiple executions can run in parallel.
 type state struct {
@@ -15,51 +143,341 @@ type state struct {
 	writer   io.Writer
 	node     parse.Node // current node
 
-	// maps variable names to values
-	mapper func(string) string
+	// maps variable names to values, reporting whether
+	// the variable is set.
+	lookup func(string) (string, bool, error)
+
+	// if not nil, execution stops once the context is done.
+	ctx context.Context
+
+	// execution options
+	opts *options
+
+	// current expansion depth
+	depth int
+
+	// undefined variables collected with WithAllUndefined.
+	undefined UndefinedErrors
+}
+
+// limitWriter writes to w, failing with ErrMaxOutputSize rather than
+// write more than n bytes in total.
+type limitWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if len(p) > l.n {
+		return 0, ErrMaxOutputSize
+	}
+	l.n -= len(p)
+	return l.w.Write(p)
+}
+
+// fallback returns the value that WithDefaults supplies for the named
+// variable if it is not set, as looked up.
+func (s *state) fallback(name, v string, ok bool) (string, bool) {
+	if d, has := s.opts.defaults[name]; has && !ok {
+		return d, true
+	}
+	return v, ok
+}
+
+// length returns the length of v in characters or, with
+// WithByteLength, in bytes.
+func (s *state) length(v string) string {
+	if s.opts.byteLength {
+		return toByteLen(v)
+	}
+	return toLen(v)
 }
 
 // Template is the representation of a parsed shell format string.
+// A template is parsed once and may then be executed any number of
+// times, including concurrently from multiple goroutines.
 type Template struct {
 	tree *parse.Tree
+
+	// name identifies the template in errors.
+	name string
+
+	// evaluated is true if the template was parsed by an Eval
+	// function, which passes the options that configure parsing on
+	// to execution as well.
+	evaluated bool
+}
+
+// New allocates a new template with the given name, which prefixes the
+// errors returned by parsing and executing it.
+func New(name string) *Template {
+	return &Template{name: name}
+}
+
+// Name returns the name of the template.
+func (t *Template) Name() string {
+	return t.name
 }
 
 // Parse creates a new shell format template and parses the template
 // definition from string s.
 func Parse(s string) (t *Template, err error) {
-	t = new(Template)
-	t.tree, err = parse.Parse(s)
+	return new(Template).Parse(s)
+}
+
+// Parse parses the template definition from string s. A parse error
+// names the template, as in config.tpl:12:5: bad substitution.
+func (t *Template) Parse(s string) (*Template, error) {
+	tree, err := parse.Parse(s)
 	if err != nil {
+		if perr, ok := err.(*parse.ErrParse); ok {
+			perr.Filename = t.name
+		}
 		return nil, err
 	}
+	t.tree = tree
 	return t, nil
 }
 
+// AddParseTree sets the parse tree of the template, such as a tree
+// built by hand or unmarshaled from JSON rather than parsed.
+func (t *Template) AddParseTree(tree *parse.Tree) *Template {
+	t.tree = tree
+	return t
+}
+
 // ParseFile creates a new shell format template and parses the template
-// definition from the named file.
+// definition from the named file. The template is named after the file,
+// so errors name the file, as in config.tpl:12:5: bad substitution.
 func ParseFile(path string) (*Template, error) {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	return Parse(string(b))
+	return New(path).Parse(string(b))
+}
+
+// Validate parses the string without evaluating it, returning the
+// *parse.ErrParse describing the first syntax error, if any. No
+// variables are looked up, so a template can be checked without the
+// environment it will be expanded in.
+func Validate(s string) error {
+	_, err := Parse(s)
+	return err
 }
 
 // Execute applies a parsed template to the specified data mapping.
-func (t *Template) Execute(mapping func(string) string) (str string, err error) {
+// Every value returned by the mapping, including the empty string,
+// is considered set.
+func (t *Template) Execute(mapping func(string) string, opts ...Option) (str string, err error) {
+	return t.ExecuteLookup(func(name string) (string, bool) {
+		return mapping(name), true
+	}, opts...)
+}
+
+// ExecuteString applies a parsed template to the variables in the map.
+// A name that the map does not contain is not set.
+func (t *Template) ExecuteString(vars map[string]string, opts ...Option) (string, error) {
+	return t.ExecuteLookup(func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}, opts...)
+}
+
+// MustExecute is like Execute but panics if the template cannot be
+// executed. It simplifies the use of templates whose variables are
+// known to be valid, such as in tests.
+func (t *Template) MustExecute(mapping func(string) string, opts ...Option) string {
+	s, err := t.Execute(mapping, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// ExecuteLookup applies a parsed template to the specified lookup
+// function, which reports whether each variable is set in the style
+// of os.LookupEnv. This allows substitutions such as ${var-word} and
+// ${var:-word} to tell unset variables apart from empty ones.
+func (t *Template) ExecuteLookup(lookup func(string) (string, bool), opts ...Option) (str string, err error) {
 	b := new(bytes.Buffer)
+	err = t.ExecuteLookupTo(b, lookup, opts...)
+	if err != nil {
+		return
+	}
+	return b.String(), nil
+}
+
+// ExecuteTo applies a parsed template to the specified data mapping,
+// writing the output directly to w rather than returning a string.
+func (t *Template) ExecuteTo(w io.Writer, mapping func(string) string, opts ...Option) error {
+	return t.ExecuteLookupTo(w, func(name string) (string, bool) {
+		return mapping(name), true
+	}, opts...)
+}
+
+// ExecuteLookupTo applies a parsed template to the specified lookup
+// function, writing the output directly to w rather than returning
+// a string.
+func (t *Template) ExecuteLookupTo(w io.Writer, lookup func(string) (string, bool), opts ...Option) error {
+	if err := t.checkParsed(); err != nil {
+		return err
+	}
 	s := new(state)
 	s.node = t.tree.Root
-	s.mapper = mapping
-	s.writer = b
-	err = t.eval(s)
+	s.lookup = func(name string) (string, bool, error) {
+		v, ok := lookup(name)
+		return v, ok, nil
+	}
+	o, err := t.executeOptions(opts)
 	if err != nil {
-		return
+		return err
+	}
+	s.opts = o
+	s.writer = w
+	return t.execute(s)
+}
+
+// ExecuteContext applies a parsed template to the specified mapping,
+// passing the context to each call. The mapping may return an error,
+// such as when a remote lookup fails, which stops execution. Execution
+// also stops with the context's error once the context is done. Every
+// value returned by the mapping, including the empty string, is
+// considered set.
+func (t *Template) ExecuteContext(ctx context.Context, mapping func(context.Context, string) (string, error), opts ...Option) (string, error) {
+	if err := t.checkParsed(); err != nil {
+		return "", err
+	}
+	o, err := t.executeOptions(opts)
+	if err != nil {
+		return "", err
+	}
+	b := new(bytes.Buffer)
+	s := new(state)
+	s.node = t.tree.Root
+	s.lookup = func(name string) (string, bool, error) {
+		v, err := mapping(ctx, name)
+		return v, true, err
+	}
+	s.ctx = ctx
+	s.opts = o
+	s.writer = b
+	if err := t.execute(s); err != nil {
+		return "", err
 	}
 	return b.String(), nil
 }
 
+// Variables returns the distinct names of the variables referenced
+// by the template, in order of first appearance. This includes the
+// variables referenced inside function arguments, such as default
+// values and substring offsets.
+func (t *Template) Variables() []string {
+	if t.tree == nil {
+		return nil
+	}
+	var names []string
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	parse.Walk(t.tree.Root, func(node parse.Node) bool {
+		switch node := node.(type) {
+		case *parse.FuncNode:
+			if node.Param != "" {
+				add(node.Param)
+			}
+		case *parse.ArithNode:
+			for _, n := range node.Args {
+				if text, ok := n.(*parse.TextNode); ok {
+					for _, name := range arithNames(text.Value) {
+						add(name)
+					}
+				}
+			}
+		}
+		return true
+	})
+	return names
+}
+
+// checkParsed returns an error if the template has no parse tree, as
+// when it is created by New but never parsed.
+func (t *Template) checkParsed() error {
+	if t.tree == nil {
+		return fmt.Errorf("template: %s: not parsed", t.name)
+	}
+	return nil
+}
+
+// executeOptions returns the configuration resulting from the
+// options of an execution. Unless the template was parsed by an Eval
+// function, an option that configures parsing is an error.
+func (t *Template) executeOptions(opts []Option) (*options, error) {
+	o := newOptions(opts...)
+	if o.parseOnly != "" && !t.evaluated {
+		return nil, fmt.Errorf("%s: %w", o.parseOnly, ErrParseOption)
+	}
+	return o, nil
+}
+
+// execute evaluates the template, returning any undefined variables
+// collected along the way once the evaluation completes. Errors are
+// prefixed with the name of the template, if any.
+func (t *Template) execute(s *state) error {
+	t.prepare(s)
+	var err error
+	if s.opts.trimEmpty {
+		err = t.evalTrim(s)
+	} else {
+		err = t.eval(s)
+	}
+	return t.finish(s, err)
+}
+
+// prepare applies the options that modify the lookup function and the
+// writer of the state before evaluation begins.
+func (t *Template) prepare(s *state) {
+	if s.opts.maxOutput > 0 {
+		s.writer = &limitWriter{w: s.writer, n: s.opts.maxOutput}
+	}
+	if s.opts.foldCase {
+		s.lookup = foldCase(s.lookup, s.opts.enumerator)
+	}
+	if fn := s.opts.transform; fn != nil {
+		lookup := s.lookup
+		s.lookup = func(name string) (string, bool, error) {
+			v, ok, err := lookup(name)
+			if ok && err == nil {
+				v = fn(name, v)
+			}
+			return v, ok, err
+		}
+	}
+}
+
+// finish returns the error of a completed evaluation, or the undefined
+// variables collected along the way, prefixed with the name of the
+// template, if any.
+func (t *Template) finish(s *state, err error) error {
+	if err == nil && len(s.undefined) != 0 {
+		err = s.undefined
+	}
+	if err != nil && t.name != "" {
+		err = fmt.Errorf("%s: %w", t.name, err)
+	}
+	return err
+}
+
 func (t *Template) eval(s *state) (err error) {
+	if s.ctx != nil {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+	}
 	switch node := s.node.(type) {
 	case *parse.TextNode:
 		err = t.evalText(s, node)
@@ -67,15 +485,64 @@ func (t *Template) eval(s *state) (err error) {
 		err = t.evalFunc(s, node)
 	case *parse.ListNode:
 		err = t.evalList(s, node)
+	case *parse.ArithNode:
+		err = t.evalArith(s, node)
 	}
 	return err
 }
 
 func (t *Template) evalText(s *state, node *parse.TextNode) error {
-	_, err := io.WriteString(s.writer, node.Value)
+	// in restricted mode escapes are left for the substitutions
+	// that are written as they appear in the template.
+	v := node.Value
+	if s.opts.allowed != nil && node.Source != "" {
+		v = node.Source
+	} else if s.opts.tilde && s.depth == 0 {
+		var err error
+		if v, err = t.expandTilde(s, v, t.first(node)); err != nil {
+			return err
+		}
+	}
+	if s.opts.lineEnding != 0 && s.depth == 0 {
+		v = toLineEnding(v, s.opts.lineEnding)
+	}
+	_, err := io.WriteString(s.writer, v)
 	return err
 }
 
+// first returns true if the node begins the template.
+func (t *Template) first(node parse.Node) bool {
+	root := t.tree.Root
+	if list, ok := root.(*parse.ListNode); ok && len(list.Nodes) != 0 {
+		root = list.Nodes[0]
+	}
+	return root == node
+}
+
+// expandTilde replaces each ~ that begins a word of v with the value
+// of HOME, where start reports whether v begins a word. A ~ must be
+// followed by a slash, white space or the end of v.
+func (t *Template) expandTilde(s *state, v string, start bool) (string, error) {
+	if strings.IndexByte(v, '~') < 0 {
+		return v, nil
+	}
+	home, ok, err := s.lookup("HOME")
+	if err != nil || !ok {
+		return v, err
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		begins := start && i == 0 || i > 0 && isSpace(v[i-1])
+		ends := i+1 == len(v) || v[i+1] == '/' || isSpace(v[i+1])
+		if v[i] == '~' && begins && ends {
+			b.WriteString(home)
+			continue
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String(), nil
+}
+
 func (t *Template) evalList(s *state, node *parse.ListNode) (err error) {
 	for _, n := range node.Nodes {
 		s.node = n
@@ -87,7 +554,431 @@ func (t *Template) evalList(s *state, node *parse.ListNode) (err error) {
 	return nil
 }
 
+// evalTrim evaluates the template for WithTrimEmptyExpansionWhitespace.
+// Each top-level node is expanded separately, so that the white space
+// around the substitutions that expand to the empty string can be
+// trimmed before the output is written.
+func (t *Template) evalTrim(s *state) error {
+	var w = s.writer
+	var parts []string
+	var empty []bool
+	for _, n := range topLevel(s.node) {
+		var buf bytes.Buffer
+		s.writer = &buf
+		s.node = n
+		if err := t.eval(s); err != nil {
+			s.writer = w
+			return err
+		}
+		_, fn := n.(*parse.FuncNode)
+		parts = append(parts, buf.String())
+		empty = append(empty, fn && buf.Len() == 0)
+	}
+	s.writer = w
+	_, err := io.WriteString(w, trimEmpty(parts, empty))
+	return err
+}
+
+// topLevel returns the nodes of the tree rooted at node in order,
+// flattening the nested lists.
+func topLevel(node parse.Node) []parse.Node {
+	var nodes []parse.Node
+	parse.Walk(node, func(n parse.Node) bool {
+		if _, ok := n.(*parse.ListNode); ok {
+			return true
+		}
+		nodes = append(nodes, n)
+		return false
+	})
+	return nodes
+}
+
+// trimEmpty joins the expanded parts of a template, trimming the white
+// space around each empty substitution that stands alone between white
+// space or line boundaries, as described by
+// WithTrimEmptyExpansionWhitespace.
+func trimEmpty(parts []string, empty []bool) string {
+	var b []byte
+	var skip bool // trim the white space that follows
+	for i, part := range parts {
+		if !empty[i] {
+			if skip {
+				part = strings.TrimLeft(part, " \t")
+				skip = part == ""
+			}
+			b = append(b, part...)
+			continue
+		}
+
+		// the end of the template is the end of a line.
+		next := byte('\n')
+		for _, p := range parts[i+1:] {
+			if p != "" {
+				next = p[0]
+				break
+			}
+		}
+		if len(b) != 0 && !isSpace(b[len(b)-1]) || !isSpace(next) {
+			continue
+		}
+		trimmed := bytes.TrimRight(b, " \t")
+		switch {
+		case len(trimmed) != 0 && trimmed[len(trimmed)-1] != '\n':
+			b = trimmed
+		case next == '\n' || next == '\r':
+			b = trimmed
+		default:
+			skip = true
+		}
+	}
+	return string(b)
+}
+
 func (t *Template) evalFunc(s *state, node *parse.FuncNode) error {
+	if s.opts.allowed != nil && !s.opts.allowed[node.Param] {
+		_, err := io.WriteString(s.writer, node.Source)
+		return err
+	}
+
+	switch node.Param {
+	case "@", "*":
+		return t.evalParams(s, node)
+	}
+
+	switch node.Name {
+	case "!*", "!@":
+		return t.writeValue(s, t.names(s, node.Param))
+	case "[", "#[":
+		return t.evalIndex(s, node)
+	case "![":
+		return t.evalKeys(s, node)
+	case "#":
+		if node.Param == "" {
+			args, err := t.evalArgs(s, node)
+			if err != nil {
+				return err
+			}
+			if len(args) != 1 {
+				return badNode(node)
+			}
+			return t.writeValue(s, s.length(args[0]))
+		}
+	}
+
+	v, ok, err := t.lookup(s, node, node.Param)
+	if err != nil {
+		return err
+	}
+
+	// indirect expansion uses the value as the name of the
+	// variable to expand.
+	if node.Name == "!" && v != "" {
+		if err := t.enter(s, node); err != nil {
+			return err
+		}
+		v, ok, err = t.lookup(s, node, v)
+		s.depth--
+		if err != nil {
+			return err
+		}
+	}
+
+	if isDefaultFunc(node.Name) {
+		return t.evalDefault(s, node, v, ok)
+	}
+
+	if !ok && s.opts.keepUnset {
+		src := node.Source
+		if src == "" {
+			src = node.String()
+		}
+		_, err := io.WriteString(s.writer, src)
+		return err
+	}
+
+	args, err := t.evalArgs(s, node)
+	if err != nil {
+		return err
+	}
+
+	if node.Name == ":" {
+		if err := checkOffsets(node, args, s.opts.strictOffsets); err != nil {
+			return err
+		}
+	}
+
+	if s.opts.stats != nil {
+		switch node.Name {
+		case "/", "//", "/#", "/%":
+			s.opts.stats.Replacements = append(s.opts.stats.Replacements, Replacement{
+				Name:  node.Param,
+				Count: countMatches(node.Name, v, args...),
+				Pos:   node.Pos,
+			})
+		}
+	}
+
+	if node.Name == "#" && len(args) == 0 {
+		return t.writeValue(s, s.length(v))
+	}
+
+	if fn := lookupDecodeFunc(node.Name); fn != nil {
+		v, err := fn(v)
+		if err != nil {
+			return fmt.Errorf("%d:%d: %s: %w", node.Pos.Line, node.Pos.Col, node.Param, err)
+		}
+		return t.writeValue(s, v)
+	}
+
+	if node.Name == "|" {
+		if len(args) == 0 {
+			return badNode(node)
+		}
+		v, err := callFunc(node, v, args)
+		if err != nil {
+			return err
+		}
+		return t.writeValue(s, v)
+	}
+
+	fn := lookupFunc(node.Name, len(args))
+
+	return t.writeValue(s, fn(v, args...))
+}
+
+// checkOffsets returns an error if a substring offset or length given
+// by an expansion does not resolve to an integer. Unless strict, a
+// literal offset that is not an integer is left to toSubstr, which
+// returns the value unchanged.
+func checkOffsets(node *parse.FuncNode, args []string, strict bool) error {
+	for i, arg := range node.Args {
+		if _, ok := arg.(*parse.TextNode); ok && !strict {
+			continue
+		}
+		if _, err := parseOffset(args[i]); err != nil {
+			return &OffsetError{Name: node.Param, Offset: args[i], Pos: node.Pos}
+		}
+	}
+	return nil
+}
+
+// evalDefault evaluates the functions that substitute a word
+// depending on whether the variable is set. The colon forms also
+// treat a variable set to the empty string as not set. The word is
+// only evaluated when it is used.
+func (t *Template) evalDefault(s *state, node *parse.FuncNode, v string, ok bool) error {
+	set := ok
+	if strings.HasPrefix(node.Name, ":") || node.Name == "=" {
+		// ${var=word} historically treats an empty variable as
+		// not set, and is kept consistent with ${var:=word}.
+		set = ok && v != ""
+	}
+
+	switch strings.TrimPrefix(node.Name, ":") {
+	case "+":
+		if !set {
+			return t.writeValue(s, "")
+		}
+	case "?":
+		if set {
+			return t.writeValue(s, v)
+		}
+		args, err := t.evalArgs(s, node)
+		if err != nil {
+			return err
+		}
+		msg := strings.Join(args, "")
+		switch {
+		case msg != "":
+		case node.Name == ":?":
+			msg = "parameter null or not set"
+		default:
+			msg = "parameter not set"
+		}
+		return &ParameterError{Name: node.Param, Message: msg, Pos: node.Pos}
+	case "num:":
+		// an envsubst extension, the value is only used if it
+		// is an integer.
+		if _, err := strconv.ParseInt(v, 10, 64); set && err == nil {
+			return t.writeValue(s, v)
+		}
+	default:
+		if set {
+			return t.writeValue(s, v)
+		}
+	}
+
+	args, err := t.evalArgs(s, node)
+	if err != nil {
+		return err
+	}
+	word := strings.Join(args, "")
+	if s.opts.tilde {
+		if word, err = t.expandTilde(s, word, true); err != nil {
+			return err
+		}
+	}
+	return t.writeValue(s, word)
+}
+
+// writeValue writes the value of a substitution. The value is escaped
+// if an escaping mode is configured, unless the substitution is nested
+// in the arguments of another substitution.
+func (t *Template) writeValue(s *state, v string) error {
+	if s.opts.maxOutput > 0 && len(v) > s.opts.maxOutput {
+		return ErrMaxOutputSize
+	}
+	if s.opts.unescape && s.depth == 0 {
+		v = toUnescaped(v)
+	}
+	if s.opts.escape != nil && s.depth == 0 {
+		v = s.opts.escape(v)
+	}
+	if s.opts.lineEnding != 0 && s.opts.lineValues && s.depth == 0 {
+		v = toLineEnding(v, s.opts.lineEnding)
+	}
+	_, err := io.WriteString(s.writer, v)
+	return err
+}
+
+// evalIndex evaluates the ${var[index]} and ${#var[index]} functions,
+// where the index is @ or * for all the elements of the list.
+func (t *Template) evalIndex(s *state, node *parse.FuncNode) error {
+	args, err := t.evalArgs(s, node)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return badNode(node)
+	}
+
+	list, ok := []string(nil), false
+	if s.opts.lister != nil {
+		list, ok = s.opts.lister.List(node.Param)
+	}
+	if !ok {
+		v, set, err := t.lookup(s, node, node.Param)
+		if err != nil {
+			return err
+		}
+		if set {
+			list = []string{v}
+		}
+	}
+
+	var v string
+	switch index := strings.TrimSpace(args[0]); index {
+	case "@", "*":
+		if node.Name == "#[" {
+			v = strconv.Itoa(len(list))
+		} else {
+			v = strings.Join(list, " ")
+		}
+	default:
+		i, err := strconv.Atoi(index)
+		if err != nil {
+			return fmt.Errorf("%d:%d: %s: bad array subscript %q", node.Pos.Line, node.Pos.Col, node.Param, index)
+		}
+		if i < 0 {
+			i += len(list)
+		}
+		if i >= 0 && i < len(list) {
+			v = list[i]
+		}
+		if node.Name == "#[" {
+			v = s.length(v)
+		}
+	}
+	return t.writeValue(s, v)
+}
+
+// evalKeys evaluates the ${!var[@]} and ${!var[*]} functions, which
+// expand to the keys of a map or the indices of a list. A scalar has
+// the single index 0, and an unset variable has none.
+func (t *Template) evalKeys(s *state, node *parse.FuncNode) error {
+	if keyer, ok := s.opts.lister.(Keyer); ok {
+		if keys, ok := keyer.Keys(node.Param); ok {
+			return t.writeValue(s, strings.Join(keys, " "))
+		}
+	}
+
+	list, ok := []string(nil), false
+	if s.opts.lister != nil {
+		list, ok = s.opts.lister.List(node.Param)
+	}
+	if !ok {
+		v, set, err := t.lookup(s, node, node.Param)
+		if err != nil {
+			return err
+		}
+		if set {
+			list = []string{v}
+		}
+	}
+
+	keys := make([]string, len(list))
+	for i := range list {
+		keys[i] = strconv.Itoa(i)
+	}
+	return t.writeValue(s, strings.Join(keys, " "))
+}
+
+// evalParams evaluates the ${@} and ${*} functions, which expand to
+// the positional parameters ${1} onwards, and the ${#@} and ${#*}
+// functions, which expand to their number. The number is the value
+// of the variable #, as resolved by ArgsLookup, and a parameter that
+// is not set expands to the empty string. The parameters of ${*} are
+// separated by the first character of IFS, or a space if IFS is empty.
+func (t *Template) evalParams(s *state, node *parse.FuncNode) error {
+	lookup := func(name string) (string, error) {
+		v, _, err := s.lookup(name)
+		if err != nil {
+			err = &LookupError{Name: name, Pos: node.Pos, Err: err}
+		}
+		return v, err
+	}
+
+	v, err := lookup("#")
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		n = 0
+	}
+	if node.Name == "#" {
+		return t.writeValue(s, strconv.Itoa(n))
+	}
+
+	sep := " "
+	if node.Param == "*" {
+		ifs, err := lookup("IFS")
+		if err != nil {
+			return err
+		}
+		if r, size := utf8.DecodeRuneInString(ifs); size != 0 {
+			sep = string(r)
+		}
+	}
+	params := make([]string, n)
+	for i := range params {
+		if params[i], err = lookup(strconv.Itoa(i + 1)); err != nil {
+			return err
+		}
+	}
+	return t.writeValue(s, strings.Join(params, sep))
+}
+
+// evalArgs evaluates the function arguments.
+func (t *Template) evalArgs(s *state, node *parse.FuncNode) ([]string, error) {
+	if len(node.Args) == 0 {
+		return nil, nil
+	}
+	if err := t.enter(s, node); err != nil {
+		return nil, err
+	}
+	defer func() { s.depth-- }()
+
 	var w = s.writer
 	var buf bytes.Buffer
 	var args []string
@@ -97,7 +988,7 @@ func (t *Template) evalFunc(s *state, node *parse.FuncNode) error {
 		s.node = n
 		err := t.eval(s)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		args = append(args, buf.String())
 	}
@@ -105,13 +996,133 @@ func (t *Template) evalFunc(s *state, node *parse.FuncNode) error {
 	// restore the origin writer
 	s.writer = w
 	s.node = node
+	return args, nil
+}
 
-	v := s.mapper(node.Param)
+// badNode returns ErrBadNode for the function node.
+func badNode(node *parse.FuncNode) error {
+	return fmt.Errorf("%d:%d: %s: %w: %q with %d arguments", node.Pos.Line, node.Pos.Col, node.Param, ErrBadNode, node.Name, len(node.Args))
+}
 
-	fn := lookupFunc(node.Name, len(args))
+// enter increments the expansion depth when evaluation descends
+// into the arguments of the function node or follows an indirect
+// reference, returning an error if the maximum depth is exceeded.
+func (t *Template) enter(s *state, node *parse.FuncNode) error {
+	s.depth++
+	if s.depth > s.opts.maxDepth {
+		return fmt.Errorf("%d:%d: %s: %w", node.Pos.Line, node.Pos.Col, node.Param, ErrMaxDepth)
+	}
+	return nil
+}
 
-	_, err := io.WriteString(s.writer, fn(v, args...))
-	return err
+// lookup returns the value of the named variable referenced by
+// the function node, and whether the variable is set.
+func (t *Template) lookup(s *state, node *parse.FuncNode, name string) (string, bool, error) {
+	v, ok, err := s.lookup(name)
+	if err == nil && !isDefaultFunc(node.Name) {
+		v, ok = s.fallback(name, v, ok)
+	}
+	switch {
+	case err != nil:
+		return v, ok, &LookupError{Name: name, Pos: node.Pos, Err: err}
+	case v == "" && s.opts.forbidEmpty[name] && !isEmptyDefaultFunc(node.Name):
+		return v, ok, &EmptyError{Name: name, Pos: node.Pos}
+	case !ok && s.opts.strict && !isDefaultFunc(node.Name):
+		err := &UndefinedError{Name: name, Pos: node.Pos}
+		if !s.opts.allUndefined {
+			return v, ok, err
+		}
+		for _, e := range s.undefined {
+			if e.Name == name {
+				return v, ok, nil
+			}
+		}
+		s.undefined = append(s.undefined, err)
+	}
+	if s.opts.recursive && !isLiteral(v, s.opts) {
+		v, err = t.expandValue(s, node, v)
+	}
+	return v, ok, err
+}
+
+// expandValue parses and evaluates the value of a variable, for
+// WithRecursiveExpansion. Each level of expansion counts towards the
+// maximum depth, so values that refer to each other fail with
+// ErrMaxDepth rather than expanding forever.
+func (t *Template) expandValue(s *state, node *parse.FuncNode, v string) (string, error) {
+	if err := t.enter(s, node); err != nil {
+		return "", err
+	}
+	defer func() { s.depth-- }()
+
+	tree := new(parse.Tree)
+	tree.Strict = s.opts.strictSyntax
+	tree.LiteralDoubleDollar = s.opts.literalDollar
+	tree, err := tree.Delims(s.opts.leftDelim, s.opts.rightDelim).Parse(v)
+	if err != nil {
+		return "", err
+	}
+
+	var w, n = s.writer, s.node
+	var buf bytes.Buffer
+	s.writer = &buf
+	s.node = tree.Root
+	err = t.eval(s)
+	s.writer = w
+	s.node = n
+	return buf.String(), err
+}
+
+// names returns the sorted, space separated names of the variables
+// that begin with prefix.
+func (t *Template) names(s *state, prefix string) string {
+	if s.opts.enumerator == nil {
+		return ""
+	}
+	var names []string
+	for _, name := range s.opts.enumerator.Names() {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+// isDefaultFunc returns true if the named function supplies a
+// default for a variable that is not set.
+func isDefaultFunc(name string) bool {
+	switch name {
+	case "=", ":=", ":-", ":?", ":+", "-", "+", "?", ":num:":
+		return true
+	default:
+		return false
+	}
+}
+
+// isEmptyDefaultFunc returns true if the named function supplies a
+// default for a variable that is set to the empty string.
+func isEmptyDefaultFunc(name string) bool {
+	switch name {
+	case ":=", ":-", ":?", ":num:":
+		return true
+	default:
+		return false
+	}
+}
+
+// lookupDecodeFunc returns the decoding function by name, which
+// fails if the value is malformed, or nil if the named function is
+// not a decoding function.
+func lookupDecodeFunc(name string) func(string) (string, error) {
+	switch name {
+	case "@b64d":
+		return fromBase64
+	case "@urld":
+		return fromURLEncoded
+	default:
+		return nil
+	}
 }
 
 // lookupFunc returns the parameters substitution function by name. If the
@@ -126,6 +1137,24 @@ func lookupFunc(name string, args int) substituteFunc {
 		return toUpperFirst
 	case "^^":
 		return toUpper
+	case "~":
+		return toggleFirst
+	case "~~":
+		return toggle
+	case "@U":
+		return toUpper
+	case "@L":
+		return toLower
+	case "@u":
+		return toUpperFirst
+	case "@Q":
+		return toQuoted
+	case "@E":
+		return toUnescaped
+	case "@b64":
+		return toBase64
+	case "@url":
+		return toURLEncoded
 	case "#":
 		if args == 0 {
 			return toLen
@@ -147,10 +1176,6 @@ func lookupFunc(name string, args int) substituteFunc {
 		return replaceFirst
 	case "//":
 		return replaceAll
-	case "=", ":=", ":-":
-		return toDefault
-	case ":?", ":+", "-", "+":
-		return toDefault
 	default:
 		return toDefault
 	}
@@ -0,0 +1,631 @@
+package envsubst
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/drone/envsubst/parse"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestForbidEmpty(t *testing.T) {
+	tmpl, err := Parse("key=${API_KEY}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := tmpl.Execute(func(string) string { return "secret" }, WithForbidEmpty("API_KEY"))
+	if err != nil {
+		t.Errorf("Want populated variable to expand, got error %q", err)
+	}
+	if want := "key=secret"; got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+
+	_, err = tmpl.Execute(func(string) string { return "" }, WithForbidEmpty("API_KEY"))
+	if !errors.Is(err, ErrEmpty) {
+		t.Errorf("Want ErrEmpty for present but empty variable, got %v", err)
+	}
+	var eerr *EmptyError
+	if !errors.As(err, &eerr) || eerr.Name != "API_KEY" || eerr.Pos != (parse.Pos{Line: 1, Col: 5}) {
+		t.Errorf("Want EmptyError for API_KEY at 1:5, got %v", err)
+	}
+	if want := "1:5: API_KEY: parameter null"; err == nil || err.Error() != want {
+		t.Errorf("Want error %q, got %v", want, err)
+	}
+
+	// a default for the empty value is exempt, but not one for an
+	// unset variable only.
+	empty := func(string) string { return "" }
+	for _, text := range []string{"${API_KEY:-none}", "${API_KEY:=none}"} {
+		tmpl, err := Parse(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := tmpl.Execute(empty, WithForbidEmpty("API_KEY")); err != nil || got != "none" {
+			t.Errorf("Want the default of %s used, got %q, %v", text, got, err)
+		}
+	}
+	tmpl, err = Parse("${API_KEY-none}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Execute(empty, WithForbidEmpty("API_KEY")); !errors.Is(err, ErrEmpty) {
+		t.Errorf("Want ErrEmpty for ${API_KEY-none}, got %v", err)
+	}
+	_, err = tmpl.Execute(func(string) string { return "" }, WithForbidEmpty("OTHER"))
+	if err != nil {
+		t.Errorf("Want empty variable not in the list to expand, got error %q", err)
+	}
+}
+
+func TestExecuteConcurrent(t *testing.T) {
+	tmpl, err := Parse("tenant=${TENANT} host=${TENANT,,}.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tenant := fmt.Sprintf("Tenant%d", i)
+			got, err := tmpl.Execute(func(string) string { return tenant })
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			want := fmt.Sprintf("tenant=Tenant%d host=tenant%d.example.com", i, i)
+			if got != want {
+				t.Errorf("Want %q, got %q", want, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestVariables(t *testing.T) {
+	var tests = []struct {
+		input string
+		names []string
+	}{
+		{"text only", nil},
+		{"${HOST}:${PORT}", []string{"HOST", "PORT"}},
+		{"${HOST} ${HOST,,} $HOST", []string{"HOST"}},
+		{"${#NAME}", []string{"NAME"}},
+		{"${A:-${B:-${A}}}", []string{"A", "B"}},
+		{"${path:${offset}:${length}}", []string{"path", "offset", "length"}},
+		{"${path//${from}/${to}}", []string{"path", "from", "to"}},
+		{"$((PORT + ${OFFSET} * 2))", []string{"PORT", "OFFSET"}},
+	}
+
+	for _, test := range tests {
+		tmpl, err := Parse(test.input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if diff := cmp.Diff(test.names, tmpl.Variables()); diff != "" {
+			t.Errorf("Unexpected variables for %q: %s", test.input, diff)
+		}
+	}
+}
+
+type names []string
+
+func (n names) Names() []string { return n }
+
+func TestPrefixNames(t *testing.T) {
+	mapping := func(string) string { return "" }
+	enum := names{"HOST", "HOME", "PATH", "HOSTNAME"}
+
+	var tests = []struct {
+		input  string
+		output string
+		opts   []Option
+	}{
+		{"${!HO*}", "HOME HOST HOSTNAME", []Option{WithEnumerator(enum)}},
+		{"${!HOST@}", "HOST HOSTNAME", []Option{WithEnumerator(enum)}},
+		{"${!USER*}", "", []Option{WithEnumerator(enum)}},
+		{"${!HO*}", "", nil},
+	}
+
+	for _, test := range tests {
+		tmpl, err := Parse(test.input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		got, err := tmpl.Execute(mapping, test.opts...)
+		if err != nil {
+			t.Error(err)
+		}
+		if got != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, got)
+		}
+	}
+}
+
+type lists map[string][]string
+
+func (l lists) List(name string) ([]string, bool) {
+	v, ok := l[name]
+	return v, ok
+}
+
+// maps holds associative arrays, whose values are listed in key order.
+type maps map[string]map[string]string
+
+func (m maps) List(name string) ([]string, bool) {
+	keys, ok := m.Keys(name)
+	var values []string
+	for _, k := range keys {
+		values = append(values, m[name][k])
+	}
+	return values, ok
+}
+
+func (m maps) Keys(name string) ([]string, bool) {
+	v, ok := m[name]
+	var keys []string
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, ok
+}
+
+func TestLister(t *testing.T) {
+	params := map[string]string{"HOST": "localhost", "EMPTY": ""}
+	lookup := func(s string) (string, bool) {
+		v, ok := params[s]
+		return v, ok
+	}
+	list := lists{"SERVERS": {"a.example.com", "b.example.com", "c.example.com"}, "NONE": {}}
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"${SERVERS[@]}", "a.example.com b.example.com c.example.com"},
+		{"${SERVERS[*]}", "a.example.com b.example.com c.example.com"},
+		{"${#SERVERS[@]} ${#SERVERS[*]}", "3 3"},
+		{"${SERVERS[0]} ${SERVERS[ 2 ]}", "a.example.com c.example.com"},
+		{"${SERVERS[-1]}", "c.example.com"},
+		{"${SERVERS[3]}", ""},
+		{"${#SERVERS[1]}", "13"},
+		{"${#NONE[@]}[${NONE[@]}]", "0[]"},
+		{"${SERVERS[${INDEX:-1}]}", "b.example.com"},
+		{"${!SERVERS[@]}|${!SERVERS[*]}|${!NONE[@]}", "0 1 2|0 1 2|"},
+
+		// scalars are a list of one element
+		{"${HOST[0]} ${HOST[@]} ${#HOST[@]}", "localhost localhost 1"},
+		{"[${HOST[1]}]", "[]"},
+		{"${#EMPTY[@]} ${#UNSET[@]}", "1 0"},
+		{"${!HOST[@]} ${!EMPTY[@]}[${!UNSET[@]}]", "0 0[]"},
+	}
+
+	for _, test := range tests {
+		tmpl, err := Parse(test.input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		got, err := tmpl.ExecuteLookup(lookup, WithLister(list))
+		if err != nil {
+			t.Error(err)
+		}
+		if got != test.output {
+			t.Errorf("Want %q expanded to %q, got %q", test.input, test.output, got)
+		}
+	}
+
+	// without a Lister every variable is a scalar
+	got, err := Eval("${SERVERS[0]}|${#SERVERS[@]}", func(string) string { return "x" })
+	if err != nil || got != "x|1" {
+		t.Errorf("Want scalar expansion, got %q, %v", got, err)
+	}
+
+	if _, err := Eval("${SERVERS[x]}", func(string) string { return "x" }); err == nil {
+		t.Errorf("Want bad array subscript error")
+	}
+
+	if _, err := Eval("${SECRET@b64d}", func(string) string { return "not base64" }); err == nil || !strings.Contains(err.Error(), "invalid base64") {
+		t.Errorf("Want invalid base64 error, got %v", err)
+	}
+	if _, err := Eval("${QUERY@urld}", func(string) string { return "100%" }); err == nil || !strings.Contains(err.Error(), "invalid URL escape") {
+		t.Errorf("Want invalid URL escape error, got %v", err)
+	}
+
+	// a Keyer lists the keys of its maps
+	hosts := maps{"HOSTS": {"web": "10.0.0.2", "db": "10.0.0.3"}}
+	got, err = EvalLookup("${!HOSTS[@]}=${HOSTS[@]} ${!HOST[*]}", lookup, WithLister(hosts))
+	if want := "db web=10.0.0.3 10.0.0.2 0"; err != nil || got != want {
+		t.Errorf("Want %q, got %q, %v", want, got, err)
+	}
+}
+
+func TestExecuteTo(t *testing.T) {
+	tmpl, err := Parse("host=${HOST,,}:${PORT:-8080}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping := func(s string) string {
+		return map[string]string{"HOST": "LOCALHOST"}[s]
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.ExecuteTo(&b, mapping); err != nil {
+		t.Error(err)
+	}
+	want, _ := tmpl.Execute(mapping)
+	if got := b.String(); got != want {
+		t.Errorf("Want ExecuteTo to write %q, got %q", want, got)
+	}
+}
+
+func TestMaxOutputSize(t *testing.T) {
+	mapping := func(s string) string {
+		return map[string]string{"BIG": strings.Repeat("a", 1000), "HOST": "localhost"}[s]
+	}
+
+	// a global replacement of a large value trips the limit.
+	if _, err := Eval("${BIG//a/aaaa}", mapping, WithMaxOutputSize(2000)); !errors.Is(err, ErrMaxOutputSize) {
+		t.Errorf("Want ErrMaxOutputSize, got %v", err)
+	}
+	if _, err := Eval("${UNSET:-${BIG//a/aaaa}}", mapping, WithMaxOutputSize(2000)); !errors.Is(err, ErrMaxOutputSize) {
+		t.Errorf("Want ErrMaxOutputSize for a nested value, got %v", err)
+	}
+	if out, err := Eval("${BIG//a/aa}", mapping, WithMaxOutputSize(2000)); err != nil || len(out) != 2000 {
+		t.Errorf("Want output at the limit expanded, got %d bytes, %v", len(out), err)
+	}
+
+	// the output accumulates across substitutions as it is written.
+	tmpl, err := Parse("${BIG} ${BIG} ${BIG}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.ExecuteTo(&b, mapping, WithMaxOutputSize(2500)); !errors.Is(err, ErrMaxOutputSize) {
+		t.Errorf("Want ExecuteTo to return ErrMaxOutputSize, got %v", err)
+	}
+	if b.Len() > 2500 {
+		t.Errorf("Want at most 2500 bytes written, got %d", b.Len())
+	}
+
+	r := tmpl.ExecuteReader(mapping, WithMaxOutputSize(2500))
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, ErrMaxOutputSize) {
+		t.Errorf("Want the reader to return ErrMaxOutputSize, got %v", err)
+	}
+
+	// a string without substitutions is also limited.
+	text := strings.Repeat("a", 100)
+	if _, err := Eval(text, mapping, WithMaxOutputSize(10)); !errors.Is(err, ErrMaxOutputSize) {
+		t.Errorf("Want ErrMaxOutputSize for literal text, got %v", err)
+	}
+	if _, err := EvalLookup(text, func(string) (string, bool) { return "", false }, WithMaxOutputSize(10)); !errors.Is(err, ErrMaxOutputSize) {
+		t.Errorf("Want EvalLookup to return ErrMaxOutputSize for literal text, got %v", err)
+	}
+	if r, err := EvalReader(text, mapping, WithMaxOutputSize(10)); err != nil {
+		t.Error(err)
+	} else if _, err := ioutil.ReadAll(r); !errors.Is(err, ErrMaxOutputSize) {
+		t.Errorf("Want the reader to return ErrMaxOutputSize for literal text, got %v", err)
+	}
+	if out, err := Eval(text, mapping, WithMaxOutputSize(100)); err != nil || out != text {
+		t.Errorf("Want literal text at the limit unchanged, got %q, %v", out, err)
+	}
+}
+
+// benchTemplate is a large template used by the benchmarks.
+var benchTemplate = strings.Repeat("server ${HOST}:${PORT:-8080} user=${USER,,} path=${PATH_PREFIX}/static\n", 100)
+
+func benchMapping(s string) string {
+	switch s {
+	case "HOST":
+		return "localhost"
+	case "USER":
+		return "Admin"
+	}
+	return ""
+}
+
+func BenchmarkExecute(b *testing.B) {
+	tmpl, err := Parse(benchTemplate)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		out, err := tmpl.Execute(benchMapping)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.WriteString(ioutil.Discard, out)
+	}
+}
+
+func BenchmarkExecuteTo(b *testing.B) {
+	tmpl, err := Parse(benchTemplate)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := tmpl.ExecuteTo(ioutil.Discard, benchMapping); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var benchLiteral = strings.Repeat("server localhost:8080 user=admin path=/static\n", 100)
+
+func BenchmarkEvalLiteral(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Eval(benchLiteral, benchMapping); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkParseLiteral parses and executes the same string as
+// BenchmarkEvalLiteral, for comparison.
+func BenchmarkParseLiteral(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tmpl, err := Parse(benchLiteral)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := tmpl.Execute(benchMapping); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkEvalParallel renders many small templates concurrently,
+// as a server rendering a template per request would.
+func BenchmarkEvalParallel(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := Eval("user=${USER,,} host=${HOST}:${PORT:-8080}", benchMapping); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestMaxDepth(t *testing.T) {
+	// a default that refers to the same variable, nested
+	// deeper than the default maximum depth.
+	mapping := func(s string) string { return "" }
+	nested := strings.Repeat("${VAR:-", 60) + "done" + strings.Repeat("}", 60)
+
+	tmpl, err := Parse(nested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Execute(mapping); !errors.Is(err, ErrMaxDepth) {
+		t.Errorf("Want ErrMaxDepth for nesting beyond the default depth, got %v", err)
+	}
+	if got, err := tmpl.Execute(mapping, WithMaxDepth(100)); err != nil || got != "done" {
+		t.Errorf("Want nesting within the maximum depth to expand, got %q, %v", got, err)
+	}
+
+	// each level of nested arguments counts once, however many
+	// variables the template refers to.
+	tmpl, err = Parse("${A}${U:-${U:-${U:-${A}}}}${A}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := func(s string) string { return map[string]string{"A": "a"}[s] }
+	if got, err := tmpl.Execute(values, WithMaxDepth(3)); err != nil || got != "aaa" {
+		t.Errorf("Want three levels expanded with a maximum depth of 3, got %q, %v", got, err)
+	}
+	if _, err := tmpl.Execute(values, WithMaxDepth(2)); !errors.Is(err, ErrMaxDepth) {
+		t.Errorf("Want ErrMaxDepth for three levels with a maximum depth of 2, got %v", err)
+	}
+
+	// an indirect reference that refers to itself.
+	tmpl, err = Parse("${!REF}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cyclic := func(s string) string { return "REF" }
+	if got, err := tmpl.Execute(cyclic); err != nil || got != "REF" {
+		t.Errorf("Want indirect reference to expand a single level, got %q, %v", got, err)
+	}
+	if _, err := tmpl.Execute(cyclic, WithMaxDepth(0)); !errors.Is(err, ErrMaxDepth) {
+		t.Errorf("Want ErrMaxDepth for indirect reference beyond the maximum depth, got %v", err)
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "envsubst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("host=${HOST}\nport=${PORT\n")
+	f.Close()
+
+	_, err = ParseFile(f.Name())
+	perr, ok := err.(*parse.ErrParse)
+	if !ok {
+		t.Fatalf("Want ErrParse, got %v", err)
+	}
+	if perr.Filename != f.Name() || perr.Pos.Line != 2 {
+		t.Errorf("Want error in %s on line 2, got %v", f.Name(), err)
+	}
+	if want := f.Name() + ":2:"; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("Want error message beginning with %q, got %q", want, err)
+	}
+
+	if _, err := ParseFile(f.Name() + ".missing"); !os.IsNotExist(err) {
+		t.Errorf("Want a missing file to return a not exist error, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate("host=${HOST:-localhost} $((${PORT} + 1))"); err != nil {
+		t.Errorf("Want valid template, got %v", err)
+	}
+	err := Validate("host=${HOST}\nport=${PORT:}")
+	perr, ok := err.(*parse.ErrParse)
+	if !ok {
+		t.Fatalf("Want ErrParse, got %v", err)
+	}
+	if perr.Pos.Line != 2 {
+		t.Errorf("Want error on line 2, got %v", err)
+	}
+}
+
+func TestNamedTemplate(t *testing.T) {
+	tmpl, err := New("config.tpl").Parse("host=${HOST}\nport=${PORT:?port is required}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tmpl.Name(), "config.tpl"; got != want {
+		t.Errorf("Want name %q, got %q", want, got)
+	}
+
+	got, err := tmpl.ExecuteString(map[string]string{"HOST": "localhost", "PORT": "8080"})
+	if err != nil {
+		t.Error(err)
+	}
+	if want := "host=localhost\nport=8080"; got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+
+	_, err = tmpl.ExecuteString(map[string]string{"HOST": "localhost"})
+	if want := "config.tpl: "; err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("Want error message beginning with %q, got %v", want, err)
+	}
+	var perr *ParameterError
+	if !errors.As(err, &perr) || perr.Name != "PORT" {
+		t.Errorf("Want ParameterError for PORT, got %v", err)
+	}
+
+	_, err = New("config.tpl").Parse("port=${PORT")
+	if _, ok := err.(*parse.ErrParse); !ok {
+		t.Fatalf("Want ErrParse, got %v", err)
+	}
+	if want := "config.tpl:1:"; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("Want error message beginning with %q, got %q", want, err)
+	}
+}
+
+func TestNotParsed(t *testing.T) {
+	tmpl := New("x")
+	mapping := func(string) string { return "" }
+	want := "template: x: not parsed"
+	if _, err := tmpl.Execute(mapping); err == nil || err.Error() != want {
+		t.Errorf("Want Execute to return %q, got %v", want, err)
+	}
+	if _, err := tmpl.ExecuteContext(context.Background(), func(context.Context, string) (string, error) { return "", nil }); err == nil || err.Error() != want {
+		t.Errorf("Want ExecuteContext to return %q, got %v", want, err)
+	}
+	if _, err := ioutil.ReadAll(tmpl.ExecuteReader(mapping)); err == nil || err.Error() != want {
+		t.Errorf("Want ExecuteReader to return %q, got %v", want, err)
+	}
+	if names := tmpl.Variables(); names != nil {
+		t.Errorf("Want no variables, got %q", names)
+	}
+}
+
+func TestParseOption(t *testing.T) {
+	tmpl, err := Parse("{{HOST}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping := func(string) string { return "localhost" }
+	opts := []Option{WithDelims("{{", "}}"), WithStrictSyntax(), WithBalancedBraces(), WithLiteralDoubleDollar(), WithFirstLine(2), WithDirectives(), WithStripDirectives()}
+	for _, opt := range opts {
+		if _, err := tmpl.Execute(mapping, opt); !errors.Is(err, ErrParseOption) {
+			t.Errorf("Want Execute to return ErrParseOption, got %v", err)
+		}
+	}
+	if _, err := tmpl.ExecuteContext(context.Background(), func(context.Context, string) (string, error) { return "", nil }, WithDelims("{{", "}}")); !errors.Is(err, ErrParseOption) {
+		t.Errorf("Want ExecuteContext to return ErrParseOption, got %v", err)
+	}
+	if _, err := ioutil.ReadAll(tmpl.ExecuteReader(mapping, WithDelims("{{", "}}"))); !errors.Is(err, ErrParseOption) {
+		t.Errorf("Want ExecuteReader to return ErrParseOption, got %v", err)
+	}
+
+	// the Eval functions parse the string with them.
+	if got, err := Eval("{{HOST}}", mapping, WithDelims("{{", "}}")); err != nil || got != "localhost" {
+		t.Errorf("Want Eval to apply WithDelims, got %q, %v", got, err)
+	}
+}
+
+func TestMustExecute(t *testing.T) {
+	tmpl, err := Parse("${HOST:?host is required}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping := func(name string) string {
+		return map[string]string{"HOST": "localhost"}[name]
+	}
+	if got, want := tmpl.MustExecute(mapping), "localhost"; got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Want MustExecute to panic on error")
+		}
+	}()
+	tmpl.MustExecute(func(string) string { return "" })
+}
+
+func TestAddParseTree(t *testing.T) {
+	tree := new(parse.Tree)
+	data := `{"type":"list","nodes":[{"type":"text","value":"host="},{"type":"func","param":"HOST","name":":-","args":[{"type":"text","value":"localhost"}]}]}`
+	if err := json.Unmarshal([]byte(data), tree); err != nil {
+		t.Fatal(err)
+	}
+	tmpl := New("edited").AddParseTree(tree)
+	got, err := tmpl.Execute(func(string) string { return "" })
+	if want := "host=localhost"; err != nil || got != want {
+		t.Errorf("Want %q, got %q, %v", want, got, err)
+	}
+	if got, want := tree.Root.String(), "host=${HOST:-localhost}"; got != want {
+		t.Errorf("Want tree written as %q, got %q", want, got)
+	}
+
+	// a malformed JSON tree is rejected.
+	for _, data := range []string{
+		`{"type":"func","param":"a","name":"["}`,
+		`{"type":"func","param":"a","name":"|"}`,
+	} {
+		if err := json.Unmarshal([]byte(data), new(parse.Tree)); err == nil {
+			t.Errorf("Want %s rejected", data)
+		}
+	}
+
+	// as is a malformed tree built by hand, rather than panicking.
+	for _, name := range []string{"[", "#[", "|"} {
+		tree := &parse.Tree{Root: &parse.FuncNode{Param: "a", Name: name}}
+		_, err := New("bad").AddParseTree(tree).Execute(func(string) string { return "x" })
+		if !errors.Is(err, ErrBadNode) {
+			t.Errorf("Want ErrBadNode for %q without arguments, got %v", name, err)
+		}
+	}
+	tree = &parse.Tree{Root: &parse.FuncNode{Name: "#"}}
+	if _, err := New("bad").AddParseTree(tree).Execute(func(string) string { return "x" }); !errors.Is(err, ErrBadNode) {
+		t.Errorf("Want ErrBadNode for a length without arguments, got %v", err)
+	}
+}